@@ -0,0 +1,325 @@
+package engine
+
+import (
+	"napredni/structures/LRU"
+	"napredni/structures/LSM"
+	"napredni/structures/SStable"
+	"napredni/structures/WAL"
+	"napredni/structures/configReader"
+	"napredni/structures/iterator"
+	"napredni/structures/readPath"
+	"napredni/structures/storageErrors"
+	"napredni/structures/writePath"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// lockFileName is name of the file in the store directory that an
+// engine keeps locked while it is open, so that a store is not opened
+// by two engines at once.
+const lockFileName = "LOCK"
+
+// Errors returned by the engine. Corruption and I/O errors can be
+// inspected further with errors.As and storageErrors.CorruptionError
+// or storageErrors.IOError.
+var (
+	ErrNotFound   = storageErrors.ErrNotFound
+	ErrCorruption = storageErrors.ErrCorruption
+	ErrIO         = storageErrors.ErrIO
+	ErrClosed     = storageErrors.ErrClosed
+	ErrLocked     = storageErrors.ErrLocked
+)
+
+// Iterator walks through live key-value pairs of the store in key order.
+type Iterator = iterator.Iterator
+
+// KeyValue is a single pair returned by Scan and PrefixScan.
+type KeyValue = iterator.KeyValue
+
+// WriteBatch collects puts and deletes that are applied atomically by Write.
+type WriteBatch = writePath.WriteBatch
+
+// WALStats holds counters of group commit of the write-ahead log.
+type WALStats = WAL.CommitStats
+
+// TableStats holds size and compression of a single sstable.
+type TableStats = SStable.Stats
+
+// NewWriteBatch returns an empty write batch.
+func NewWriteBatch() *WriteBatch {
+	return writePath.NewWriteBatch()
+}
+
+// Engine is an embeddable key-value store. It wires together the
+// write-ahead log, the LSM tree with its memtable and the LRU cache,
+// so that other programs can use the store without the console menu.
+// Engine is safe for concurrent use. Reads don't wait for each other,
+// while concurrent writes are committed to the write-ahead log in groups
+// and reach the memtable in the order of their sequence numbers.
+type Engine struct {
+	Dir     string
+	Config  configReader.Config
+	wal     *WAL.WAL
+	lsm     *LSM.LSM
+	flusher *writePath.Flusher
+	cache   *LRU.ShardedCache
+	lock    *os.File
+	// mutex is held for reading by every operation and for writing by Close.
+	mutex  sync.RWMutex
+	closed bool
+}
+
+// Open opens the store located in dir using passed configuration.
+// Every file of the store is kept inside of dir, so several stores
+// can be opened at the same time as long as their directories differ.
+// Records left in the write-ahead log are replayed into the memtable.
+// If the store is already opened by another engine, ErrLocked is returned.
+// Full memtables are flushed and levels are compacted in the background.
+func Open(dir string, config configReader.Config) (*Engine, error) {
+	err := SStable.FormDirectories(dir)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	mem := writePath.InitializeMemTable(float64(config.SegmentSize), config.MemtableThreshold)
+	lsm, err := writePath.InitializeLSM(dir, mem, &config)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	err = lsm.UpdateLSM()
+	if err != nil {
+		lsm.Close()
+		lock.Close()
+		return nil, err
+	}
+
+	wal, err := writePath.InitializeWAL(config.GetWalPath(dir), config.Lwm, config.WalSegmentSize,
+		config.WalSync, config.WalSyncInterval, config.WalGroupCommitWindow, config.WalRecovery)
+	if err != nil {
+		lsm.Close()
+		lock.Close()
+		return nil, err
+	}
+	wal.SkipSeqNumsUpTo(lsm.MaxSeqNum())
+	err = writePath.WALToMemtable(wal, lsm)
+	if err != nil {
+		wal.Close()
+		lsm.Close()
+		lock.Close()
+		return nil, err
+	}
+	flusher := writePath.StartFlusher(wal, lsm, config.MaxImmutableMemtables)
+	cache := LRU.NewSharded(config.CacheSize, LRU.NumOfShards)
+
+	return &Engine{
+		Dir:     dir,
+		Config:  config,
+		wal:     wal,
+		lsm:     lsm,
+		flusher: flusher,
+		cache:   cache,
+		lock:    lock,
+	}, nil
+}
+
+// lockDir locks the lock file of the store in passed directory.
+func lockDir(dir string) (*os.File, error) {
+	path := filepath.Join(dir, lockFileName)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, storageErrors.NewIO("open", path, err)
+	}
+	err = lockFile(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// Get returns value for passed key. If key doesn't exist, ErrNotFound is returned.
+func (engine *Engine) Get(key string) ([]byte, error) {
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	if engine.closed {
+		return nil, ErrClosed
+	}
+	return readPath.Get(engine.cache, engine.lsm, key)
+}
+
+// Put adds or updates passed key with passed value.
+func (engine *Engine) Put(key string, value []byte) error {
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	if engine.closed {
+		return ErrClosed
+	}
+	err := writePath.Put(engine.wal, engine.lsm, engine.flusher, key, value)
+	engine.cache.Remove(key)
+	return err
+}
+
+// Delete deletes passed key. If key doesn't exist, ErrNotFound is returned.
+func (engine *Engine) Delete(key string) error {
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	if engine.closed {
+		return ErrClosed
+	}
+	return writePath.Delete(engine.wal, engine.cache, engine.lsm, engine.flusher, key)
+}
+
+// Write applies all changes from passed batch atomically. After a crash
+// either all of them are recovered from the write-ahead log or none.
+func (engine *Engine) Write(batch *WriteBatch) error {
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	if engine.closed {
+		return ErrClosed
+	}
+	err := writePath.Write(engine.wal, engine.lsm, engine.flusher, batch)
+	for _, rec := range batch.Records {
+		engine.cache.Remove(rec.Key)
+	}
+	return err
+}
+
+// NewIterator returns iterator over all live pairs of the store. It merges
+// the memtable with every sstable, so only the most recent value of each
+// key is visible and deleted keys are skipped. Iterator must be closed.
+// Iterator sees the memtable as it changes, so it should be used through
+// a snapshot while other goroutines write.
+func (engine *Engine) NewIterator() (Iterator, error) {
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	if engine.closed {
+		return nil, ErrClosed
+	}
+	it, err := readPath.NewIterator(engine.lsm)
+	if err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// Scan returns live pairs whose keys are in range [start, end) in key
+// order. Empty end means that range has no upper bound, and limit that
+// is not positive means that number of returned pairs is not limited.
+func (engine *Engine) Scan(start, end string, limit int) ([]KeyValue, error) {
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	if engine.closed {
+		return nil, ErrClosed
+	}
+	return readPath.Scan(engine.lsm, start, end, limit)
+}
+
+// PrefixScan returns all live pairs whose keys start with prefix, in key order.
+func (engine *Engine) PrefixScan(prefix string) ([]KeyValue, error) {
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	if engine.closed {
+		return nil, ErrClosed
+	}
+	return readPath.PrefixScan(engine.lsm, prefix)
+}
+
+// RecoveryErrors returns corruption errors for parts of the write-ahead
+// log that were skipped when the store was opened, including a partial
+// record at its end that was left by an interrupted write, and for
+// sstables that were quarantined.
+func (engine *Engine) RecoveryErrors() []error {
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	if engine.closed {
+		return nil
+	}
+	return append(append([]error{}, engine.wal.Corruptions...), engine.lsm.Corruptions...)
+}
+
+// WALStats returns counters of group commit of the write-ahead log,
+// which show how many writes share a sync and how long they wait.
+func (engine *Engine) WALStats() (WALStats, error) {
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	if engine.closed {
+		return WALStats{}, ErrClosed
+	}
+	return engine.wal.Stats(), nil
+}
+
+// TableStats returns stats of every sstable, by levels from the first one.
+func (engine *Engine) TableStats() ([]TableStats, error) {
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	if engine.closed {
+		return nil, ErrClosed
+	}
+	_, version := engine.lsm.Acquire()
+	defer version.Release()
+	stats := make([]TableStats, 0)
+	for _, level := range version.Levels {
+		for i := range level {
+			tableStats, err := level[i].Stats()
+			if err != nil {
+				return nil, err
+			}
+			stats = append(stats, tableStats)
+		}
+	}
+	return stats, nil
+}
+
+// Flush writes the memtable to an sstable and waits until all memtables
+// that were waiting to be flushed are on disk, e.g. before a backup.
+func (engine *Engine) Flush() error {
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	if engine.closed {
+		return ErrClosed
+	}
+	return engine.flusher.Flush()
+}
+
+// CompactRange flushes the memtable and rewrites every sstable whose keys
+// overlap range [start, end) into the last level, dropping tombstones and
+// versions that are no longer needed, e.g. after a bulk delete. Empty end
+// means that range has no upper bound.
+func (engine *Engine) CompactRange(start, end string) error {
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	if engine.closed {
+		return ErrClosed
+	}
+	return engine.flusher.CompactRange(start, end)
+}
+
+// Close flushes the memtable to disk, waits for the background flush
+// to finish and releases the engine. Engine must not be used after it is closed.
+func (engine *Engine) Close() error {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	if engine.closed {
+		return ErrClosed
+	}
+	err := engine.flusher.Close()
+	for _, closeErr := range []error{engine.wal.Close(), engine.lsm.Close(),
+		storageErrors.NewIO("close", engine.lock.Name(), engine.lock.Close())} {
+		if err == nil {
+			err = closeErr
+		}
+	}
+	engine.closed = true
+	engine.wal = nil
+	engine.lsm = nil
+	engine.flusher = nil
+	engine.cache = nil
+	engine.lock = nil
+	return err
+}
@@ -0,0 +1,677 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"napredni/structures/configReader"
+)
+
+// testConfig returns default configuration with a small memtable,
+// so that tests flush and compact often.
+func testConfig() configReader.Config {
+	config := configReader.Config{}
+	config.FillDefaults()
+	config.SegmentSize = 50
+	return config
+}
+
+func openTestEngine(t *testing.T, dir string, config configReader.Config) *Engine {
+	t.Helper()
+	db, err := Open(dir, config)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() {
+		err := db.Close()
+		if err != nil && !errors.Is(err, ErrClosed) {
+			t.Error(err)
+		}
+	})
+	return db
+}
+
+func expectValue(t *testing.T, db *Engine, key, value string) {
+	t.Helper()
+	got, err := db.Get(key)
+	if err != nil {
+		t.Fatalf("get %q: %v", key, err)
+	}
+	if string(got) != value {
+		t.Fatalf("get %q: got %q, want %q", key, got, value)
+	}
+}
+
+// Sequence numbers must continue after the last flushed one even when
+// the sequence file is lost and segments that held them are deleted.
+func TestSeqNumsContinueAfterFlushedOnes(t *testing.T) {
+	dir := t.TempDir()
+	config := testConfig()
+	config.Lwm = 1
+
+	db := openTestEngine(t, dir, config)
+	err := db.Put("k", []byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(filepath.Join(config.GetWalPath(dir), "sequence"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestEngine(t, dir, config)
+	err = db.Put("k", []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Store is copied while the engine is open, so the copy holds
+	// the put only in the wal, as if the process crashed after it.
+	crashed := copyStore(t, dir)
+
+	db = openTestEngine(t, crashed, config)
+	expectValue(t, db, "k", "new")
+}
+
+// copyStore copies every file of the store in passed directory
+// to a temporary directory and returns it.
+func copyStore(t *testing.T, dir string) string {
+	t.Helper()
+	copied := t.TempDir()
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return os.MkdirAll(filepath.Join(copied, relPath), 0777)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(copied, relPath), data, 0777)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return copied
+}
+
+// Store can't be opened by a second engine until the first one is closed.
+func TestStoreIsLocked(t *testing.T) {
+	dir := t.TempDir()
+	config := testConfig()
+	db := openTestEngine(t, dir, config)
+	err := db.Put("k", []byte("v"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Open(dir, config)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("second open: got %v, want locked", err)
+	}
+	expectValue(t, db, "k", "v")
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestEngine(t, dir, config)
+	expectValue(t, db, "k", "v")
+}
+
+// copyFixtures copies files of the store in data fixtures, which was
+// written before sequence numbers and the manifest were added, from
+// passed directories to a temporary directory and returns it.
+func copyFixtures(t *testing.T, subDirs ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, subDir := range subDirs {
+		files, err := os.ReadDir(filepath.Join("..", "data", subDir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.MkdirAll(filepath.Join(dir, subDir), 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(filepath.Join("..", "data", subDir, file.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(filepath.Join(dir, subDir, file.Name()), data, 0777)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return dir
+}
+
+// Store written in baseline formats is opened, and its records, whose
+// timestamps are used as sequence numbers, are older than new ones.
+func TestBaselineStoreIsOpened(t *testing.T) {
+	dir := copyFixtures(t, "data", "index", "summary", "filter", "metadata", "toc", "wal")
+	config := testConfig()
+
+	db := openTestEngine(t, dir, config)
+	expectValue(t, db, "pera1", "peki123")
+	expectValue(t, db, "pera4", "peki123")
+	expectValue(t, db, "pera5", "peki123")
+	_, err := db.Get("pera2")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("get deleted pera2: got %v, want not found", err)
+	}
+
+	err = db.Put("pera1", []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Delete("pera3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, db, "pera1", "new")
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestEngine(t, dir, config)
+	expectValue(t, db, "pera1", "new")
+	_, err = db.Get("pera3")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("get deleted pera3: got %v, want not found", err)
+	}
+}
+
+// Sstables of a store without the manifest that can't be read are moved
+// to the quarantine directory instead of being deleted as orphans.
+func TestUnreadableSStablesAreQuarantined(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		subDir string
+		damage func(data []byte) []byte
+	}{
+		{"cut off summary", "summary", func(data []byte) []byte { return data[:10] }},
+		{"corrupt record", "data", func(data []byte) []byte {
+			data[len(data)-1] ^= 0xff
+			return data
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := copyFixtures(t, "data", "index", "summary", "filter", "metadata", "toc")
+			path := filepath.Join(dir, test.subDir, "usertable_1_1_"+test.subDir+".db")
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(path, test.damage(data), 0777)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			db := openTestEngine(t, dir, testConfig())
+			recoveryErrors := db.RecoveryErrors()
+			if len(recoveryErrors) != 1 || !errors.Is(recoveryErrors[0], ErrCorruption) {
+				t.Fatalf("recovery errors: %v", recoveryErrors)
+			}
+			_, err = db.Get("pera1")
+			if !errors.Is(err, ErrNotFound) {
+				t.Fatalf("get pera1: got %v, want not found", err)
+			}
+			for _, subDir := range []string{"data", "index", "summary", "filter", "metadata"} {
+				name := "usertable_1_1_" + subDir + ".db"
+				_, err = os.Stat(filepath.Join(dir, "quarantine", name))
+				if err != nil {
+					t.Fatalf("%s is not quarantined: %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+// New records must be newer than records of baseline sstables even if
+// the wal doesn't hold records with greater timestamps.
+func TestSeqNumsExceedBaselineSStables(t *testing.T) {
+	dir := copyFixtures(t, "data", "index", "summary", "filter", "metadata", "toc")
+	config := testConfig()
+
+	db := openTestEngine(t, dir, config)
+	err := db.Put("pera1", []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, db, "pera1", "new")
+	err = db.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The greatest sequence number of baseline sstables
+	// is kept in the manifest once the wal is gone.
+	err = os.RemoveAll(config.GetWalPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = openTestEngine(t, dir, config)
+	err = db.Put("pera2", []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, db, "pera1", "new")
+	expectValue(t, db, "pera2", "new")
+}
+
+// Gets, puts and deletes from many goroutines must be safe while
+// memtables are flushed and levels compacted in the background.
+// Run with -race.
+func TestConcurrentReadersAndWriters(t *testing.T) {
+	const writers, readers, keysPerWriter, rounds = 4, 4, 50, 20
+	db := openTestEngine(t, t.TempDir(), testConfig())
+
+	var writersDone sync.WaitGroup
+	errs := make(chan error, writers+readers)
+	for w := 0; w < writers; w++ {
+		writersDone.Add(1)
+		go func(w int) {
+			defer writersDone.Done()
+			for round := 0; round < rounds; round++ {
+				for i := 0; i < keysPerWriter; i++ {
+					key := fmt.Sprintf("w%d/%03d", w, i)
+					var err error
+					if (i+round)%5 == 0 {
+						err = db.Delete(key)
+						if errors.Is(err, ErrNotFound) {
+							err = nil
+						}
+					} else {
+						err = db.Put(key, []byte(fmt.Sprintf("%s=%d", key, round)))
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(w)
+	}
+
+	stop := make(chan struct{})
+	var readersDone sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		readersDone.Add(1)
+		go func(r int) {
+			defer readersDone.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := fmt.Sprintf("w%d/%03d", (r+i)%writers, i%keysPerWriter)
+				value, err := db.Get(key)
+				if errors.Is(err, ErrNotFound) {
+					continue
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !strings.HasPrefix(string(value), key+"=") {
+					errs <- fmt.Errorf("get %q: got %q", key, value)
+					return
+				}
+			}
+		}(r)
+	}
+
+	writersDone.Wait()
+	close(stop)
+	readersDone.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	last := rounds - 1
+	for w := 0; w < writers; w++ {
+		for i := 0; i < keysPerWriter; i++ {
+			key := fmt.Sprintf("w%d/%03d", w, i)
+			if (i+last)%5 == 0 {
+				_, err := db.Get(key)
+				if !errors.Is(err, ErrNotFound) {
+					t.Fatalf("get %q: got %v, want ErrNotFound", key, err)
+				}
+				continue
+			}
+			expectValue(t, db, key, fmt.Sprintf("%s=%d", key, last))
+		}
+	}
+}
+
+// expectModel checks that every key of passed keys has the value from
+// the model, or is missing if the model doesn't hold it.
+func expectModel(t *testing.T, get func(string) ([]byte, error), model map[string]string, keys []string) {
+	t.Helper()
+	for _, key := range keys {
+		value, found := model[key]
+		got, err := get(key)
+		if !found {
+			if !errors.Is(err, ErrNotFound) {
+				t.Fatalf("get %q: got %q, %v, want ErrNotFound", key, got, err)
+			}
+			continue
+		}
+		if err != nil || string(got) != value {
+			t.Fatalf("get %q: got %q, %v, want %q", key, got, err, value)
+		}
+	}
+}
+
+// The engine must behave like a map across random puts, deletes, flushes
+// and compactions with both strategies, so compaction never drops a
+// tombstone while an older version of its key can still be read.
+func TestEngineMatchesMapModel(t *testing.T) {
+	for _, strategy := range []string{"leveled", "size_tiered"} {
+		for seed := int64(1); seed <= 3; seed++ {
+			t.Run(fmt.Sprintf("%s/%d", strategy, seed), func(t *testing.T) {
+				testMapModel(t, strategy, seed)
+			})
+		}
+	}
+}
+
+func testMapModel(t *testing.T, strategy string, seed int64) {
+	random := rand.New(rand.NewSource(seed))
+	dir := t.TempDir()
+	config := testConfig()
+	config.SegmentSize = 40 + random.Intn(60)
+	config.LsmLevelMax = 2 + random.Intn(3)
+	config.LsmBaseLevelSize = uint64(500 + random.Intn(2000))
+	config.LsmLevelSizeMultiplier = 2 + random.Intn(3)
+	config.SSTableTargetSize = uint64(300 + random.Intn(1500))
+	config.SizeTieredThreshold = 2 + random.Intn(3)
+	config.CompactionStrategy = strategy
+
+	keys := make([]string, 100+random.Intn(200))
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%04d", i)
+	}
+	model := make(map[string]string)
+	for reopen := 0; reopen < 3; reopen++ {
+		db := openTestEngine(t, dir, config)
+		expectModel(t, db.Get, model, keys)
+
+		var snapshot *Snapshot
+		var snapshotModel map[string]string
+		for i := 0; i < 800; i++ {
+			key := keys[random.Intn(len(keys))]
+			var err error
+			switch operation := random.Intn(100); {
+			case operation < 35:
+				err = db.Delete(key)
+				if errors.Is(err, ErrNotFound) {
+					err = nil
+				}
+				delete(model, key)
+			case operation < 37:
+				err = db.Flush()
+			case operation < 38:
+				start, end := keys[random.Intn(len(keys))], keys[random.Intn(len(keys))]
+				if start > end {
+					start, end = end, start
+				}
+				err = db.CompactRange(start, end)
+			case operation < 39 && snapshot == nil:
+				snapshot, err = db.Snapshot()
+				snapshotModel = make(map[string]string, len(model))
+				for key, value := range model {
+					snapshotModel[key] = value
+				}
+			default:
+				value := fmt.Sprintf("%d/%d", reopen, i)
+				err = db.Put(key, []byte(value))
+				model[key] = value
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		expectModel(t, db.Get, model, keys)
+		if snapshot != nil {
+			expectModel(t, snapshot.Get, snapshotModel, keys)
+			snapshot.Release()
+		}
+		err := db.CompactRange("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectModel(t, db.Get, model, keys)
+		pairs, err := db.Scan("", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pairs) != len(model) {
+			t.Fatalf("scan returned %d pairs, model holds %d", len(pairs), len(model))
+		}
+		for _, pair := range pairs {
+			if model[pair.Key] != string(pair.Value) {
+				t.Fatalf("scan %q: got %q, want %q", pair.Key, pair.Value, model[pair.Key])
+			}
+		}
+		err = db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Size-tiered compaction merges full buckets of the last level in place
+// into a single larger table, so under sustained writes the last level
+// holds less than threshold tables of every size tier, and number of
+// tiers grows with the logarithm of number of flushes.
+func TestSizeTieredLastLevelStaysBounded(t *testing.T) {
+	const rounds = 200
+	config := testConfig()
+	config.CompactionStrategy = "size_tiered"
+	config.SizeTieredThreshold = 3
+	config.LsmLevels = 2
+	db := openTestEngine(t, t.TempDir(), config)
+
+	tiers := 1
+	for flushes := 1; flushes < rounds; flushes *= config.SizeTieredThreshold {
+		tiers++
+	}
+	maxTables := (config.SizeTieredThreshold - 1) * tiers
+	for round := 0; round < rounds; round++ {
+		for i := 0; i < 20; i++ {
+			err := db.Put(fmt.Sprintf("key%06d", round*20+i), []byte("value"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := db.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats, err := db.TableStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lastLevelTables := 0
+		for _, tableStats := range stats {
+			if tableStats.Level == config.LsmLevels {
+				lastLevelTables++
+			}
+		}
+		if lastLevelTables > maxTables {
+			t.Fatalf("round %d: %d tables on the last level, want at most %d", round, lastLevelTables, maxTables)
+		}
+	}
+	expectValue(t, db, "key000000", "value")
+	expectValue(t, db, fmt.Sprintf("key%06d", rounds*20-1), "value")
+}
+
+// Reverse iteration and prefix scan merge the memtable, immutable memtables
+// and sstables, so newer versions and tombstones of every source hide older
+// versions of the same key.
+func TestReverseIterationAndPrefixScanMergeAllSources(t *testing.T) {
+	config := testConfig()
+	config.SegmentSize = 1000
+	db := openTestEngine(t, t.TempDir(), config)
+
+	put := func(key, value string) {
+		t.Helper()
+		err := db.Put(key, []byte(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	remove := func(key string) {
+		t.Helper()
+		err := db.Delete(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"a1", "a2", "a3", "a4", "a5", "b1", "b2"} {
+		put(key, "sst")
+	}
+	err := db.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	put("a3", "sst2")
+	err = db.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	put("a2", "imm")
+	put("a6", "imm")
+	remove("b1")
+	// Immutable memtable is added past the flusher,
+	// so it isn't flushed while the test reads it.
+	db.lsm.AddImmutable()
+	if len(db.lsm.Current().Immutables) != 1 {
+		t.Fatalf("immutables: %d", len(db.lsm.Current().Immutables))
+	}
+	put("a4", "mem")
+	put("a0", "mem")
+	put("c1", "mem")
+	remove("a5")
+
+	want := []string{"a0=mem", "a1=sst", "a2=imm", "a3=sst2", "a4=mem", "a6=imm", "b2=sst", "c1=mem"}
+	it, err := db.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0)
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		got = append([]string{it.Key() + "=" + string(it.Value())}, got...)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("reverse iteration: got %v, want %v", got, want)
+	}
+	it.Seek("a5")
+	if !it.Valid() || it.Key() != "a6" {
+		t.Fatalf("seek a5: got valid %v", it.Valid())
+	}
+	it.Prev()
+	if !it.Valid() || it.Key() != "a4" || string(it.Value()) != "mem" {
+		t.Fatalf("prev after seek: got valid %v", it.Valid())
+	}
+	err = it.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for prefix, want := range map[string]string{
+		"a": "[a0=mem a1=sst a2=imm a3=sst2 a4=mem a6=imm]",
+		"b": "[b2=sst]",
+		"d": "[]",
+	} {
+		pairs, err := db.PrefixScan(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, 0)
+		for _, pair := range pairs {
+			got = append(got, pair.Key+"="+string(pair.Value))
+		}
+		if fmt.Sprint(got) != want {
+			t.Fatalf("prefix %q: got %v, want %s", prefix, got, want)
+		}
+	}
+}
+
+// Concurrent writes are committed in groups that share a single sync,
+// and every write and sync is counted by WALStats.
+func TestConcurrentWritersShareSync(t *testing.T) {
+	const writers = 20
+	config := testConfig()
+	config.WalGroupCommitWindow = 50 * time.Millisecond
+	db := openTestEngine(t, t.TempDir(), config)
+
+	start := make(chan struct{})
+	errs := make(chan error, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			errs <- db.Put(fmt.Sprintf("key%02d", i), []byte("value"))
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := db.WALStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Writes != writers {
+		t.Fatalf("writes: got %d, want %d", stats.Writes, writers)
+	}
+	if stats.Syncs != stats.Groups || stats.Syncs >= stats.Writes {
+		t.Fatalf("%d writes were committed in %d groups with %d syncs", stats.Writes, stats.Groups, stats.Syncs)
+	}
+	if stats.Latency == 0 || stats.MaxLatency < config.WalGroupCommitWindow {
+		t.Fatalf("latency: %v, max %v", stats.Latency, stats.MaxLatency)
+	}
+	for i := 0; i < writers; i++ {
+		expectValue(t, db, fmt.Sprintf("key%02d", i), "value")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package engine
+
+import "os"
+
+// lockFile is not supported, so a store can be opened more than once.
+func lockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"napredni/structures/storageErrors"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock of passed file, which the system
+// releases when the file is closed, including when the process dies.
+func lockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return fmt.Errorf("%s: %w", file.Name(), storageErrors.ErrLocked)
+	}
+	return storageErrors.NewIO("flock", file.Name(), err)
+}
@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"napredni/structures/readPath"
+)
+
+// Snapshot is a consistent point-in-time view of the store. Reads
+// through a snapshot ignore every write made after it was taken, and
+// compaction keeps versions that the snapshot can see until it is released.
+type Snapshot struct {
+	engine   *Engine
+	seqNum   uint64
+	released bool
+}
+
+// Snapshot returns a snapshot of the current state of the store.
+// Snapshot must be released when it is no longer needed.
+func (engine *Engine) Snapshot() (*Snapshot, error) {
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	if engine.closed {
+		return nil, ErrClosed
+	}
+	// Every write up to the committed sequence number is already in the
+	// memtable, and versions that the snapshot sees can't be dropped by
+	// a write that is applied before the snapshot is acquired.
+	seqNum := engine.wal.PinCommittedSeqNum(engine.lsm.Snapshots.Acquire)
+	return &Snapshot{engine: engine, seqNum: seqNum}, nil
+}
+
+// SeqNum returns sequence number of the last write visible to the snapshot.
+func (snapshot *Snapshot) SeqNum() uint64 {
+	return snapshot.seqNum
+}
+
+// Get returns value that passed key had when the snapshot was taken.
+// If key didn't exist then, ErrNotFound is returned.
+func (snapshot *Snapshot) Get(key string) ([]byte, error) {
+	snapshot.engine.mutex.RLock()
+	defer snapshot.engine.mutex.RUnlock()
+	err := snapshot.check()
+	if err != nil {
+		return nil, err
+	}
+	return readPath.GetAt(snapshot.engine.lsm, key, snapshot.seqNum)
+}
+
+// NewIterator returns iterator over pairs that were live when the
+// snapshot was taken. Iterator must be closed.
+func (snapshot *Snapshot) NewIterator() (Iterator, error) {
+	snapshot.engine.mutex.RLock()
+	defer snapshot.engine.mutex.RUnlock()
+	err := snapshot.check()
+	if err != nil {
+		return nil, err
+	}
+	it, err := readPath.NewIteratorAt(snapshot.engine.lsm, snapshot.seqNum)
+	if err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// Scan works like Engine.Scan on the state of the store when the snapshot was taken.
+func (snapshot *Snapshot) Scan(start, end string, limit int) ([]KeyValue, error) {
+	snapshot.engine.mutex.RLock()
+	defer snapshot.engine.mutex.RUnlock()
+	err := snapshot.check()
+	if err != nil {
+		return nil, err
+	}
+	return readPath.ScanAt(snapshot.engine.lsm, start, end, limit, snapshot.seqNum)
+}
+
+// Release releases the snapshot, so that compaction can drop versions
+// that only it could see. Released snapshot must not be used.
+func (snapshot *Snapshot) Release() {
+	snapshot.engine.mutex.RLock()
+	defer snapshot.engine.mutex.RUnlock()
+	if snapshot.released || snapshot.engine.closed {
+		snapshot.released = true
+		return
+	}
+	snapshot.engine.lsm.Snapshots.Release(snapshot.seqNum)
+	snapshot.released = true
+}
+
+// check returns ErrClosed if the snapshot or its engine can't be used.
+func (snapshot *Snapshot) check() error {
+	if snapshot.released || snapshot.engine.closed {
+		return ErrClosed
+	}
+	return nil
+}
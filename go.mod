@@ -1,12 +1,7 @@
 module napredni
 
-go 1.17
+go 1.19
 
 require github.com/spaolacci/murmur3 v1.1.0
 
-require (
-	github.com/edsrzf/mmap-go v1.1.0
-	gopkg.in/yaml.v2 v2.4.0
-)
-
-require golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
+require gopkg.in/yaml.v2 v2.4.0
@@ -2,56 +2,34 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"napredni/engine"
 	"napredni/menu"
 	"napredni/structures/CMS"
 	"napredni/structures/HLL"
-	"napredni/structures/LRU"
-	"napredni/structures/LSM"
-	"napredni/structures/WAL"
 	"napredni/structures/configReader"
-	"napredni/structures/readPath"
-	"napredni/structures/record"
 	"napredni/structures/writePath"
 	"os"
 	"time"
 )
 
-func WALToMemtable(wal *WAL.WAL, lsm *LSM.LSM) {
-	for _, segmentPath := range wal.SegmentPaths {
-		file, err := os.OpenFile(segmentPath, os.O_RDWR, 0777)
-		if err != nil {
-			panic(err)
-		}
-		defer file.Close()
-		reader := bufio.NewReader(file)
-		rec := record.Record{}
-		for {
-			if rec.DecodeRecord(reader) {
-				break
-			}
-
-			if rec.Crc == WAL.CRC32(rec.Value) {
-				var _, _, _ = lsm.MemTable.AddRecord(rec)
-			} else {
-				panic("CRC is not compatible!")
-			}
-		}
-	}
-}
-
 func App() {
 	var config configReader.Config
-	config.ReadConfig()
+	err := config.ReadConfig("data")
+	if err != nil {
+		panic(err)
+	}
 
-	mem := writePath.InitializeMemTable(float64(config.SegmentSize), config.MemtableThreshold)
-	lsm := writePath.InitializeLSM(mem, config.LsmLevels, config.LsmLevelMax)
-	lsm.UpdateLSM()
+	db, err := engine.Open("data", config)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		menu.PrintError(db.Close())
+	}()
 
-	wal := writePath.InitializeWAL(config.Lwm, config.SegmentSize)
 	tb := writePath.InitializeTokenBucket(config.TokenTime, config.TokenRequests)
-	WALToMemtable(wal, lsm)
-	cache := LRU.New(config.CacheSize)
 
 	hll := HLL.HLL{}
 	cms := CMS.CountMinSketch{}
@@ -70,7 +48,7 @@ func App() {
 				i = 1
 			}
 			if tb.Handler() {
-				writePath.Put(wal, lsm, key, value)
+				menu.PrintError(db.Put(key, value))
 				fmt.Println("Uspešan zahtev.")
 			} else {
 				fmt.Println("Neuspešan zahtev.")
@@ -84,8 +62,11 @@ func App() {
 				i = 1
 			}
 			if tb.Handler() {
-				success := writePath.Delete(wal, cache, lsm, key)
-				fmt.Println(success)
+				err := db.Delete(key)
+				fmt.Println(err == nil)
+				if !errors.Is(err, engine.ErrNotFound) {
+					menu.PrintError(err)
+				}
 				fmt.Println("Uspešan zahtev.")
 			} else {
 				fmt.Println("Neuspešan zahtev.")
@@ -98,13 +79,15 @@ func App() {
 				i = 1
 			}
 			if tb.Handler() {
-				found, bytes := readPath.Get(cache, lsm, key)
+				bytes, err := db.Get(key)
 				fmt.Println("Uspešan zahtev.")
 
-				if found {
+				if err == nil {
 					fmt.Println("Ključ:", key+", Vrednost:", string(bytes))
-				} else {
+				} else if errors.Is(err, engine.ErrNotFound) {
 					fmt.Println("Nije pronađen element za uneti ključ.")
+				} else {
+					menu.PrintError(err)
 				}
 			} else {
 				fmt.Println("Neuspešan zahtev.")
@@ -117,7 +100,7 @@ func App() {
 			}
 			if tb.Handler() {
 				fmt.Println("Uspešan zahtev.")
-				menu.FirstMenuCMS(cms, wal, lsm, cache, tb, i)
+				menu.FirstMenuCMS(cms, db, tb, i)
 			} else {
 				fmt.Println("Neuspešan zahtev.")
 			}
@@ -129,11 +112,42 @@ func App() {
 			}
 			if tb.Handler() {
 				fmt.Println("Uspešan zahtev.")
-				menu.FirstMenuHLL(hll, wal, lsm, cache, tb, i)
+				menu.FirstMenuHLL(hll, db, tb, i)
 			} else {
 				fmt.Println("Neuspešan zahtev.")
 			}
 		} else if command == "6" {
+			if i == 0 {
+				tb.Start = time.Now()
+				tb.AvailableRequests--
+				i = 1
+			}
+			if tb.Handler() {
+				err := db.Flush()
+				menu.PrintError(err)
+				if err == nil {
+					fmt.Println("Memtabela je upisana na disk.")
+				}
+			} else {
+				fmt.Println("Neuspešan zahtev.")
+			}
+		} else if command == "7" {
+			start, end := menu.GetKeyRangeFromUser(reader)
+			if i == 0 {
+				tb.Start = time.Now()
+				tb.AvailableRequests--
+				i = 1
+			}
+			if tb.Handler() {
+				err := db.CompactRange(start, end)
+				menu.PrintError(err)
+				if err == nil {
+					fmt.Println("Kompakcija je završena.")
+				}
+			} else {
+				fmt.Println("Neuspešan zahtev.")
+			}
+		} else if command == "8" {
 			break
 		} else {
 			fmt.Println("Pogrešan unos.")
@@ -2,15 +2,12 @@ package menu
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"napredni/engine"
 	"napredni/structures/CMS"
 	"napredni/structures/HLL"
-	"napredni/structures/LRU"
-	"napredni/structures/LSM"
-	"napredni/structures/WAL"
-	"napredni/structures/readPath"
 	"napredni/structures/tokenBucket"
-	"napredni/structures/writePath"
 	"os"
 	"strings"
 	"time"
@@ -24,7 +21,9 @@ func PrintMenu() {
 	fmt.Println("3 - Pretraga baze podataka za uneti ključ.")
 	fmt.Println("4 - CMS funkcionalnosti")
 	fmt.Println("5 - HLL funkcionalnosti")
-	fmt.Println("6 - Izlazak iz programa.")
+	fmt.Println("6 - Upisivanje memtabele na disk.")
+	fmt.Println("7 - Kompakcija opsega ključeva.")
+	fmt.Println("8 - Izlazak iz programa.")
 }
 
 func PrintMenuHLL() {
@@ -61,7 +60,7 @@ func HandlerCMS() {
 	fmt.Println("3 - Korak nazad")
 }
 
-func FirstMenuCMS(cms CMS.CountMinSketch, wal *WAL.WAL, lsm *LSM.LSM, cache *LRU.CacheLRU, tb *tokenBucket.TokenBucket, i int) {
+func FirstMenuCMS(cms CMS.CountMinSketch, db *engine.Engine, tb *tokenBucket.TokenBucket, i int) {
 	reader := bufio.NewReader(os.Stdin)
 
 	for {
@@ -82,7 +81,7 @@ func FirstMenuCMS(cms CMS.CountMinSketch, wal *WAL.WAL, lsm *LSM.LSM, cache *LRU
 				fmt.Println("Uspešan zahtev.")
 				cms = *CMS.CreateCountMinSketch(0.01, 0.01)
 				value := cms.DecodeCMS()
-				writePath.Put(wal, lsm, key, value)
+				PrintError(db.Put(key, value))
 			} else {
 				fmt.Println("Neuspešan zahtev.")
 			}
@@ -94,11 +93,13 @@ func FirstMenuCMS(cms CMS.CountMinSketch, wal *WAL.WAL, lsm *LSM.LSM, cache *LRU
 			}
 			if tb.Handler() {
 				fmt.Println("Uspešan zahtev.")
-				succes := writePath.Delete(wal, cache, lsm, key)
-				if succes {
+				err := db.Delete(key)
+				if err == nil {
 					fmt.Println("Uspesno obrisan CMS")
-				} else {
+				} else if errors.Is(err, engine.ErrNotFound) {
 					fmt.Println("Ne postoji CMS sa ovakvim kljucem")
+				} else {
+					PrintError(err)
 				}
 			} else {
 				fmt.Println("Neuspešan zahtev.")
@@ -111,12 +112,14 @@ func FirstMenuCMS(cms CMS.CountMinSketch, wal *WAL.WAL, lsm *LSM.LSM, cache *LRU
 			}
 			if tb.Handler() {
 				fmt.Println("Uspešan zahtev.")
-				found, cmsBytes := readPath.Get(cache, lsm, key)
-				if found {
+				cmsBytes, err := db.Get(key)
+				if err == nil {
 					cms.EncodeCMS(cmsBytes)
-					SecondMenuCMS(cms, wal, lsm, key)
-				} else {
+					SecondMenuCMS(cms, db, key)
+				} else if errors.Is(err, engine.ErrNotFound) {
 					fmt.Println("Ne postoji CMS sa ovim kljucem")
+				} else {
+					PrintError(err)
 				}
 			} else {
 				fmt.Println("Neuspešan zahtev.")
@@ -125,7 +128,7 @@ func FirstMenuCMS(cms CMS.CountMinSketch, wal *WAL.WAL, lsm *LSM.LSM, cache *LRU
 	}
 }
 
-func FirstMenuHLL(hll HLL.HLL, wal *WAL.WAL, lsm *LSM.LSM, cache *LRU.CacheLRU, tb *tokenBucket.TokenBucket, i int) {
+func FirstMenuHLL(hll HLL.HLL, db *engine.Engine, tb *tokenBucket.TokenBucket, i int) {
 	reader := bufio.NewReader(os.Stdin)
 
 	for {
@@ -146,7 +149,7 @@ func FirstMenuHLL(hll HLL.HLL, wal *WAL.WAL, lsm *LSM.LSM, cache *LRU.CacheLRU,
 				fmt.Println("Uspešan zahtev.")
 				hll = *HLL.CreateHLL(4)
 				value := hll.DecodeHLL()
-				writePath.Put(wal, lsm, key, value)
+				PrintError(db.Put(key, value))
 			} else {
 				fmt.Println("Neuspešan zahtev.")
 			}
@@ -158,11 +161,13 @@ func FirstMenuHLL(hll HLL.HLL, wal *WAL.WAL, lsm *LSM.LSM, cache *LRU.CacheLRU,
 			}
 			if tb.Handler() {
 				fmt.Println("Uspešan zahtev.")
-				succes := writePath.Delete(wal, cache, lsm, key)
-				if succes {
+				err := db.Delete(key)
+				if err == nil {
 					fmt.Println("Uspesno obrisan HLL")
-				} else {
+				} else if errors.Is(err, engine.ErrNotFound) {
 					fmt.Println("Ne postoji HLL sa ovakvim kljucem")
+				} else {
+					PrintError(err)
 				}
 			} else {
 				fmt.Println("Neuspešan zahtev.")
@@ -175,12 +180,14 @@ func FirstMenuHLL(hll HLL.HLL, wal *WAL.WAL, lsm *LSM.LSM, cache *LRU.CacheLRU,
 			}
 			if tb.Handler() {
 				fmt.Println("Uspešan zahtev.")
-				found, hllBytes := readPath.Get(cache, lsm, key)
-				if found {
+				hllBytes, err := db.Get(key)
+				if err == nil {
 					hll.EncodeHLL(hllBytes)
-					SecondMenuHLL(hll, wal, lsm, key)
-				} else {
+					SecondMenuHLL(hll, db, key)
+				} else if errors.Is(err, engine.ErrNotFound) {
 					fmt.Println("Ne postoji HLL sa ovim kljucem")
+				} else {
+					PrintError(err)
 				}
 			} else {
 				fmt.Println("Neuspešan zahtev.")
@@ -189,7 +196,7 @@ func FirstMenuHLL(hll HLL.HLL, wal *WAL.WAL, lsm *LSM.LSM, cache *LRU.CacheLRU,
 	}
 }
 
-func SecondMenuCMS(cms CMS.CountMinSketch, wal *WAL.WAL, lsm *LSM.LSM, key string) {
+func SecondMenuCMS(cms CMS.CountMinSketch, db *engine.Engine, key string) {
 	reader := bufio.NewReader(os.Stdin)
 
 	for {
@@ -207,10 +214,10 @@ func SecondMenuCMS(cms CMS.CountMinSketch, wal *WAL.WAL, lsm *LSM.LSM, key strin
 		}
 	}
 	value := cms.DecodeCMS()
-	writePath.Put(wal, lsm, key, value)
+	PrintError(db.Put(key, value))
 }
 
-func SecondMenuHLL(hll HLL.HLL, wal *WAL.WAL, lsm *LSM.LSM, key string) {
+func SecondMenuHLL(hll HLL.HLL, db *engine.Engine, key string) {
 
 	reader := bufio.NewReader(os.Stdin)
 	for {
@@ -227,7 +234,14 @@ func SecondMenuHLL(hll HLL.HLL, wal *WAL.WAL, lsm *LSM.LSM, key string) {
 		}
 	}
 	value := hll.DecodeHLL()
-	writePath.Put(wal, lsm, key, value)
+	PrintError(db.Put(key, value))
+}
+
+// PrintError prints passed error to terminal, if there is one.
+func PrintError(err error) {
+	if err != nil {
+		fmt.Println("Greška:", err)
+	}
 }
 
 func GetInputFromUser(prompt string, reader *bufio.Reader) string {
@@ -251,3 +265,13 @@ func GetKeyAndValueFromUser(reader *bufio.Reader) (string, []byte) {
 	value := []byte(GetInputFromUser("Unesite vrednost: ", reader))
 	return key, value
 }
+
+// GetKeyRangeFromUser returns start and end of a key range. Both can be
+// left empty, which means that range is not bounded on that side.
+func GetKeyRangeFromUser(reader *bufio.Reader) (string, string) {
+	fmt.Print("Unesite početni ključ opsega (prazno za početak baze): ")
+	start, _ := reader.ReadString('\n')
+	fmt.Print("Unesite krajnji ključ opsega, koji nije uključen (prazno za kraj baze): ")
+	end, _ := reader.ReadString('\n')
+	return strings.Replace(start, "\n", "", -1), strings.Replace(end, "\n", "", -1)
+}
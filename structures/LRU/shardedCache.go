@@ -0,0 +1,89 @@
+package LRU
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// NumOfShards is default number of shards of ShardedCache.
+const NumOfShards = 16
+
+// ShardedCache splits keys between several LRU caches, each guarded by
+// its own lock, so that concurrent reads of different keys rarely wait
+// for each other. It is safe for concurrent use.
+type ShardedCache struct {
+	shards []cacheShard
+}
+
+type cacheShard struct {
+	mutex sync.Mutex
+	cache *CacheLRU
+	// generation changes whenever a key is removed from the shard.
+	generation uint64
+}
+
+// NewSharded returns cache with passed total capacity split between
+// passed number of shards. There are never more shards than capacity.
+func NewSharded(capacity int, numOfShards int) *ShardedCache {
+	if numOfShards > capacity {
+		numOfShards = capacity
+	}
+	if numOfShards < 1 {
+		numOfShards = 1
+	}
+	shardCapacity := (capacity + numOfShards - 1) / numOfShards
+	cache := &ShardedCache{shards: make([]cacheShard, numOfShards)}
+	for i := range cache.shards {
+		cache.shards[i].cache = New(shardCapacity)
+	}
+	return cache
+}
+
+func (cache *ShardedCache) shard(key string) *cacheShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return &cache.shards[hash.Sum32()%uint32(len(cache.shards))]
+}
+
+func (cache *ShardedCache) Add(key string, value []byte) {
+	shard := cache.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	shard.cache.Add(key, value)
+}
+
+func (cache *ShardedCache) Get(key string) (bool, []byte) {
+	shard := cache.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	return shard.cache.Get(key)
+}
+
+func (cache *ShardedCache) Remove(key string) (bool, []byte) {
+	shard := cache.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	shard.generation++
+	return shard.cache.Remove(key)
+}
+
+// Generation returns generation of the shard that holds passed key.
+// It is read before a value is looked up on disk, so that the value
+// is cached with AddIfGeneration only if no write removed it meanwhile.
+func (cache *ShardedCache) Generation(key string) uint64 {
+	shard := cache.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	return shard.generation
+}
+
+// AddIfGeneration adds passed pair only if generation of
+// its shard is still equal to passed generation.
+func (cache *ShardedCache) AddIfGeneration(key string, value []byte, generation uint64) {
+	shard := cache.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if shard.generation == generation {
+		shard.cache.Add(key, value)
+	}
+}
@@ -0,0 +1,205 @@
+package LSM
+
+import (
+	"errors"
+	"napredni/structures/SStable"
+	"napredni/structures/record"
+	"sort"
+)
+
+// Compaction is a single merge of tables of a level with tables of the
+// output level whose key range overlaps them. Merged records form tables
+// of about TableSize bytes on the output level, or a single table if
+// TableSize is 0.
+type Compaction struct {
+	Level       int
+	Inputs      []SStable.SSTable
+	OutputLevel int
+	Next        []SStable.SSTable
+	TableSize   uint64
+}
+
+// CompactionStrategy picks tables that are merged after a flush.
+// Levels are counted from 0 in compactions that it returns.
+type CompactionStrategy interface {
+	// PickCompaction returns the next compaction of passed version
+	// of lsm tree and false if the version doesn't need one.
+	PickCompaction(lsm *LSM, version *Version) (Compaction, bool)
+}
+
+// ParseCompactionStrategy returns compaction strategy for its name in
+// configuration: "leveled" or "size_tiered", which merges a bucket of
+// tables once it holds passed number of tables.
+func ParseCompactionStrategy(name string, threshold int) (CompactionStrategy, error) {
+	switch name {
+	case "leveled", "":
+		return &LeveledCompaction{}, nil
+	case "size_tiered":
+		return &SizeTieredCompaction{Threshold: threshold}, nil
+	}
+	return nil, errors.New("unknown compaction strategy " + name)
+}
+
+// LeveledCompaction keeps tables of every level after the first one
+// from overlapping. A level is compacted when it is over its target:
+// the first level when it holds MaxNumOfTablesInLvl tables, and every
+// other level when its tables are larger than its size target.
+type LeveledCompaction struct {
+	// pointers holds for every level the largest key
+	// of the last table that was compacted from it.
+	pointers []string
+}
+
+// PickCompaction returns compaction of the level that is the most over
+// its target. The last level is never compacted.
+func (strategy *LeveledCompaction) PickCompaction(lsm *LSM, version *Version) (Compaction, bool) {
+	level := -1
+	bestScore := 1.0
+	for i := 0; i < len(version.Levels)-1; i++ {
+		var score float64
+		if i == 0 {
+			score = float64(len(version.Levels[i])) / float64(lsm.MaxNumOfTablesInLvl)
+		} else {
+			score = float64(levelSize(version.Levels[i])) / float64(lsm.levelTarget(i))
+		}
+		if score >= bestScore {
+			level = i
+			bestScore = score
+		}
+	}
+	if level < 0 {
+		return Compaction{}, false
+	}
+	if len(strategy.pointers) < len(version.Levels) {
+		strategy.pointers = append(strategy.pointers, make([]string, len(version.Levels)-len(strategy.pointers))...)
+	}
+
+	// Tables of the first level overlap each other, so all of
+	// them are merged. On other levels one table is merged, and
+	// the next one starts after key range of the last merged table.
+	levelTables := version.Levels[level]
+	inputs := levelTables
+	if level > 0 {
+		i := sort.Search(len(levelTables), func(i int) bool {
+			return levelTables[i].MinKey > strategy.pointers[level]
+		})
+		if i == len(levelTables) {
+			i = 0
+		}
+		// Levels written before compaction was leveled, or by size-tiered
+		// compaction, can hold tables that overlap each other.
+		inputs = overlapping(levelTables, levelTables[i].MinKey, levelTables[i].MaxKey)
+		strategy.pointers[level] = levelTables[i].MaxKey
+	}
+	minKey, maxKey := keyRange(inputs)
+	return Compaction{Level: level, Inputs: inputs, OutputLevel: level + 1,
+		Next: overlapping(version.Levels[level+1], minKey, maxKey), TableSize: lsm.TableSize}, true
+}
+
+// levelTarget returns size target in bytes of passed level, which
+// starts from BaseLevelSize on the second level and grows by
+// LevelSizeMultiplier on every next level.
+func (lsm *LSM) levelTarget(level int) uint64 {
+	target := lsm.BaseLevelSize
+	for i := 1; i < level; i++ {
+		target *= uint64(lsm.LevelSizeMultiplier)
+	}
+	if target == 0 {
+		return 1
+	}
+	return target
+}
+
+// levelSize returns size of data of passed tables.
+func levelSize(tables []SStable.SSTable) uint64 {
+	size := uint64(0)
+	for _, sstable := range tables {
+		size += sstable.Size
+	}
+	return size
+}
+
+// keyRange returns the smallest and the largest key of passed tables.
+func keyRange(tables []SStable.SSTable) (string, string) {
+	minKey, maxKey := tables[0].MinKey, tables[0].MaxKey
+	for _, sstable := range tables[1:] {
+		if sstable.MinKey < minKey {
+			minKey = sstable.MinKey
+		}
+		if sstable.MaxKey > maxKey {
+			maxKey = sstable.MaxKey
+		}
+	}
+	return minKey, maxKey
+}
+
+// overlapping returns tables whose key range overlaps passed key range.
+func overlapping(tables []SStable.SSTable, minKey, maxKey string) []SStable.SSTable {
+	result := make([]SStable.SSTable, 0)
+	for _, sstable := range tables {
+		if sstable.MaxKey >= minKey && sstable.MinKey <= maxKey {
+			result = append(result, sstable)
+		}
+	}
+	return result
+}
+
+// withoutTables returns passed tables without the deleted ones.
+func withoutTables(tables []SStable.SSTable, deleted []SStable.SSTable) []SStable.SSTable {
+	result := make([]SStable.SSTable, 0, len(tables))
+	for _, sstable := range tables {
+		found := false
+		for i := range deleted {
+			if deleted[i].Path() == sstable.Path() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, sstable)
+		}
+	}
+	return result
+}
+
+// sortByKey sorts tables of every level after the first one by key
+// range, which leveled compaction keeps from overlapping.
+func sortByKey(levels [][]SStable.SSTable) {
+	for _, tables := range levels[1:] {
+		sort.SliceStable(tables, func(i, j int) bool {
+			return tables[i].MinKey < tables[j].MinKey
+		})
+	}
+}
+
+// keepVersions returns versions of a single key that compaction keeps:
+// the ones that snapshots need, without tombstones that are the oldest
+// versions of the key if none of passed tables can hold an older version.
+// Such tombstone hides no record, and snapshots older than it see the key
+// as deleted either way. Versions must be ordered from the newest one.
+func (lsm *LSM) keepVersions(versions []record.Record, others []SStable.SSTable) ([]record.Record, error) {
+	kept := lsm.Snapshots.KeepVersions(versions)
+	last := len(kept)
+	for last > 0 && kept[last-1].Tombstone == 1 {
+		last--
+	}
+	if last == len(kept) {
+		return kept, nil
+	}
+	found, err := lsm.mayHoldKey(others, kept[0].Key)
+	if err != nil || found {
+		return kept, err
+	}
+	return kept[:last], nil
+}
+
+// mayHoldKey returns true if some of passed tables can hold passed key.
+func (lsm *LSM) mayHoldKey(tables []SStable.SSTable, key string) (bool, error) {
+	for i := range tables {
+		found, err := lsm.Tables.MayContain(&tables[i], key)
+		if err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
+}
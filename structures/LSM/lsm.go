@@ -1,172 +1,471 @@
 package LSM
 
 import (
-	"io/ioutil"
+	"errors"
 	"napredni/structures/Memtable"
 	"napredni/structures/SStable"
-	"napredni/structures/record"
+	"napredni/structures/snapshot"
+	"napredni/structures/storageErrors"
+	"os"
+	"path/filepath"
+	"sync"
 )
 
+// LSM keeps the memtable and the current version with immutable memtables
+// and sstables by levels. Versions are copied on write: flush and compaction
+// publish a new version instead of changing the current one, so reads use
+// the version they acquired without holding a lock.
 type LSM struct {
+	mutex               sync.RWMutex
+	DirPath             string
 	MemTable            Memtable.MemTable
-	Levels              [][]SStable.SSTable
+	version             *Version
 	MaxNumOfLvl         uint8
 	MaxNumOfTablesInLvl uint8
+	// SingleFileSSTables is true if new sstables
+	// are formed as a single file.
+	SingleFileSSTables bool
+	// Codecs holds compression of sstables of every level, from the
+	// first one. Levels after the last codec use the last one.
+	Codecs []SStable.Codec
+	// IndexInterval is index interval of new sstables.
+	IndexInterval int
+	// BaseLevelSize is size target of the second level, and size target
+	// of every next level is LevelSizeMultiplier times larger. TableSize
+	// is size of tables that compaction forms.
+	BaseLevelSize       uint64
+	LevelSizeMultiplier int
+	TableSize           uint64
+	// Strategy picks tables that compaction merges.
+	Strategy CompactionStrategy
+	// Tables keeps sstables open for lookups.
+	Tables    *SStable.TableCache
+	Snapshots *snapshot.List
+	// manifest is changed only by the background flush
+	// and by manual compaction, one at a time.
+	manifest *manifest
+	// flushedSeqNum is the greatest sequence number
+	// of records that are durable in sstables.
+	flushedSeqNum uint64
+	// maxSeqNum is the greatest sequence number of records in
+	// sstables that were written before the manifest.
+	maxSeqNum uint64
+	// Corruptions holds errors for sstables that couldn't be
+	// read when the lsm tree was loaded from names of files.
+	Corruptions []error
 }
 
-func CreateLSM(memtable Memtable.MemTable, numOfLevels uint8, numOfTablesInLevel uint8) *LSM {
+// Version holds immutable memtables that wait to be flushed, from the
+// oldest one, and sstables by levels. Version is never changed once it
+// is published, and sstables that are left out of a newer version are
+// deleted only after all reads of older versions are released.
+type Version struct {
+	Immutables []*Memtable.MemTable
+	Levels     [][]SStable.SSTable
+	readers    sync.WaitGroup
+	previous   *Version
+}
+
+// CreateLSM creates lsm tree whose sstables are kept inside of passed root directory.
+func CreateLSM(dirPath string, memtable Memtable.MemTable, numOfLevels uint8, numOfTablesInLevel uint8) *LSM {
 	lsm := &LSM{}
+	lsm.DirPath = dirPath
+	lsm.Snapshots = snapshot.NewList()
+	lsm.Tables = SStable.NewTableCache(0, false)
 	lsm.MemTable = memtable
-	lsm.Levels = make([][]SStable.SSTable, numOfLevels)
-	//for i := range lsm.Levels {
-	//	lsm.Levels[i] = make([]SStable.SSTable, 0)
-	//}
+	lsm.MemTable.Snapshots = lsm.Snapshots
+	lsm.version = &Version{Levels: make([][]SStable.SSTable, numOfLevels)}
 	lsm.MaxNumOfLvl = numOfLevels
 	lsm.MaxNumOfTablesInLvl = numOfTablesInLevel
+	lsm.Strategy = &LeveledCompaction{}
 	return lsm
 }
 
-func (lsm *LSM) UpdateLSM() {
-	files, _ := ioutil.ReadDir("data/data")
+// Current returns the current version. Sstables of returned version can
+// be deleted by compaction, so it is used only by the background flush
+// and by manual compaction.
+func (lsm *LSM) Current() *Version {
+	lsm.mutex.RLock()
+	defer lsm.mutex.RUnlock()
+	return lsm.version
+}
+
+// Acquire returns the memtable and the current version for a read.
+// Sstables of the version are not deleted until the version is released.
+func (lsm *LSM) Acquire() (Memtable.MemTable, *Version) {
+	lsm.mutex.RLock()
+	defer lsm.mutex.RUnlock()
+	lsm.version.readers.Add(1)
+	return lsm.MemTable, lsm.version
+}
+
+// Release ends a read of the version acquired with Acquire.
+func (version *Version) Release() {
+	version.readers.Done()
+}
 
-	if len(files) == 0 {
-		return
+// clone returns a copy of the version that can be changed and published.
+func (version *Version) clone() *Version {
+	newVersion := &Version{
+		Immutables: append([]*Memtable.MemTable{}, version.Immutables...),
+		Levels:     make([][]SStable.SSTable, len(version.Levels)),
+	}
+	for i := range version.Levels {
+		newVersion.Levels[i] = append([]SStable.SSTable{}, version.Levels[i]...)
 	}
-	maxIdx := make([]int, lsm.MaxNumOfLvl)
-	for _, file := range files {
-		fileName := file.Name()
+	return newVersion
+}
 
-		level, index := SStable.GetLevelAndIndexForFileName(fileName)
-		level--
-		if index > maxIdx[level] {
-			maxIdx[level] = index
+// publish makes passed version the current one. Lock must be held.
+func (lsm *LSM) publish(version *Version) {
+	version.previous = lsm.version
+	lsm.version = version
+}
+
+// waitForOlderVersions waits until all reads of versions published
+// before passed version are released, so that older versions can be
+// dropped. It is called only by the background flush or by manual
+// compaction after it publishes.
+func (lsm *LSM) waitForOlderVersions(version *Version) {
+	for older := version.previous; older != nil; older = older.previous {
+		older.readers.Wait()
+	}
+	version.previous = nil
+}
+
+// UpdateLSM loads levels from the manifest and writes them to a new
+// manifest, which drops edits that are no longer needed. Files of sstables
+// that the manifest doesn't hold, left by a flush or a compaction that was
+// interrupted, are deleted. A store without a manifest is loaded from
+// names of sstable files, and sstables that can't be read are moved to
+// the quarantine directory instead.
+func (lsm *LSM) UpdateLSM() error {
+	manifestPath := filepath.Join(lsm.DirPath, manifestFileName)
+	edits, found, err := readManifest(manifestPath, lsm.DirPath)
+	if err != nil {
+		return err
+	}
+	if !found {
+		edits, err = lsm.editFromFileNames()
+		if err != nil {
+			return err
 		}
 	}
-	for i := 0; i < len(lsm.Levels); i++ {
-		if maxIdx[i] != 0 {
-			lsm.Levels[i] = make([]SStable.SSTable, maxIdx[i])
-		} else {
-			lsm.Levels[i] = make([]SStable.SSTable, 0)
+	levels := make([][]SStable.SSTable, lsm.MaxNumOfLvl)
+	flushedSeqNum := uint64(0)
+	maxSeqNum := uint64(0)
+	for _, edit := range edits {
+		err = applyEdit(levels, edit)
+		if err != nil {
+			return storageErrors.NewCorruption(manifestPath, 0, err.Error())
+		}
+		if edit.FlushedSeqNum > flushedSeqNum {
+			flushedSeqNum = edit.FlushedSeqNum
+		}
+		if edit.MaxSeqNum > maxSeqNum {
+			maxSeqNum = edit.MaxSeqNum
 		}
 	}
 
-	for _, file := range files {
-		fileName := file.Name()
+	sortByKey(levels)
+	err = removeOrphans(lsm.DirPath, levels)
+	if err != nil {
+		return err
+	}
+	manifest, err := writeManifest(manifestPath, levels, flushedSeqNum, maxSeqNum)
+	if err != nil {
+		return err
+	}
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
+	lsm.manifest = manifest
+	lsm.flushedSeqNum = flushedSeqNum
+	lsm.maxSeqNum = maxSeqNum
+	lsm.publish(&Version{Levels: levels})
+	return nil
+}
 
-		level, index := SStable.GetLevelAndIndexForFileName(fileName)
-		filePaths := SStable.FormFilePathsForSSTable(level, index)
-		sstable := SStable.SSTable{DataFilePath: filePaths[0], IndexFilePath: filePaths[1],
-			SummaryFilePath: filePaths[2], FilterFilePath: filePaths[3], MetadataFilePath: filePaths[4],
-			TOCFilePath: filePaths[5]}
-		lsm.Levels[level-1][index-1] = sstable
+// editFromFileNames returns edit that adds every complete sstable inside
+// of the root directory, by level and index. Such sstables were written
+// before the manifest, and their records use timestamps as sequence
+// numbers, so the edit also holds the greatest one, which new records
+// must exceed. Sstables that are corrupt or miss some of their files
+// are quarantined, and their errors are added to Corruptions.
+func (lsm *LSM) editFromFileNames() ([]VersionEdit, error) {
+	sstables, err := SStable.FindSSTables(lsm.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	edit := VersionEdit{}
+	for _, sstable := range sstables {
+		level, _ := sstable.GetLevel()
+		if level < 1 || level > int(lsm.MaxNumOfLvl) {
+			return nil, errors.New("sstable " + sstable.Path() + " is outside of lsm levels")
+		}
+		maxSeqNum := uint64(0)
+		err = sstable.ReadKeyRangeAndSize()
+		if err == nil {
+			maxSeqNum, err = readMaxSeqNum(&sstable)
+		}
+		if errors.Is(err, storageErrors.ErrCorruption) || errors.Is(err, os.ErrNotExist) {
+			lsm.Corruptions = append(lsm.Corruptions, err)
+			err = sstable.Quarantine(lsm.DirPath)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if maxSeqNum > edit.MaxSeqNum {
+			edit.MaxSeqNum = maxSeqNum
+		}
+		edit.Added = append(edit.Added, sstable)
 	}
+	return []VersionEdit{edit}, nil
 }
 
-// prima novi sstable koji je nastao flushovanjem memtable
-func (lsm *LSM) AddSSTable(sstable SStable.SSTable) {
+// readMaxSeqNum returns the greatest sequence number of records in passed sstable.
+func readMaxSeqNum(sstable *SStable.SSTable) (uint64, error) {
+	versions, err := sstable.NewVersionIterator()
+	if err != nil {
+		return 0, err
+	}
+	maxSeqNum := uint64(0)
+	for ; versions.Valid(); versions.Next() {
+		if versions.Record().SeqNum > maxSeqNum {
+			maxSeqNum = versions.Record().SeqNum
+		}
+	}
+	return maxSeqNum, versions.Close()
+}
 
-	lsm.Levels[0] = append(lsm.Levels[0], sstable)
-	lvl := 0
-	for {
-		if uint8(len(lsm.Levels[lvl])) < lsm.MaxNumOfTablesInLvl {
-			break
+// removeOrphans deletes files of every sstable that is not in passed levels.
+func removeOrphans(dir string, levels [][]SStable.SSTable) error {
+	err := SStable.RemoveUnfinishedFiles(dir)
+	if err != nil {
+		return err
+	}
+	live := make(map[string]bool)
+	for _, level := range levels {
+		for _, sstable := range level {
+			live[sstable.Path()] = true
 		}
-		nextLvlSstable := MergeTables(lsm.Levels[lvl], lvl)
-		for i := 0; i < len(lsm.Levels[lvl]); i++ {
-			lsm.Levels[lvl][i].DeleteSSTable()
+	}
+	sstables, err := SStable.FindSSTables(dir)
+	if err != nil {
+		return err
+	}
+	for _, sstable := range sstables {
+		if !live[sstable.Path()] {
+			err = sstable.DeleteSSTable()
+			if err != nil {
+				return err
+			}
 		}
-		lsm.Levels[lvl] = make([]SStable.SSTable, 0)
-		lvl++
-		lsm.Levels[lvl] = append(lsm.Levels[lvl], *nextLvlSstable)
+	}
+	return nil
+}
 
-		if lvl == int(lsm.MaxNumOfLvl)-1 {
-			break
-		}
+// FlushedSeqNum returns the greatest sequence number of records
+// that are durable in sstables, so wal doesn't need to keep them.
+func (lsm *LSM) FlushedSeqNum() uint64 {
+	lsm.mutex.RLock()
+	defer lsm.mutex.RUnlock()
+	return lsm.flushedSeqNum
+}
+
+// MaxSeqNum returns the greatest sequence number of records in sstables.
+// It can be greater than flushed sequence number, since records of sstables
+// written before the manifest are not removed from the wal by it.
+func (lsm *LSM) MaxSeqNum() uint64 {
+	lsm.mutex.RLock()
+	defer lsm.mutex.RUnlock()
+	if lsm.maxSeqNum > lsm.flushedSeqNum {
+		return lsm.maxSeqNum
 	}
+	return lsm.flushedSeqNum
 }
 
-func MergeTables(sstables []SStable.SSTable, lvl int) *SStable.SSTable {
-	sstable1 := sstables[0]
-	records := sstable1.GetRecordsFromDataFile()
-	for i := 1; i < len(sstables); i++ {
-		newRecords := sstables[i].GetRecordsFromDataFile()
-		records = MergeData(records, newRecords)
+// Close closes the manifest.
+func (lsm *LSM) Close() error {
+	err := lsm.Tables.Close()
+	if lsm.manifest == nil {
+		return err
 	}
-	newIndex := SStable.GetNewIndexForLevel(lvl + 2)
-	filepaths := SStable.FormFilePathsForSSTable(lvl+2, newIndex)
-	newSstable := SStable.FormSSTable(records, filepaths[0], filepaths[1], filepaths[2], filepaths[3], filepaths[4],
-		filepaths[5])
-	return newSstable
+	closeErr := lsm.manifest.close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// AddImmutable turns the memtable into an immutable one, which stays
+// readable until it is flushed, and replaces it with an empty memtable.
+func (lsm *LSM) AddImmutable() {
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
+	immutable := lsm.MemTable
+	version := lsm.version.clone()
+	version.Immutables = append(version.Immutables, &immutable)
+	lsm.publish(version)
+	lsm.MemTable.Empty()
 }
 
-func MergeData(records1 []record.Record, records2 []record.Record) []record.Record {
+// OldestImmutable returns immutable memtable that is flushed next.
+func (lsm *LSM) OldestImmutable() *Memtable.MemTable {
+	return lsm.Current().Immutables[0]
+}
 
-	records := make([]record.Record, 0)
+// AddFlushedSSTable adds sstable formed from the oldest immutable memtable,
+// removes that memtable and compacts levels that got full. Passed sequence
+// number is the greatest one among records of the memtable.
+func (lsm *LSM) AddFlushedSSTable(sstable SStable.SSTable, flushedSeqNum uint64) error {
+	return lsm.addSSTable(sstable, flushedSeqNum, true)
+}
+
+// AddSSTable adds sstable formed from the memtable while the wal is
+// replayed, when there are no immutable memtables, and compacts levels
+// that got full. Passed sequence number is the greatest one among
+// records of the memtable.
+func (lsm *LSM) AddSSTable(sstable SStable.SSTable, flushedSeqNum uint64) error {
+	return lsm.addSSTable(sstable, flushedSeqNum, false)
+}
 
-	it1 := 0
-	it2 := 0
+// addSSTable records passed sstable on the first level in the manifest,
+// publishes it together with the flushed sequence number and removes
+// the oldest immutable memtable if removeImmutable is true.
+func (lsm *LSM) addSSTable(sstable SStable.SSTable, flushedSeqNum uint64, removeImmutable bool) error {
+	err := lsm.manifest.append(VersionEdit{Added: []SStable.SSTable{sstable}, FlushedSeqNum: flushedSeqNum})
+	if err != nil {
+		return err
+	}
+	lsm.mutex.Lock()
+	version := lsm.version.clone()
+	version.Levels[0] = append(version.Levels[0], sstable)
+	if removeImmutable {
+		version.Immutables = version.Immutables[1:]
+	}
+	lsm.publish(version)
+	lsm.flushedSeqNum = flushedSeqNum
+	lsm.mutex.Unlock()
+	lsm.waitForOlderVersions(version)
+	return lsm.compact()
+}
+
+// compact runs compactions while the strategy picks them.
+func (lsm *LSM) compact() error {
 	for {
-		if records1[it1].Key == records2[it2].Key {
-			if records1[it1].Timestamp > records2[it2].Timestamp {
-				if records1[it1].Tombstone == 0 {
-					records = append(records, records1[it2])
-				}
-			} else {
-				if records2[it2].Tombstone == 0 {
-					records = append(records, records2[it2])
-				}
-			}
-			it1++
-			if it1 == len(records1) {
-				ReadUntilEnd(&records2, it2, &records)
-				break
-			}
-			it2++
-			if it2 == len(records2) {
-				ReadUntilEnd(&records1, it1, &records)
-				break
-			}
-		} else {
-			if records1[it1].Key > records2[it2].Key {
-				records = append(records, records2[it2])
-
-				it2++
-				if it2 == len(records2) {
-					ReadUntilEnd(&records1, it1, &records)
-					break
-				}
-			} else{
-				records = append(records, records1[it1])
-
-				it1++
-				if it1 == len(records1) {
-					ReadUntilEnd(&records2, it2, &records)
-					break
-				}
+		current := lsm.Current()
+		job, found := lsm.Strategy.PickCompaction(lsm, current)
+		if !found {
+			return nil
+		}
+		merged := append(append([]SStable.SSTable{}, job.Inputs...), job.Next...)
+		err := lsm.runCompaction(current, merged, job.OutputLevel, job.TableSize)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// CompactRange merges every sstable whose key range overlaps range
+// [start, end) into sstables on the last level, which drops versions
+// and tombstones that are no longer needed. Empty end means that range
+// has no upper bound. Sstables of the last level that overlap merged
+// ones are merged too. It must not run at the same time as the
+// background flush.
+func (lsm *LSM) CompactRange(start, end string) error {
+	current := lsm.Current()
+	lastLevel := len(current.Levels) - 1
+	merged := make([]SStable.SSTable, 0)
+	for _, tables := range current.Levels[:lastLevel] {
+		for _, sstable := range tables {
+			if sstable.MaxKey >= start && (end == "" || sstable.MinKey < end) {
+				merged = append(merged, sstable)
 			}
 		}
 	}
-	return records
+	// Sstables of the last level in the whole key range of merged
+	// sstables are merged, so that no new sstable overlaps the rest.
+	minKey, maxKey := start, end
+	if len(merged) > 0 {
+		lowest, highest := keyRange(merged)
+		if lowest < minKey {
+			minKey = lowest
+		}
+		if end != "" && highest > maxKey {
+			maxKey = highest
+		}
+	}
+	for _, sstable := range current.Levels[lastLevel] {
+		if sstable.MaxKey >= minKey && (maxKey == "" || sstable.MinKey <= maxKey) {
+			merged = append(merged, sstable)
+		}
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+	return lsm.runCompaction(current, merged, lastLevel, lsm.TableSize)
 }
 
-func ReadUntilEnd(oldRecords *[]record.Record, it int, records *[]record.Record) {
+// runCompaction merges passed tables of passed version into tables of
+// about tableSize bytes on passed output level. Tables are merged without
+// the lock, since only the background flush or a manual compaction changes
+// levels at a time. Merged tables are deleted once no read uses them, and
+// if that is interrupted, they are deleted when the lsm tree is loaded.
+func (lsm *LSM) runCompaction(current *Version, merged []SStable.SSTable, outputLevel int, tableSize uint64) error {
+	others := make([]SStable.SSTable, 0)
+	for _, tables := range current.Levels {
+		others = append(others, withoutTables(tables, merged)...)
+	}
+	newTables, err := lsm.MergeTables(merged, others, outputLevel+1, lsm.TableOptions(outputLevel+1), tableSize)
+	if err != nil {
+		return err
+	}
+	err = lsm.manifest.append(VersionEdit{Added: newTables, Deleted: merged})
+	if err != nil {
+		return err
+	}
+	lsm.mutex.Lock()
+	version := lsm.version.clone()
+	for i := range version.Levels {
+		version.Levels[i] = withoutTables(version.Levels[i], merged)
+	}
+	version.Levels[outputLevel] = append(version.Levels[outputLevel], newTables...)
+	sortByKey(version.Levels)
+	lsm.publish(version)
+	lsm.mutex.Unlock()
 
-	for {
-		if (*oldRecords)[it].Tombstone == 0 {
-			*records = append(*records, (*oldRecords)[it])
+	lsm.waitForOlderVersions(version)
+	for i := 0; i < len(merged); i++ {
+		err = lsm.Tables.Evict(&merged[i])
+		if err != nil {
+			return err
 		}
-		it++
-		if it == len(*oldRecords) {
-			break
+		err = merged[i].DeleteSSTable()
+		if err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
-func sliceContainsDeletedEL(recordSlice []record.Record) bool {
-	for _, record := range recordSlice {
-		if record.Tombstone == 1 {
-			return true
-		}
+// TableOptions returns options of new sstables on passed level.
+func (lsm *LSM) TableOptions(level int) SStable.Options {
+	return SStable.Options{SingleFile: lsm.SingleFileSSTables, Codec: lsm.CodecForLevel(level),
+		IndexInterval: lsm.IndexInterval}
+}
+
+// CodecForLevel returns compression of new sstables on passed level,
+// where the first level is 1.
+func (lsm *LSM) CodecForLevel(level int) SStable.Codec {
+	if len(lsm.Codecs) == 0 {
+		return SStable.CodecNone
+	}
+	if level > len(lsm.Codecs) {
+		return lsm.Codecs[len(lsm.Codecs)-1]
 	}
-	return false
+	return lsm.Codecs[level-1]
 }
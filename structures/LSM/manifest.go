@@ -0,0 +1,362 @@
+package LSM
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"napredni/structures/SStable"
+	"napredni/structures/storageErrors"
+	"os"
+	"path/filepath"
+)
+
+// manifestFileName is name of the file inside of the root directory that
+// keeps the log of version edits, which is replayed to restore levels.
+const manifestFileName = "MANIFEST"
+
+// manifestEntryHeaderSize is size of crc and size of content of an entry.
+const manifestEntryHeaderSize = 4 + 8
+
+// VersionEdit is a single entry of the manifest. It lists sstables that
+// were added to levels and sstables that were removed from them. Flush
+// also records FlushedSeqNum, since every record with a smaller or equal
+// sequence number is then in sstables and wal doesn't need it anymore.
+// MaxSeqNum is the greatest sequence number of records in sstables that
+// were written before the manifest, whose records use timestamps instead.
+type VersionEdit struct {
+	Added         []SStable.SSTable
+	Deleted       []SStable.SSTable
+	FlushedSeqNum uint64
+	MaxSeqNum     uint64
+}
+
+// manifest is an append-only log of version edits. Every entry starts
+// with crc and size of its content, so that an entry which was cut off
+// by a crash is recognized and ignored.
+type manifest struct {
+	path string
+	file *os.File
+}
+
+// writeManifest writes a new manifest that holds passed levels and sequence
+// numbers as a single edit and opens it for appending. The old manifest
+// is replaced only after the new one is on disk, so one of them is always
+// complete.
+func writeManifest(path string, levels [][]SStable.SSTable, flushedSeqNum uint64,
+	maxSeqNum uint64) (*manifest, error) {
+	edit := VersionEdit{FlushedSeqNum: flushedSeqNum, MaxSeqNum: maxSeqNum}
+	for _, level := range levels {
+		edit.Added = append(edit.Added, level...)
+	}
+	entry, err := edit.encode()
+	if err != nil {
+		return nil, err
+	}
+
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0777)
+	if err != nil {
+		return nil, storageErrors.NewIO("create", tmpPath, err)
+	}
+	_, err = file.Write(entry)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return nil, storageErrors.NewIO("write", tmpPath, err)
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return nil, storageErrors.NewIO("rename", tmpPath, err)
+	}
+	err = syncDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+
+	file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0777)
+	if err != nil {
+		return nil, storageErrors.NewIO("open", path, err)
+	}
+	return &manifest{path: path, file: file}, nil
+}
+
+// append writes passed edit to the end of the manifest and syncs it,
+// so that the edit is on disk before it is applied.
+func (manifest *manifest) append(edit VersionEdit) error {
+	entry, err := edit.encode()
+	if err != nil {
+		return err
+	}
+	_, err = manifest.file.Write(entry)
+	if err != nil {
+		return storageErrors.NewIO("write", manifest.path, err)
+	}
+	return storageErrors.NewIO("sync", manifest.path, manifest.file.Sync())
+}
+
+// syncDir syncs passed directory, so that a file
+// renamed inside of it stays renamed after a crash.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return storageErrors.NewIO("open", path, err)
+	}
+	err = dir.Sync()
+	dir.Close()
+	return storageErrors.NewIO("sync", path, err)
+}
+
+func (manifest *manifest) close() error {
+	return storageErrors.NewIO("close", manifest.path, manifest.file.Close())
+}
+
+// readManifest reads all edits from the manifest on passed path. Sstables
+// of the edits are placed inside of passed root directory. It returns
+// false if the manifest doesn't exist. An entry cut off at the end of the
+// manifest is ignored, while a damaged entry before the end is corruption.
+func readManifest(path string, dir string) ([]VersionEdit, bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, storageErrors.NewIO("read", path, err)
+	}
+
+	edits := make([]VersionEdit, 0)
+	offset := 0
+	for len(data)-offset >= manifestEntryHeaderSize {
+		crc := binary.LittleEndian.Uint32(data[offset:])
+		size := binary.LittleEndian.Uint64(data[offset+4:])
+		end := offset + manifestEntryHeaderSize + int(size)
+		if size > uint64(len(data)) || end > len(data) {
+			break
+		}
+		content := data[offset+manifestEntryHeaderSize : end]
+		if crc32.ChecksumIEEE(content) != crc {
+			if end == len(data) {
+				break
+			}
+			return nil, true, storageErrors.NewCorruption(path, int64(offset), "crc mismatch")
+		}
+		edit, err := decodeVersionEdit(content, dir)
+		if err != nil {
+			return nil, true, storageErrors.NewCorruption(path, int64(offset), err.Error())
+		}
+		edits = append(edits, edit)
+		offset = end
+	}
+	return edits, true, nil
+}
+
+// applyEdit removes deleted sstables from passed levels and
+// then appends added sstables to the end of their levels.
+func applyEdit(levels [][]SStable.SSTable, edit VersionEdit) error {
+	for _, deleted := range edit.Deleted {
+		level, err := deleted.GetLevel()
+		if err != nil {
+			return err
+		}
+		if level < 1 || level > len(levels) {
+			return errors.New("sstable " + deleted.Path() + " is outside of lsm levels")
+		}
+		tables := levels[level-1][:0]
+		for _, sstable := range levels[level-1] {
+			if sstable.Path() != deleted.Path() {
+				tables = append(tables, sstable)
+			}
+		}
+		levels[level-1] = tables
+	}
+	for _, added := range edit.Added {
+		level, err := added.GetLevel()
+		if err != nil {
+			return err
+		}
+		if level < 1 || level > len(levels) {
+			return errors.New("sstable " + added.Path() + " is outside of lsm levels")
+		}
+		levels[level-1] = append(levels[level-1], added)
+	}
+	return nil
+}
+
+// encode returns the edit as a manifest entry. Content of the entry holds
+// number of added sstables followed by their level, index, key range and
+// size, then number of deleted sstables followed by level and index,
+// flushed sequence number, codec and raw size of added sstables, and the
+// greatest sequence number of sstables written before the manifest at the
+// end.
+func (edit *VersionEdit) encode() ([]byte, error) {
+	content := new(bytes.Buffer)
+	binary.Write(content, binary.LittleEndian, uint64(len(edit.Added)))
+	for _, sstable := range edit.Added {
+		err := writeLevelAndIndex(content, &sstable)
+		if err != nil {
+			return nil, err
+		}
+		writeString(content, sstable.MinKey)
+		writeString(content, sstable.MaxKey)
+		binary.Write(content, binary.LittleEndian, sstable.Size)
+	}
+	binary.Write(content, binary.LittleEndian, uint64(len(edit.Deleted)))
+	for _, sstable := range edit.Deleted {
+		err := writeLevelAndIndex(content, &sstable)
+		if err != nil {
+			return nil, err
+		}
+	}
+	binary.Write(content, binary.LittleEndian, edit.FlushedSeqNum)
+	for _, sstable := range edit.Added {
+		content.WriteByte(byte(sstable.Codec))
+		binary.Write(content, binary.LittleEndian, sstable.RawSize)
+	}
+	binary.Write(content, binary.LittleEndian, edit.MaxSeqNum)
+
+	entry := make([]byte, manifestEntryHeaderSize, manifestEntryHeaderSize+content.Len())
+	binary.LittleEndian.PutUint32(entry, crc32.ChecksumIEEE(content.Bytes()))
+	binary.LittleEndian.PutUint64(entry[4:], uint64(content.Len()))
+	return append(entry, content.Bytes()...), nil
+}
+
+// decodeVersionEdit decodes content of a manifest entry.
+func decodeVersionEdit(content []byte, dir string) (VersionEdit, error) {
+	reader := bytes.NewReader(content)
+	edit := VersionEdit{}
+
+	var numOfAdded uint64
+	err := binary.Read(reader, binary.LittleEndian, &numOfAdded)
+	if err != nil {
+		return edit, unexpectedEOF(err)
+	}
+	for i := uint64(0); i < numOfAdded; i++ {
+		sstable, err := readLevelAndIndex(reader, dir)
+		if err != nil {
+			return edit, err
+		}
+		sstable.MinKey, err = readString(reader)
+		if err != nil {
+			return edit, err
+		}
+		sstable.MaxKey, err = readString(reader)
+		if err != nil {
+			return edit, err
+		}
+		err = binary.Read(reader, binary.LittleEndian, &sstable.Size)
+		if err != nil {
+			return edit, unexpectedEOF(err)
+		}
+		sstable.RawSize = sstable.Size
+		edit.Added = append(edit.Added, sstable)
+	}
+
+	var numOfDeleted uint64
+	err = binary.Read(reader, binary.LittleEndian, &numOfDeleted)
+	if err != nil {
+		return edit, unexpectedEOF(err)
+	}
+	for i := uint64(0); i < numOfDeleted; i++ {
+		sstable, err := readLevelAndIndex(reader, dir)
+		if err != nil {
+			return edit, err
+		}
+		edit.Deleted = append(edit.Deleted, sstable)
+	}
+
+	// Entries written before flushed sequence
+	// number was recorded end here.
+	if reader.Len() == 0 {
+		return edit, nil
+	}
+	err = binary.Read(reader, binary.LittleEndian, &edit.FlushedSeqNum)
+	if err != nil {
+		return edit, unexpectedEOF(err)
+	}
+
+	// Entries written before compression
+	// was recorded end here.
+	if reader.Len() == 0 {
+		return edit, nil
+	}
+	for i := range edit.Added {
+		codec, err := reader.ReadByte()
+		if err != nil {
+			return edit, unexpectedEOF(err)
+		}
+		edit.Added[i].Codec = SStable.Codec(codec)
+		err = binary.Read(reader, binary.LittleEndian, &edit.Added[i].RawSize)
+		if err != nil {
+			return edit, unexpectedEOF(err)
+		}
+	}
+
+	// Entries written before the greatest sequence
+	// number of sstables was recorded end here.
+	if reader.Len() == 0 {
+		return edit, nil
+	}
+	err = binary.Read(reader, binary.LittleEndian, &edit.MaxSeqNum)
+	if err != nil {
+		return edit, unexpectedEOF(err)
+	}
+	return edit, nil
+}
+
+func writeLevelAndIndex(writer io.Writer, sstable *SStable.SSTable) error {
+	level, err := sstable.GetLevel()
+	if err != nil {
+		return err
+	}
+	index, err := sstable.GetIndex()
+	if err != nil {
+		return err
+	}
+	binary.Write(writer, binary.LittleEndian, uint64(level))
+	binary.Write(writer, binary.LittleEndian, uint64(index))
+	return nil
+}
+
+func readLevelAndIndex(reader io.Reader, dir string) (SStable.SSTable, error) {
+	var level, index uint64
+	err := binary.Read(reader, binary.LittleEndian, &level)
+	if err != nil {
+		return SStable.SSTable{}, unexpectedEOF(err)
+	}
+	err = binary.Read(reader, binary.LittleEndian, &index)
+	if err != nil {
+		return SStable.SSTable{}, unexpectedEOF(err)
+	}
+	return SStable.GetSSTableForLevelAndIndex(dir, int(level), int(index)), nil
+}
+
+func writeString(writer io.Writer, value string) {
+	binary.Write(writer, binary.LittleEndian, uint64(len(value)))
+	writer.Write([]byte(value))
+}
+
+func readString(reader *bytes.Reader) (string, error) {
+	var size uint64
+	err := binary.Read(reader, binary.LittleEndian, &size)
+	if err != nil {
+		return "", unexpectedEOF(err)
+	}
+	if size > uint64(reader.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	value := make([]byte, size)
+	_, err = io.ReadFull(reader, value)
+	return string(value), unexpectedEOF(err)
+}
+
+// unexpectedEOF turns io.EOF in the middle of an entry into io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
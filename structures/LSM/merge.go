@@ -0,0 +1,147 @@
+package LSM
+
+import (
+	"container/heap"
+	"napredni/structures/SStable"
+	"napredni/structures/record"
+)
+
+// mergeHeap orders iterators of merged tables by their current records:
+// by key, and versions of the same key from the newest one.
+type mergeHeap []*SStable.VersionIterator
+
+func (sources mergeHeap) Len() int {
+	return len(sources)
+}
+
+func (sources mergeHeap) Less(i, j int) bool {
+	record1, record2 := sources[i].Record(), sources[j].Record()
+	if record1.Key != record2.Key {
+		return record1.Key < record2.Key
+	}
+	return record1.IsNewerThan(record2)
+}
+
+func (sources mergeHeap) Swap(i, j int) {
+	sources[i], sources[j] = sources[j], sources[i]
+}
+
+func (sources *mergeHeap) Push(source any) {
+	*sources = append(*sources, source.(*SStable.VersionIterator))
+}
+
+func (sources *mergeHeap) Pop() any {
+	old := *sources
+	source := old[len(old)-1]
+	*sources = old[:len(old)-1]
+	return source
+}
+
+// next returns all versions of the smallest key, from the newest one,
+// and moves past them. Tables whose records run out are closed.
+func (sources *mergeHeap) next(versions []record.Record) ([]record.Record, error) {
+	key := (*sources)[0].Record().Key
+	for sources.Len() > 0 && (*sources)[0].Record().Key == key {
+		source := (*sources)[0]
+		versions = append(versions, *source.Record())
+		source.Next()
+		if source.Valid() {
+			heap.Fix(sources, 0)
+			continue
+		}
+		heap.Pop(sources)
+		err := source.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return versions, nil
+}
+
+// close closes iterators of all tables that are still merged.
+func (sources *mergeHeap) close() {
+	for _, source := range *sources {
+		source.Close()
+	}
+	*sources = nil
+}
+
+// MergeTables merges records of passed tables into new tables on passed
+// level, which hold about tableSize bytes of records each, or into
+// a single table if tableSize is 0. Tombstones are dropped for keys
+// that none of other tables of the lsm tree can hold. Tables are read
+// and new tables are written as records are merged, so only a data block
+// of every table and versions of the current key are kept in memory.
+func (lsm *LSM) MergeTables(sstables, others []SStable.SSTable, level int, options SStable.Options,
+	tableSize uint64) ([]SStable.SSTable, error) {
+	sources := make(mergeHeap, 0, len(sstables))
+	defer sources.close()
+	for i := range sstables {
+		source, err := sstables[i].NewVersionIterator()
+		if err != nil {
+			return nil, err
+		}
+		if !source.Valid() {
+			err = source.Close()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		sources = append(sources, source)
+	}
+	heap.Init(&sources)
+
+	newTables := make([]SStable.SSTable, 0)
+	var writer *SStable.Writer
+	versions := make([]record.Record, 0)
+	for sources.Len() > 0 {
+		var err error
+		versions, err = sources.next(versions[:0])
+		if err == nil {
+			versions, err = lsm.keepVersions(versions, others)
+		}
+		if err != nil {
+			if writer != nil {
+				writer.Abort()
+			}
+			return nil, err
+		}
+		if len(versions) == 0 {
+			continue
+		}
+
+		// Versions of a key stay in one table, so that
+		// key ranges of new tables don't overlap.
+		if writer != nil && tableSize > 0 && writer.Size() >= tableSize {
+			newTable, err := writer.Finish()
+			if err != nil {
+				return nil, err
+			}
+			newTables = append(newTables, *newTable)
+			writer = nil
+		}
+		if writer == nil {
+			writer, err = SStable.NewWriterForLevelAndIndex(lsm.DirPath, level,
+				SStable.GetNewIndexForLevel(lsm.DirPath, level), options)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for i := range versions {
+			err = writer.Add(&versions[i])
+			if err != nil {
+				writer.Abort()
+				return nil, err
+			}
+		}
+	}
+	if writer != nil {
+		newTable, err := writer.Finish()
+		if err != nil {
+			return nil, err
+		}
+		newTables = append(newTables, *newTable)
+	}
+	return newTables, nil
+}
@@ -0,0 +1,85 @@
+package LSM
+
+import (
+	"napredni/structures/SStable"
+	"sort"
+)
+
+// Tables of a size-tiered bucket are between bucketLow and bucketHigh
+// times the average size of tables in the bucket.
+const (
+	bucketLow  = 0.5
+	bucketHigh = 1.5
+)
+
+// SizeTieredCompaction groups tables of every level into buckets of
+// tables of similar size and merges a bucket into a single table on the
+// next level once it holds Threshold tables. Buckets of the last level
+// are merged into a single table of the same level, which is larger than
+// tables of the bucket, so it joins a bucket of larger tables and number
+// of tables on the last level grows only with the logarithm of its size.
+// Tables of a level can overlap each other, which makes writes cheaper
+// and lookups costlier.
+type SizeTieredCompaction struct {
+	Threshold int
+}
+
+// PickCompaction returns compaction of the largest full bucket of the
+// first level that has one.
+func (strategy *SizeTieredCompaction) PickCompaction(lsm *LSM, version *Version) (Compaction, bool) {
+	for level, tables := range version.Levels {
+		var inputs []SStable.SSTable
+		for _, bucket := range buckets(tables) {
+			if len(bucket) >= strategy.threshold() && len(bucket) > len(inputs) {
+				inputs = bucket
+			}
+		}
+		if inputs == nil {
+			continue
+		}
+		outputLevel := level + 1
+		if outputLevel == len(version.Levels) {
+			outputLevel = level
+		}
+		return Compaction{Level: level, Inputs: inputs, OutputLevel: outputLevel}, true
+	}
+	return Compaction{}, false
+}
+
+// threshold returns number of tables that fill a bucket, which is at
+// least 2, since merging a single table doesn't shrink the bucket.
+func (strategy *SizeTieredCompaction) threshold() int {
+	if strategy.Threshold < 2 {
+		return 2
+	}
+	return strategy.Threshold
+}
+
+// buckets groups passed tables by size, from the smallest ones. A table
+// joins the first bucket whose average size is close to its own size.
+func buckets(tables []SStable.SSTable) [][]SStable.SSTable {
+	sorted := append([]SStable.SSTable{}, tables...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Size < sorted[j].Size
+	})
+
+	result := make([][]SStable.SSTable, 0)
+	averages := make([]float64, 0)
+	for _, sstable := range sorted {
+		size := float64(sstable.Size)
+		found := false
+		for i := range result {
+			if size >= averages[i]*bucketLow && size <= averages[i]*bucketHigh {
+				averages[i] = (averages[i]*float64(len(result[i])) + size) / float64(len(result[i])+1)
+				result[i] = append(result[i], sstable)
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, []SStable.SSTable{sstable})
+			averages = append(averages, size)
+		}
+	}
+	return result
+}
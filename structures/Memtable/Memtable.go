@@ -3,6 +3,7 @@ package Memtable
 import (
 	"napredni/structures/record"
 	"napredni/structures/skipList"
+	"napredni/structures/snapshot"
 )
 
 type MemTable struct {
@@ -10,6 +11,8 @@ type MemTable struct {
 	Threshold float64
 	Sl        *skipList.SkipList
 	rec       []record.Record
+	// Snapshots decide which older versions of keys are kept.
+	Snapshots *snapshot.List
 }
 
 func (mt *MemTable) FillDefaults() {
@@ -19,22 +22,7 @@ func (mt *MemTable) FillDefaults() {
 	if mt.Threshold == 0 {
 		mt.Threshold = 0.8
 	}
-	var el0 = skipList.Element{
-		Level: 0,
-		Rec: record.Record{
-			Crc:       0,
-			Timestamp: 0,
-			Tombstone: 0,
-			KeySize:   0,
-			ValueSize: 0,
-			Key:       "",
-			Value:     nil,
-		},
-		Next:      nil,
-		Prev:      nil,
-		Tombstone: false,
-	}
-	mt.Sl = &skipList.SkipList{Begin: el0}
+	mt.Sl = skipList.New()
 	mt.rec = nil
 
 }
@@ -43,43 +31,74 @@ func (mt *MemTable) Empty() {
 	mt.FillDefaults()
 }
 
-func (mt *MemTable) AddRecord(r record.Record) ([]record.Record, bool, bool) {
-	var records []record.Record = nil
+// AddRecord adds passed record to the memtable and returns true if its key
+// was already in the memtable. Memtable is never flushed here, so IsFullFor
+// has to be checked first.
+func (mt *MemTable) AddRecord(r record.Record) bool {
 	found := false
 	if r.Tombstone == 1 {
-		found, _ = mt.Sl.FindEl(r.Key)
-		if !found {
-			if mt.Sl != nil && len(mt.Sl.Elements) >= int(mt.Capacity*mt.Threshold) {
-				records = mt.Flush()
-				mt.Empty()
-			}
-			found = mt.Sl.DeleteEl(r)
-		} else{
-			found = mt.Sl.DeleteEl(r)
-		}
+		found = mt.Sl.DeleteEl(r)
 	} else {
 		found, _ = mt.Sl.FindEl(r.Key)
-		if found {
-			mt.Sl.AddEl(r, false)
-		} else {
-			if mt.Sl != nil && len(mt.Sl.Elements) >= int(mt.Capacity*mt.Threshold) {
-				records = mt.Flush()
-				mt.Empty()
-			}
-			mt.Sl.AddEl(r, false)
+		mt.Sl.AddEl(r, false)
+	}
+	mt.pruneVersions(r.Key)
+	return found
+}
+
+// IsFullFor returns true if adding passed keys, which are not all in
+// the memtable, would go over the threshold, so memtable must be flushed
+// first. Empty memtable is never full, so a write batch with more keys
+// than the memtable can hold is added to a single memtable.
+func (mt *MemTable) IsFullFor(keys ...string) bool {
+	newKeys := make(map[string]bool)
+	for _, key := range keys {
+		found, _ := mt.Sl.FindEl(key)
+		if !found {
+			newKeys[key] = true
 		}
 	}
-	return records, true, found
+	return len(newKeys) != 0 && !mt.IsEmpty() && mt.Sl.Len()+len(newKeys) > int(mt.Capacity*mt.Threshold)
+}
+
+// IsEmpty returns true if there are no records in the memtable.
+func (mt *MemTable) IsEmpty() bool {
+	return mt.Sl.Len() == 0
+}
+
+// pruneVersions drops older versions of passed key that no snapshot can see.
+func (mt *MemTable) pruneVersions(key string) {
+	found, el := mt.Sl.FindEl(key)
+	if !found || len(el.Versions()) == 0 {
+		return
+	}
+	if mt.Snapshots == nil {
+		el.SetVersions(nil)
+		return
+	}
+	versions := mt.Snapshots.KeepVersions(append([]record.Record{el.Record()}, el.Versions()...))
+	if len(versions) != len(el.Versions())+1 {
+		el.SetVersions(versions[1:])
+	}
 }
 
 func (mt *MemTable) GetRecord(key string) (bool, []byte) {
-	found, path := mt.Sl.FindEl(key)
+	return mt.GetRecordAt(key, record.MaxSeqNum)
+}
+
+// GetRecordAt works like GetRecord, but ignores versions
+// that are newer than passed sequence number.
+func (mt *MemTable) GetRecordAt(key string, seqNum uint64) (bool, []byte) {
+	found, el := mt.Sl.FindEl(key)
 	if found {
-		el := path[len(path)-1]
-		if !el.Tombstone {
-			return true, el.Rec.Value
+		rec, visible := el.VersionAt(seqNum)
+		if !visible {
+			return false, nil
+		}
+		if rec.Tombstone == 0 {
+			return true, rec.Value
 		} else {
-			return false, el.Rec.Value
+			return false, rec.Value
 		}
 	}
 	return false, nil
@@ -87,7 +106,7 @@ func (mt *MemTable) GetRecord(key string) (bool, []byte) {
 
 func (mt *MemTable) Fill(r []record.Record) []record.Record {
 	for i := 0; i < len(r); i++ {
-		if len(mt.Sl.Elements) == int(mt.Capacity*mt.Threshold) {
+		if mt.Sl.Len() == int(mt.Capacity*mt.Threshold) {
 			records := mt.Flush()
 			mt.Empty()
 			return records
@@ -102,17 +121,23 @@ func (mt *MemTable) Fill(r []record.Record) []record.Record {
 }
 
 func (mt *MemTable) Flush() []record.Record {
-	if mt.Sl.Elements == nil {
+	if mt.Sl.Len() == 0 {
 		return nil
 	}
 	var r []record.Record
-	var current = mt.Sl.Begin.Next[0]
+	var current = mt.Sl.First()
 	for {
 		if current == nil {
 			break
 		}
-		r = append(r, current.Rec)
-		current = current.Next[0]
+		r = append(r, current.Record())
+		// Older versions follow the newest one, so that
+		// the sstable keeps them for live snapshots.
+		if mt.Snapshots != nil && len(current.Versions()) != 0 {
+			versions := mt.Snapshots.KeepVersions(append([]record.Record{current.Record()}, current.Versions()...))
+			r = append(r, versions[1:]...)
+		}
+		current = current.Next()
 	}
 	return r
 }
@@ -0,0 +1,98 @@
+package Memtable
+
+import (
+	"napredni/structures/record"
+	"napredni/structures/skipList"
+)
+
+// Iterator walks through memtable records in key order,
+// including records that are marked as deleted. For every key
+// it returns the newest version visible at its sequence number.
+type Iterator struct {
+	sl      *skipList.SkipList
+	seqNum  uint64
+	current *skipList.Element
+	record  record.Record
+}
+
+// NewIterator returns iterator over records of the memtable.
+// Iterator is not positioned until one of the seek methods is called.
+func (mt *MemTable) NewIterator() *Iterator {
+	return mt.NewIteratorAt(record.MaxSeqNum)
+}
+
+// NewIteratorAt returns iterator that ignores versions
+// newer than passed sequence number.
+func (mt *MemTable) NewIteratorAt(seqNum uint64) *Iterator {
+	return &Iterator{sl: mt.Sl, seqNum: seqNum}
+}
+
+func (it *Iterator) SeekToFirst() {
+	it.current = it.sl.First()
+	it.skipInvisibleForward()
+}
+
+func (it *Iterator) SeekToLast() {
+	it.current = it.sl.Last()
+	it.skipInvisibleBackward()
+}
+
+// Seek positions iterator at the first record whose key is not less than key.
+func (it *Iterator) Seek(key string) {
+	it.current = it.sl.FindFirstGreaterOrEqual(key)
+	it.skipInvisibleForward()
+}
+
+func (it *Iterator) Next() {
+	it.current = it.current.Next()
+	it.skipInvisibleForward()
+}
+
+func (it *Iterator) Prev() {
+	it.current = it.sl.Previous(it.current)
+	it.skipInvisibleBackward()
+}
+
+// skipInvisibleForward moves iterator forward past keys that
+// have no version visible at its sequence number.
+func (it *Iterator) skipInvisibleForward() {
+	for it.current != nil && !it.readVersion() {
+		it.current = it.current.Next()
+	}
+}
+
+// skipInvisibleBackward moves iterator backward past keys that
+// have no version visible at its sequence number.
+func (it *Iterator) skipInvisibleBackward() {
+	for it.current != nil && !it.readVersion() {
+		it.current = it.sl.Previous(it.current)
+	}
+}
+
+// readVersion reads version of current key visible at
+// sequence number of the iterator, if there is one.
+func (it *Iterator) readVersion() bool {
+	var visible bool
+	it.record, visible = it.current.VersionAt(it.seqNum)
+	return visible
+}
+
+func (it *Iterator) Valid() bool {
+	return it.current != nil
+}
+
+func (it *Iterator) Key() string {
+	return it.current.Key()
+}
+
+// Record returns record at current position. Tombstone of the
+// record is set if the element is marked as deleted.
+func (it *Iterator) Record() *record.Record {
+	rec := it.record
+	return &rec
+}
+
+func (it *Iterator) Close() error {
+	it.current = nil
+	return nil
+}
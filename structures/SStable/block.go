@@ -0,0 +1,291 @@
+package SStable
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"napredni/structures/record"
+	"napredni/structures/storageErrors"
+	"sort"
+)
+
+// dataBlockSize is size in bytes of records after which a data block is
+// finished. Versions of a key are never split between blocks, so that
+// all of them are found in a single block, which can make it larger.
+const dataBlockSize = 4096
+
+// blockTrailerSize is size of codec and crc that follow block
+// contents. Crc covers contents and codec.
+const blockTrailerSize = 1 + 4
+
+// blockRestartInterval is number of records between restart points of
+// a data block, whose keys are stored whole. Offsets of restart points
+// follow the records, so that a key is found by binary search on them.
+const blockRestartInterval = 16
+
+// blockWriter collects records of a data block in prefix format and
+// compresses them with its codec when it is finished.
+type blockWriter struct {
+	buffer     bytes.Buffer
+	lastKey    string
+	codec      Codec
+	restarts   []uint32
+	numRecords int
+}
+
+// add appends passed record to the block, with its key
+// compressed against key of the previous record.
+func (block *blockWriter) add(rec *record.Record) {
+	previousKey := block.lastKey
+	if block.numRecords%blockRestartInterval == 0 {
+		block.restarts = append(block.restarts, uint32(block.buffer.Len()))
+		previousKey = ""
+	}
+	encoded := appendKey(make([]byte, 0, 32+len(rec.Key)+len(rec.Value)), previousKey, rec.Key)
+	encoded = binary.AppendUvarint(encoded, rec.SeqNum)
+	encoded = binary.AppendVarint(encoded, rec.Timestamp)
+	encoded = append(encoded, rec.Tombstone)
+	encoded = appendString(encoded, string(rec.Value))
+	block.buffer.Write(encoded)
+	block.lastKey = rec.Key
+	block.numRecords++
+}
+
+// isFullBefore returns true if the block should be finished before
+// passed record, which can't happen between versions of a key.
+func (block *blockWriter) isFullBefore(rec *record.Record) bool {
+	return block.buffer.Len() >= dataBlockSize && rec.Key != block.lastKey
+}
+
+func (block *blockWriter) isEmpty() bool {
+	return block.numRecords == 0
+}
+
+// finish appends restart points to records of the block, compresses them,
+// writes them followed by the trailer and resets the block. Block is written
+// uncompressed if codec doesn't make it smaller. It returns size of the
+// written block and size that it would have without compression, which
+// both include the trailer.
+func (block *blockWriter) finish(writer io.Writer) (uint64, uint64, error) {
+	restarts := make([]byte, 0, 4*len(block.restarts)+4)
+	for _, restart := range block.restarts {
+		restarts = binary.LittleEndian.AppendUint32(restarts, restart)
+	}
+	block.buffer.Write(binary.LittleEndian.AppendUint32(restarts, uint32(len(block.restarts))))
+	block.restarts = block.restarts[:0]
+	block.numRecords = 0
+
+	rawSize := uint64(block.buffer.Len())
+	codec := block.codec
+	contents, err := codec.compress(block.buffer.Bytes())
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(contents) >= block.buffer.Len() {
+		codec = CodecNone
+		contents = block.buffer.Bytes()
+	}
+
+	stored := make([]byte, 0, len(contents)+blockTrailerSize)
+	stored = append(append(stored, contents...), byte(codec))
+	stored = binary.LittleEndian.AppendUint32(stored, crc32.ChecksumIEEE(stored))
+	block.buffer.Reset()
+	_, err = writer.Write(stored)
+	return uint64(len(stored)), rawSize + blockTrailerSize, err
+}
+
+// readBlock reads data block that passed index entry points to from
+// already opened data file, checks its crc and returns its records.
+// In baseline format the entry points to a single record.
+func readBlock(file io.ReaderAt, filePath string, format tableFormat, entry *IndexTableEntry) ([]record.Record, error) {
+	if format == formatBaseline {
+		baselineRecord, err := readBaselineRecord(file, filePath, entry)
+		if err != nil {
+			return nil, err
+		}
+		return []record.Record{baselineRecord}, nil
+	}
+	contents, err := readBlockContents(file, filePath, entry)
+	if err != nil {
+		return nil, err
+	}
+	records, err := decodePrefixBlock(contents)
+	if err != nil {
+		return nil, storageErrors.NewCorruption(filePath, int64(entry.Offset), err.Error())
+	}
+	return records, nil
+}
+
+// readBlockContents reads data block that passed index entry points to
+// and returns its contents after crc of the block is checked.
+func readBlockContents(file io.ReaderAt, filePath string, entry *IndexTableEntry) ([]byte, error) {
+	if entry.Size < blockTrailerSize || entry.Size > math.MaxInt64 || entry.Offset > math.MaxInt64-entry.Size {
+		return nil, storageErrors.NewCorruption(filePath, int64(entry.Offset), "invalid block size")
+	}
+	block, err := readSizedBytes(io.NewSectionReader(file, int64(entry.Offset), int64(entry.Size)), entry.Size)
+	if err == io.ErrUnexpectedEOF {
+		return nil, storageErrors.NewCorruption(filePath, int64(entry.Offset), err.Error())
+	}
+	if err != nil {
+		return nil, storageErrors.NewIO("read", filePath, err)
+	}
+
+	contents, err := blockContents(block)
+	if err != nil {
+		return nil, storageErrors.NewCorruption(filePath, int64(entry.Offset), err.Error())
+	}
+	return contents, nil
+}
+
+// readBaselineRecord reads record in baseline format
+// that passed index entry points to and checks its crc.
+func readBaselineRecord(file io.ReaderAt, filePath string, entry *IndexTableEntry) (record.Record, error) {
+	baselineRecord := record.Record{}
+	if entry.Offset > math.MaxInt64 {
+		return baselineRecord, storageErrors.NewCorruption(filePath, 0, "invalid record offset")
+	}
+	offset := int64(entry.Offset)
+	reader := bufio.NewReader(io.NewSectionReader(file, offset, math.MaxInt64-offset))
+	eof, err := baselineRecord.Decode(reader, record.FormatBaseline)
+	if err == nil && eof {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return baselineRecord, storageErrors.NewCorruption(filePath, offset, err.Error())
+	}
+	return baselineRecord, nil
+}
+
+// decodePrefixBlock returns records of a block in prefix format.
+func decodePrefixBlock(contents []byte) ([]record.Record, error) {
+	records, _, err := splitRestarts(contents)
+	if err != nil {
+		return nil, err
+	}
+	reader := bytes.NewReader(records)
+	decoded := make([]record.Record, 0)
+	previousKey := ""
+	for reader.Len() > 0 {
+		blockRecord, err := decodePrefixRecord(reader, previousKey)
+		if err != nil {
+			return nil, err
+		}
+		decoded = append(decoded, blockRecord)
+		previousKey = blockRecord.Key
+	}
+	return decoded, nil
+}
+
+// seekVersion returns the newest version of passed key that is not newer
+// than passed sequence number from a block in prefix format. Binary search
+// finds the first restart point whose key is not less than the key, and
+// records are read from the restart point before it, since versions of
+// the key can start before it.
+func seekVersion(contents []byte, key string, seqNum uint64) (*record.Record, bool, error) {
+	records, restarts, err := splitRestarts(contents)
+	if err != nil {
+		return &record.Record{}, false, err
+	}
+	var searchErr error
+	restart := sort.Search(len(restarts), func(i int) bool {
+		restartKey, err := readKey(bytes.NewReader(records[restarts[i]:]), "")
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return restartKey >= key
+	})
+	if searchErr != nil {
+		return &record.Record{}, false, unexpectedEOF(searchErr)
+	}
+	if len(restarts) == 0 {
+		return &record.Record{}, false, nil
+	}
+	if restart > 0 {
+		restart--
+	}
+
+	reader := bytes.NewReader(records[restarts[restart]:])
+	previousKey := ""
+	for reader.Len() > 0 {
+		blockRecord, err := decodePrefixRecord(reader, previousKey)
+		if err != nil {
+			return &record.Record{}, false, err
+		}
+		if blockRecord.Key > key {
+			break
+		}
+		if blockRecord.Key == key && blockRecord.SeqNum <= seqNum {
+			return &blockRecord, true, nil
+		}
+		previousKey = blockRecord.Key
+	}
+	return &record.Record{}, false, nil
+}
+
+// splitRestarts splits contents of a block in prefix format
+// into records and offsets of their restart points.
+func splitRestarts(contents []byte) ([]byte, []uint32, error) {
+	if len(contents) < 4 {
+		return nil, nil, errors.New("block is too small")
+	}
+	numOfRestarts := uint64(binary.LittleEndian.Uint32(contents[len(contents)-4:]))
+	if numOfRestarts*4 > uint64(len(contents)-4) {
+		return nil, nil, errors.New("invalid number of restart points")
+	}
+	recordsEnd := len(contents) - 4 - int(numOfRestarts)*4
+	restarts := make([]uint32, numOfRestarts)
+	for i := range restarts {
+		restarts[i] = binary.LittleEndian.Uint32(contents[recordsEnd+4*i:])
+		if restarts[i] >= uint32(recordsEnd) {
+			return nil, nil, errors.New("restart point is outside of block")
+		}
+	}
+	return contents[:recordsEnd], restarts, nil
+}
+
+// decodePrefixRecord reads a single record of a block in prefix
+// format, whose key is compressed against passed previous key.
+func decodePrefixRecord(reader *bytes.Reader, previousKey string) (record.Record, error) {
+	blockRecord := record.Record{}
+	key, err := readKey(reader, previousKey)
+	if err != nil {
+		return blockRecord, unexpectedEOF(err)
+	}
+	blockRecord.Key = key
+	blockRecord.KeySize = uint64(len(key))
+
+	blockRecord.SeqNum, err = binary.ReadUvarint(reader)
+	if err != nil {
+		return blockRecord, unexpectedEOF(err)
+	}
+	blockRecord.Timestamp, err = binary.ReadVarint(reader)
+	if err != nil {
+		return blockRecord, unexpectedEOF(err)
+	}
+	blockRecord.Tombstone, err = reader.ReadByte()
+	if err != nil {
+		return blockRecord, unexpectedEOF(err)
+	}
+	blockRecord.Value, err = readBytes(reader)
+	if err != nil {
+		return blockRecord, unexpectedEOF(err)
+	}
+	blockRecord.ValueSize = uint64(len(blockRecord.Value))
+	return blockRecord, nil
+}
+
+// blockContents checks crc of passed block and returns its
+// contents, which are decompressed with codec of the block.
+func blockContents(block []byte) ([]byte, error) {
+	crcOffset := len(block) - 4
+	if crc32.ChecksumIEEE(block[:crcOffset]) != binary.LittleEndian.Uint32(block[crcOffset:]) {
+		return nil, errors.New("block crc mismatch")
+	}
+	codec := Codec(block[crcOffset-1])
+	return codec.decompress(block[:len(block)-blockTrailerSize])
+}
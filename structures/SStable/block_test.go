@@ -0,0 +1,138 @@
+package SStable
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"napredni/structures/record"
+)
+
+// blockTestRecords returns records with keys that share a long prefix,
+// where key k/0020 has 20 versions, so its versions span restart points.
+func blockTestRecords() []record.Record {
+	records := make([]record.Record, 0)
+	seqNum := uint64(1000)
+	for i := 0; i < 60; i += 2 {
+		versions := 1
+		if i == 20 {
+			versions = 20
+		}
+		for version := 0; version < versions; version++ {
+			key := fmt.Sprintf("tenant/123/user/k/%04d", i)
+			rec := record.CreateRecord(key, []byte(fmt.Sprintf("%s v%d", key, version)), 0)
+			rec.SeqNum = seqNum
+			seqNum--
+			records = append(records, *rec)
+		}
+	}
+	return records
+}
+
+// Block in prefix format is read back whole, and seek finds every key
+// and version, including those before and after restart points.
+func TestBlockSeekAcrossRestartPoints(t *testing.T) {
+	records := blockTestRecords()
+	block := blockWriter{codec: CodecFlate}
+	for i := range records {
+		block.add(&records[i])
+	}
+	if len(block.restarts) != (len(records)+blockRestartInterval-1)/blockRestartInterval {
+		t.Fatalf("%d restart points for %d records", len(block.restarts), len(records))
+	}
+	var stored bytes.Buffer
+	_, _, err := block.finish(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := blockContents(stored.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := decodePrefixBlock(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(records) {
+		t.Fatalf("decoded %d records, want %d", len(decoded), len(records))
+	}
+	for i := range records {
+		if decoded[i].Key != records[i].Key || decoded[i].SeqNum != records[i].SeqNum ||
+			!bytes.Equal(decoded[i].Value, records[i].Value) {
+			t.Fatalf("record %d: got %s %d", i, decoded[i].Key, decoded[i].SeqNum)
+		}
+	}
+
+	for i := range records {
+		rec, found, err := seekVersion(contents, records[i].Key, records[i].SeqNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || rec.SeqNum != records[i].SeqNum || !bytes.Equal(rec.Value, records[i].Value) {
+			t.Fatalf("seek %s at %d: found %v, seq %d", records[i].Key, records[i].SeqNum, found, rec.SeqNum)
+		}
+	}
+	for _, key := range []string{"", "tenant/123/user/k/", "tenant/123/user/k/0015",
+		"tenant/123/user/k/0020a", "tenant/123/user/k/0059", "u"} {
+		_, found, err := seekVersion(contents, key, record.MaxSeqNum)
+		if err != nil || found {
+			t.Fatalf("seek %q: found %v, err %v", key, found, err)
+		}
+	}
+	_, found, err := seekVersion(contents, "tenant/123/user/k/0000", 1)
+	if err != nil || found {
+		t.Fatalf("seek of a version older than the oldest one: found %v, err %v", found, err)
+	}
+}
+
+// Iterator seeks to keys at restart points and block boundaries of
+// a table with several blocks and crosses them in both directions.
+func TestIteratorAcrossBlocksAndRestartPoints(t *testing.T) {
+	records := testRecords(2000)
+	sstable := formTestTable(t, records, Options{})
+	if sstable.RawSize < 4*dataBlockSize {
+		t.Fatalf("table of %d bytes doesn't have several blocks", sstable.RawSize)
+	}
+	it, err := sstable.NewIteratorAt(record.MaxSeqNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	n := 0
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		n++
+		if it.Key() != records[len(records)-n].Key {
+			t.Fatalf("prev %d: got %s, want %s", n, it.Key(), records[len(records)-n].Key)
+		}
+	}
+	if n != len(records) {
+		t.Fatalf("iterated %d records backwards, want %d", n, len(records))
+	}
+	for _, i := range []int{0, 15, 16, 17, 31, 32, 100, 101, 102, 1000, 1999} {
+		it.Seek(records[i].Key)
+		if !it.Valid() || it.Key() != records[i].Key {
+			t.Fatalf("seek %s: got valid %v", records[i].Key, it.Valid())
+		}
+		// Seek between keys stops at the next key.
+		it.Seek(records[i].Key[:len(records[i].Key)-1])
+		if !it.Valid() || it.Key() > records[i].Key {
+			t.Fatalf("seek before %s: got valid %v", records[i].Key, it.Valid())
+		}
+		it.Seek(records[i].Key + "a")
+		if i == len(records)-1 {
+			if it.Valid() {
+				t.Fatalf("seek past the last key: got %s", it.Key())
+			}
+			continue
+		}
+		if !it.Valid() || it.Key() != records[i+1].Key {
+			t.Fatalf("seek after %s: got valid %v", records[i].Key, it.Valid())
+		}
+		it.Prev()
+		if !it.Valid() || it.Key() != records[i].Key {
+			t.Fatalf("prev after seek: got valid %v", it.Valid())
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package SStable
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"errors"
+	"io"
+)
+
+// Codec is compression of data blocks of an sstable. Codec of every
+// block is written next to it, so blocks of a table can differ.
+type Codec byte
+
+const (
+	CodecNone Codec = iota
+	// CodecFlate is raw deflate, which is fast and has no header.
+	CodecFlate
+	// CodecZlib is deflate with the best compression and a checksum.
+	CodecZlib
+)
+
+// ParseCodec returns codec for its name in configuration:
+// "none", "flate" or "zlib".
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case "none", "":
+		return CodecNone, nil
+	case "flate":
+		return CodecFlate, nil
+	case "zlib":
+		return CodecZlib, nil
+	}
+	return CodecNone, errors.New("unknown sstable compression " + name)
+}
+
+func (codec Codec) String() string {
+	switch codec {
+	case CodecNone:
+		return "none"
+	case CodecFlate:
+		return "flate"
+	case CodecZlib:
+		return "zlib"
+	}
+	return "unknown"
+}
+
+// compress returns passed data compressed with the codec.
+func (codec Codec) compress(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	var writer io.WriteCloser
+	var err error
+	switch codec {
+	case CodecNone:
+		return data, nil
+	case CodecFlate:
+		writer, err = flate.NewWriter(&buffer, flate.BestSpeed)
+	case CodecZlib:
+		writer, err = zlib.NewWriterLevel(&buffer, zlib.BestCompression)
+	default:
+		return nil, errors.New("unknown sstable compression")
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	return buffer.Bytes(), err
+}
+
+// decompress returns passed data decompressed with the codec.
+func (codec Codec) decompress(data []byte) ([]byte, error) {
+	var reader io.ReadCloser
+	var err error
+	switch codec {
+	case CodecNone:
+		return data, nil
+	case CodecFlate:
+		reader = flate.NewReader(bytes.NewReader(data))
+	case CodecZlib:
+		reader, err = zlib.NewReader(bytes.NewReader(data))
+	default:
+		return nil, errors.New("unknown sstable compression")
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
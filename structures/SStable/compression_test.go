@@ -0,0 +1,106 @@
+package SStable
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"napredni/structures/record"
+)
+
+// Every codec returns the data that was compressed with it.
+func TestCodecsRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("tenant/123/user/00001 value 1 "), 200)
+	for _, codec := range []Codec{CodecNone, CodecFlate, CodecZlib} {
+		for _, input := range [][]byte{data, {}} {
+			compressed, err := codec.compress(input)
+			if err != nil {
+				t.Fatalf("%s: %v", codec, err)
+			}
+			decompressed, err := codec.decompress(compressed)
+			if err != nil {
+				t.Fatalf("%s: %v", codec, err)
+			}
+			if !bytes.Equal(decompressed, input) {
+				t.Fatalf("%s: got %d bytes back, want %d", codec, len(decompressed), len(input))
+			}
+		}
+	}
+	_, err := Codec(9).compress(data)
+	if err == nil {
+		t.Fatal("unknown codec compressed data")
+	}
+}
+
+// Sstable written with any codec, in separate files or as a single
+// file, reads back the same records through lookups and iteration.
+func TestCompressedTablesRoundTrip(t *testing.T) {
+	records := testRecords(1000)
+	for _, codec := range []Codec{CodecNone, CodecFlate, CodecZlib} {
+		for _, singleFile := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s single file %v", codec, singleFile), func(t *testing.T) {
+				sstable := formTestTable(t, records, Options{Codec: codec, SingleFile: singleFile})
+				if sstable.Codec != codec {
+					t.Fatalf("codec: got %s", sstable.Codec)
+				}
+				for _, i := range []int{0, 1, 15, 16, 17, 499, 998, 999} {
+					rec, found, err := sstable.GetRecordInSStableForKeyAt(records[i].Key, record.MaxSeqNum)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !found || !bytes.Equal(rec.Value, records[i].Value) {
+						t.Fatalf("get %s: found %v, value %q", records[i].Key, found, rec.Value)
+					}
+				}
+				it, err := sstable.NewIteratorAt(record.MaxSeqNum)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer it.Close()
+				i := 0
+				for it.SeekToFirst(); it.Valid(); it.Next() {
+					if i >= len(records) || it.Key() != records[i].Key ||
+						!bytes.Equal(it.Record().Value, records[i].Value) {
+						t.Fatalf("record %d: got %s", i, it.Key())
+					}
+					i++
+				}
+				if i != len(records) {
+					t.Fatalf("iterated %d records, want %d", i, len(records))
+				}
+			})
+		}
+	}
+}
+
+// Compression ratio is raw size of data blocks divided by their size
+// in the data file, so it is 1 without compression.
+func TestCompressionRatio(t *testing.T) {
+	records := testRecords(1000)
+	for i := range records {
+		records[i].Value = bytes.Repeat([]byte("value "), 20)
+	}
+	ratios := make(map[Codec]float64)
+	for _, codec := range []Codec{CodecNone, CodecFlate, CodecZlib} {
+		sstable := formTestTable(t, records, Options{Codec: codec})
+		stats, err := sstable.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(sstable.DataFilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Codec != codec.String() || stats.Size != uint64(info.Size()) {
+			t.Fatalf("%s: stats %+v, data file has %d bytes", codec, stats, info.Size())
+		}
+		ratios[codec] = stats.CompressionRatio
+	}
+	if ratios[CodecNone] != 1 {
+		t.Fatalf("ratio without compression: %v", ratios[CodecNone])
+	}
+	if ratios[CodecFlate] < 3 || ratios[CodecZlib] < ratios[CodecFlate] {
+		t.Fatalf("ratios: %v", ratios)
+	}
+}
@@ -4,65 +4,57 @@ import (
 	"bufio"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"napredni/structures/record"
-	"os"
+	"napredni/structures/storageErrors"
 )
 
 // WriteRecordToDataFile writes a data record to file.
-func WriteRecordToDataFile(record *record.Record, writer *bufio.Writer) {
+func WriteRecordToDataFile(record *record.Record, writer *bufio.Writer) error {
 	recordByteSlice := record.EncodeRecord()
 
-	err := binary.Write(writer, binary.LittleEndian, recordByteSlice)
-	if err != nil {
-		return
-	}
+	return binary.Write(writer, binary.LittleEndian, recordByteSlice)
 }
 
 // ReadRecordFromDataFile reads a record from file
-func ReadRecordFromDataFile(record *record.Record, reader *bufio.Reader) bool {
-	eof := record.DecodeRecord(reader)
-
-	return eof
+func ReadRecordFromDataFile(record *record.Record, reader *bufio.Reader) (bool, error) {
+	return record.DecodeRecord(reader)
 }
 
-// GetRecordInDataTableForOffset reads record at specified offset.
-func getRecordInDataTableForOffset(filePath string, offset uint64) (*record.Record, bool) {
-	file, err := os.Open(filePath)
+// getVersionInDataBlock reads data block that passed index entry points
+// to and returns the newest version of passed key in it that is not
+// newer than passed sequence number.
+func getVersionInDataBlock(reader io.ReaderAt, dataPath string, format tableFormat, indexEntry *IndexTableEntry,
+	key string, seqNum uint64) (*record.Record, bool, error) {
+	if format == formatBaseline {
+		baselineRecord, err := readBaselineRecord(reader, dataPath, indexEntry)
+		if err != nil || baselineRecord.Key != key || baselineRecord.SeqNum > seqNum {
+			return &record.Record{}, false, err
+		}
+		return &baselineRecord, true, nil
+	}
+	contents, err := readBlockContents(reader, dataPath, indexEntry)
 	if err != nil {
-		panic(err)
+		return &record.Record{}, false, err
 	}
-	reader := bufio.NewReader(file)
-
-	file.Seek(int64(offset), 0)
-
-	foundRecord := record.Record{}
-	eof := ReadRecordFromDataFile(&foundRecord, reader)
-	if eof {
-		return &record.Record{}, false
+	foundRecord, found, err := seekVersion(contents, key, seqNum)
+	if err != nil {
+		return &record.Record{}, false, storageErrors.NewCorruption(dataPath, int64(indexEntry.Offset), err.Error())
 	}
-	return &foundRecord, true
+	return foundRecord, found, nil
 }
 
-func (sstable *SSTable) PrintDataFile() {
-	file, err := os.Open(sstable.DataFilePath)
-	if err!= nil {
-		panic(err)
+func (sstable *SSTable) PrintDataFile() error {
+	records, err := sstable.GetRecordsFromDataFile()
+	if err != nil {
+		return err
 	}
-	defer file.Close()
-	reader := bufio.NewReader(file)
 
 	fmt.Println("****************************Records****************************")
-	i := 1
-	recordToPrint := record.Record{}
-	for {
-		eof := recordToPrint.DecodeRecord(reader)
-		if eof {
-			break
-		}
-
-		fmt.Println("Record", i)
-		recordToPrint.Print()
+	for i := range records {
+		fmt.Println("Record", i+1)
+		records[i].Print()
 		fmt.Println()
-		i++
 	}
+	return nil
 }
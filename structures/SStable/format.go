@@ -0,0 +1,137 @@
+package SStable
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// tableFormat is layout of index, summary and data of an sstable. Index
+// and summary of a table start with a format header, except in tables
+// written before the header was added.
+type tableFormat byte
+
+const (
+	// formatBaseline is layout of tables without the header. Index has an
+	// entry for every record, which holds its whole key after uint64 length
+	// and its offset, and data holds records one after another in baseline
+	// record format.
+	formatBaseline tableFormat = iota
+	// formatPrefix stores records in data blocks, and index has an entry for
+	// every block. A key is stored as length of the prefix that it shares
+	// with the previous key followed by the rest of it, with varint lengths.
+	// Restart points store whole keys, so that they can be searched without
+	// reading keys before them. Summary also records index interval.
+	formatPrefix
+)
+
+// formatMarker starts the format header. In tables without the header
+// the same place holds length of the first key, which is never equal to it.
+const (
+	formatMarker     = uint64(math.MaxUint64)
+	formatHeaderSize = 8 + 1
+)
+
+func writeFormatHeader(writer io.Writer, format tableFormat) error {
+	header := binary.LittleEndian.AppendUint64(make([]byte, 0, formatHeaderSize), formatMarker)
+	_, err := writer.Write(append(header, byte(format)))
+	return err
+}
+
+// readFormatHeader reads the format header if reader starts with it.
+// Tables without the header have baseline format.
+func readFormatHeader(reader *bufio.Reader) (tableFormat, error) {
+	marker, err := reader.Peek(8)
+	if err != nil || binary.LittleEndian.Uint64(marker) != formatMarker {
+		return formatBaseline, nil
+	}
+	header := make([]byte, formatHeaderSize)
+	_, err = io.ReadFull(reader, header)
+	if err != nil {
+		return formatBaseline, unexpectedEOF(err)
+	}
+	format := tableFormat(header[8])
+	if format != formatPrefix {
+		return formatBaseline, errors.New("unsupported table format")
+	}
+	return format, nil
+}
+
+// appendKey appends passed key compressed against the previous key.
+// Key is stored whole if previous key is empty.
+func appendKey(buffer []byte, previousKey, key string) []byte {
+	shared := 0
+	for shared < len(previousKey) && shared < len(key) && previousKey[shared] == key[shared] {
+		shared++
+	}
+	buffer = binary.AppendUvarint(buffer, uint64(shared))
+	buffer = binary.AppendUvarint(buffer, uint64(len(key)-shared))
+	return append(buffer, key[shared:]...)
+}
+
+// byteReader is a reader of keys and values, which is either a buffered
+// reader of a file or a reader of a block that is already in memory.
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// readKey reads a key that was compressed against passed previous key.
+func readKey(reader byteReader, previousKey string) (string, error) {
+	shared, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return "", err
+	}
+	if shared > uint64(len(previousKey)) {
+		return "", errors.New("invalid shared key length")
+	}
+	suffix, err := readBytes(reader)
+	if err != nil {
+		return "", unexpectedEOF(err)
+	}
+	return previousKey[:shared] + string(suffix), nil
+}
+
+// appendString appends passed value after its varint length.
+func appendString(buffer []byte, value string) []byte {
+	buffer = binary.AppendUvarint(buffer, uint64(len(value)))
+	return append(buffer, value...)
+}
+
+// readBytes reads a value written after its varint length.
+func readBytes(reader byteReader) ([]byte, error) {
+	size, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	return readSizedBytes(reader, size)
+}
+
+// maxPreallocSize is the largest length read from a file
+// for which memory is allocated before data is read.
+const maxPreallocSize = 1 << 20
+
+// readSizedBytes reads passed number of bytes, which is a length read from
+// a file. Memory for a length larger than maxPreallocSize grows while data
+// is read, so a damaged length can't exhaust it, and a length larger than
+// the rest of the data is io.ErrUnexpectedEOF.
+func readSizedBytes(reader io.Reader, size uint64) ([]byte, error) {
+	if size <= maxPreallocSize {
+		value := make([]byte, size)
+		_, err := io.ReadFull(reader, value)
+		return value, unexpectedEOF(err)
+	}
+	if size > math.MaxInt64 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	value, err := io.ReadAll(io.LimitReader(reader, int64(size)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(value)) != size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return value, nil
+}
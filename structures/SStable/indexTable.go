@@ -5,127 +5,201 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"os"
+	"napredni/structures/storageErrors"
 )
 
-// IndexTableEntry forms inside an index file.
+// IndexTableEntry forms inside an index file. There is one entry for
+// every data block, which holds the last key of the block together with
+// offset and size of the block in the data file. Every entry that summary
+// points to is a restart point. In baseline format there is an entry for
+// every record, which holds its key and offset without size.
 type IndexTableEntry struct {
 	KeySize uint64
 	Key     string
 	Offset  uint64
+	Size    uint64
 }
 
-// GetSize returns size in bytes of a single index entry.
+// GetSize returns size in bytes of a single index entry in baseline format.
 func (indexEntry *IndexTableEntry) GetSize() uint64 {
 	return 8 + indexEntry.KeySize + 8
 }
 
+// getSize returns size in bytes of the entry in passed format,
+// where its key is compressed against passed previous key.
+func (indexEntry *IndexTableEntry) getSize(format tableFormat, previousKey string) uint64 {
+	if format == formatBaseline {
+		return indexEntry.GetSize()
+	}
+	return uint64(len(indexEntry.appendEntry(nil, previousKey)))
+}
+
+// appendEntry appends the entry in prefix format, with its
+// key compressed against passed previous key.
+func (indexEntry *IndexTableEntry) appendEntry(buffer []byte, previousKey string) []byte {
+	buffer = appendKey(buffer, previousKey, indexEntry.Key)
+	buffer = binary.AppendUvarint(buffer, indexEntry.Offset)
+	return binary.AppendUvarint(buffer, indexEntry.Size)
+}
+
+// readEntry reads a single index entry in passed format, whose key
+// is compressed against passed previous key. It returns true if
+// reader is at the end.
+func (indexEntry *IndexTableEntry) readEntry(reader *bufio.Reader, format tableFormat, previousKey string) (bool, error) {
+	if format == formatBaseline {
+		return indexEntry.ReadEntryFromIndexFile(reader)
+	}
+	key, err := readKey(reader, previousKey)
+	if err != nil {
+		if err == io.EOF {
+			return true, nil
+		}
+		return false, err
+	}
+	indexEntry.Key = key
+	indexEntry.KeySize = uint64(len(key))
+
+	indexEntry.Offset, err = binary.ReadUvarint(reader)
+	if err != nil {
+		return false, unexpectedEOF(err)
+	}
+	indexEntry.Size, err = binary.ReadUvarint(reader)
+	return false, unexpectedEOF(err)
+}
+
 // Print prints an entry info to terminal.
 func (indexEntry *IndexTableEntry) Print() {
 	fmt.Println("Key size:", indexEntry.KeySize)
 	fmt.Println("Key:", indexEntry.Key)
 	fmt.Println("Offset:", indexEntry.Offset)
+	fmt.Println("Size:", indexEntry.Size)
 }
 
-// WriteEntryToIndexFile writes a single index entry to file.
-func (indexEntry *IndexTableEntry) WriteEntryToIndexFile(writer *bufio.Writer) {
+// WriteEntryToIndexFile writes a single index entry to file in baseline format.
+func (indexEntry *IndexTableEntry) WriteEntryToIndexFile(writer io.Writer) error {
 	err := binary.Write(writer, binary.LittleEndian, indexEntry.KeySize)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	err = binary.Write(writer, binary.LittleEndian, []byte(indexEntry.Key))
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	err = binary.Write(writer, binary.LittleEndian, indexEntry.Offset)
-	if err != nil {
-		panic(err)
-	}
+	return binary.Write(writer, binary.LittleEndian, indexEntry.Offset)
 }
 
-// ReadEntryFromIndexFile reads a single index entry from file to passed pointer
-func (indexEntry *IndexTableEntry) ReadEntryFromIndexFile(reader *bufio.Reader) bool {
+// ReadEntryFromIndexFile reads a single index entry in baseline format from file to
+// passed pointer. It returns true if reader is at the end.
+func (indexEntry *IndexTableEntry) ReadEntryFromIndexFile(reader *bufio.Reader) (bool, error) {
 	err := binary.Read(reader, binary.LittleEndian, &indexEntry.KeySize)
 	if err != nil {
 		if err == io.EOF {
-			return true
+			return true, nil
 		}
-		panic(err)
+		return false, err
 	}
 
-	keyByteSlice := make([]byte, indexEntry.KeySize)
-	err = binary.Read(reader, binary.LittleEndian, &keyByteSlice)
+	keyByteSlice, err := readSizedBytes(reader, indexEntry.KeySize)
 	if err != nil {
-		if err == io.EOF {
-			return true
-		}
-		panic(err)
+		return false, err
 	}
 	indexEntry.Key = string(keyByteSlice)
 
 	err = binary.Read(reader, binary.LittleEndian, &indexEntry.Offset)
 	if err != nil {
-		if err == io.EOF {
-			return true
-		}
-		panic(err)
+		return false, unexpectedEOF(err)
 	}
 
-	return false
+	return false, nil
 }
 
-// GetOffsetInDataTableForKey returns offset for data table for passed key and
-// bool value that is true if offset is found, otherwise false.
-func getOffsetInDataTableForKey(key string, filePath string, offset uint64, intervalSize uint64) (uint64, bool) {
-	file, err := os.Open(filePath)
+// getBlockForKey returns index entry of the data block that can hold passed
+// key and bool value that is true if entry is found, otherwise false. Index
+// section is read from passed offset, which is a restart point in prefix
+// format, up to the first entry whose last key is not less than the key.
+func getBlockForKey(key string, files openFiles, index section, format tableFormat,
+	offset uint64) (*IndexTableEntry, bool, error) {
+	sectionReader, err := files.reader(index)
 	if err != nil {
-		panic(err)
-		return 0, false
+		return nil, false, err
 	}
-	defer file.Close()
-	reader := bufio.NewReader(file)
-
-	_, err = file.Seek(int64(offset), 0)
+	_, err = sectionReader.Seek(int64(offset), io.SeekStart)
 	if err != nil {
-		return 0, false
+		return nil, false, storageErrors.NewIO("seek", index.path, err)
 	}
+	reader := bufio.NewReader(sectionReader)
 
 	tmpIndexEntry := IndexTableEntry{}
-	for i := uint64(0); i < intervalSize; i++ {
-		eof := tmpIndexEntry.ReadEntryFromIndexFile(reader)
+	for {
+		previousKey := tmpIndexEntry.Key
+		eof, err := tmpIndexEntry.readEntry(reader, format, previousKey)
+		if err != nil {
+			return nil, false, storageErrors.NewCorruption(index.path, index.offset+int64(offset), err.Error())
+		}
 		if eof {
-			return 0, false
+			return nil, false, nil
 		}
 
-		if tmpIndexEntry.Key == key {
-			return tmpIndexEntry.Offset, true
+		if tmpIndexEntry.Key >= key {
+			return &tmpIndexEntry, true, nil
 		}
+		offset += tmpIndexEntry.getSize(format, previousKey)
 	}
-	return 0, false
 }
 
-func (sstable *SSTable) PrintIndexFile() {
-	file, err := os.Open(sstable.IndexFilePath)
-	if err!= nil {
-		panic(err)
+func (sstable *SSTable) PrintIndexFile() error {
+	files := openFiles{}
+	defer files.close()
+	tableSections, err := sstable.sections(files)
+	if err != nil {
+		return err
+	}
+	entries, _, err := readIndexEntries(files, tableSections.index)
+	if err != nil {
+		return err
 	}
-	defer file.Close()
-	reader := bufio.NewReader(file)
 
 	fmt.Println("****************************Entries****************************")
-	i := 1
-	indexEntry := IndexTableEntry{}
+	for i := range entries {
+		fmt.Println("Entry", i+1)
+		entries[i].Print()
+		fmt.Println()
+	}
+	return nil
+}
+
+// readIndexEntries reads all entries from index section
+// and returns them together with format of the table.
+func readIndexEntries(files openFiles, index section) ([]IndexTableEntry, tableFormat, error) {
+	sectionReader, err := files.reader(index)
+	if err != nil {
+		return nil, formatBaseline, err
+	}
+	reader := bufio.NewReader(sectionReader)
+	format, err := readFormatHeader(reader)
+	if err != nil {
+		return nil, formatBaseline, storageErrors.NewCorruption(index.path, index.offset, err.Error())
+	}
+
+	entries := make([]IndexTableEntry, 0)
+	offset := index.offset
+	if format != formatBaseline {
+		offset += formatHeaderSize
+	}
+	previousKey := ""
 	for {
-		eof := indexEntry.ReadEntryFromIndexFile(reader)
+		entry := IndexTableEntry{}
+		eof, err := entry.readEntry(reader, format, previousKey)
+		if err != nil {
+			return nil, formatBaseline, storageErrors.NewCorruption(index.path, offset, err.Error())
+		}
 		if eof {
-			break
+			return entries, format, nil
 		}
-
-		fmt.Println("Entry", i)
-		indexEntry.Print()
-		fmt.Println()
-		i++
+		entries = append(entries, entry)
+		offset += int64(entry.getSize(format, previousKey))
+		previousKey = entry.Key
 	}
 }
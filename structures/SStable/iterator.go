@@ -0,0 +1,251 @@
+package SStable
+
+import (
+	"io"
+	"napredni/structures/record"
+	"sort"
+)
+
+// Iterator walks through records of one sstable in key order.
+// Index entries of the table are kept in memory together with
+// records of the data block the iterator is in, so the iterator
+// can move in both directions and read only blocks it stops at.
+// For every key it returns the newest version visible at its
+// sequence number, and keys without such version are skipped.
+type Iterator struct {
+	sstable  *SSTable
+	files    openFiles
+	data     *io.SectionReader
+	dataPath string
+	format   tableFormat
+	entries  []IndexTableEntry
+	seqNum   uint64
+	// block is position of index entry of the block in records,
+	// and position is position of the record inside of it.
+	block    int
+	records  []record.Record
+	position int
+	record   *record.Record
+	err      error
+}
+
+// NewIterator opens files of the sstable and reads its index.
+// Iterator is not positioned until one of the seek methods is called.
+func (sstable *SSTable) NewIterator() (*Iterator, error) {
+	return sstable.NewIteratorAt(record.MaxSeqNum)
+}
+
+// NewIteratorAt returns iterator that ignores versions
+// newer than passed sequence number.
+func (sstable *SSTable) NewIteratorAt(seqNum uint64) (*Iterator, error) {
+	files := openFiles{}
+	tableSections, err := sstable.sections(files)
+	if err != nil {
+		files.close()
+		return nil, err
+	}
+	entries, format, err := readIndexEntries(files, tableSections.index)
+	if err != nil {
+		files.close()
+		return nil, err
+	}
+	data, err := files.reader(tableSections.data)
+	if err != nil {
+		files.close()
+		return nil, err
+	}
+	return &Iterator{sstable: sstable, files: files, data: data, dataPath: tableSections.data.path,
+		format: format, entries: entries, seqNum: seqNum, block: -1, position: -1}, nil
+}
+
+func (it *Iterator) SeekToFirst() {
+	it.moveTo(0, 0, true)
+}
+
+func (it *Iterator) SeekToLast() {
+	it.moveTo(len(it.entries)-1, -1, false)
+}
+
+// Seek positions iterator at the first record whose key is not less than key.
+// Only the first block whose last key is not less than key can hold it.
+func (it *Iterator) Seek(key string) {
+	block := sort.Search(len(it.entries), func(i int) bool {
+		return it.entries[i].Key >= key
+	})
+	if !it.loadBlock(block) {
+		it.moveTo(block, 0, true)
+		return
+	}
+	it.moveTo(block, sort.Search(len(it.records), func(i int) bool {
+		return it.records[i].Key >= key
+	}), true)
+}
+
+func (it *Iterator) Next() {
+	it.moveTo(it.block, it.versionsEnd(it.position), true)
+}
+
+func (it *Iterator) Prev() {
+	if it.position == 0 {
+		it.moveTo(it.block-1, -1, false)
+		return
+	}
+	it.moveTo(it.block, it.position-1, false)
+}
+
+func (it *Iterator) Valid() bool {
+	return it.err == nil && it.record != nil
+}
+
+func (it *Iterator) Key() string {
+	return it.record.Key
+}
+
+func (it *Iterator) Record() *record.Record {
+	return it.record
+}
+
+// Close closes files of the sstable and returns the first
+// error that iterator ran into while reading records.
+func (it *Iterator) Close() error {
+	it.record = nil
+	it.records = nil
+	err := it.files.close()
+	if it.err != nil {
+		return it.err
+	}
+	return err
+}
+
+// moveTo positions iterator at the key of record on passed position inside
+// of passed block and finds its visible version. Position -1 means the last
+// record of the block. If the key has no visible version, or position is
+// outside of the block, iterator moves on in passed direction. If block is
+// out of range, iterator becomes invalid.
+func (it *Iterator) moveTo(block int, position int, forward bool) {
+	it.record = nil
+	for it.loadBlock(block) {
+		if position < 0 {
+			position = len(it.records) + position
+		}
+		if position < 0 || position >= len(it.records) {
+			if forward {
+				block, position = block+1, 0
+			} else {
+				block, position = block-1, -1
+			}
+			continue
+		}
+
+		it.position = it.versionsStart(position)
+		end := it.versionsEnd(position)
+		for i := it.position; i < end; i++ {
+			if it.records[i].SeqNum <= it.seqNum {
+				it.record = &it.records[i]
+				return
+			}
+		}
+		if forward {
+			position = end
+		} else {
+			position = it.position - 1
+			if position < 0 {
+				block, position = block-1, -1
+			}
+		}
+	}
+	it.block = -1
+	it.records = nil
+	it.position = -1
+}
+
+// loadBlock reads records of passed block, unless the iterator is already
+// in it. It returns false if block is out of range or can't be read.
+func (it *Iterator) loadBlock(block int) bool {
+	if it.err != nil || block < 0 || block >= len(it.entries) {
+		return false
+	}
+	if block == it.block {
+		return true
+	}
+	records, err := readBlock(it.data, it.dataPath, it.format, &it.entries[block])
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.block = block
+	it.records = records
+	return true
+}
+
+// versionsStart returns position of the first record for key on passed position.
+// All versions of a key are inside of one block. Tables in baseline format hold
+// a single version of every key, so every record of theirs is a block.
+func (it *Iterator) versionsStart(position int) int {
+	for position > 0 && it.records[position-1].Key == it.records[position].Key {
+		position--
+	}
+	return position
+}
+
+// versionsEnd returns position after the last record for key on passed position.
+func (it *Iterator) versionsEnd(position int) int {
+	end := position + 1
+	for end < len(it.records) && it.records[end].Key == it.records[position].Key {
+		end++
+	}
+	return end
+}
+
+// VersionIterator walks through all records of one sstable in the order
+// in which they are written, with every version of a key, reading one
+// data block at a time. Compaction merges sstables through it.
+type VersionIterator struct {
+	iterator *Iterator
+	position int
+}
+
+// NewVersionIterator opens files of the sstable and reads its index.
+// Iterator is positioned at the first record.
+func (sstable *SSTable) NewVersionIterator() (*VersionIterator, error) {
+	it, err := sstable.NewIterator()
+	if err != nil {
+		return nil, err
+	}
+	versions := &VersionIterator{iterator: it}
+	versions.moveTo(0, 0)
+	return versions, nil
+}
+
+func (versions *VersionIterator) Next() {
+	versions.moveTo(versions.iterator.block, versions.position+1)
+}
+
+func (versions *VersionIterator) Valid() bool {
+	return versions.position >= 0
+}
+
+func (versions *VersionIterator) Record() *record.Record {
+	return &versions.iterator.records[versions.position]
+}
+
+// Close closes files of the sstable and returns the first
+// error that iterator ran into while reading records.
+func (versions *VersionIterator) Close() error {
+	versions.position = -1
+	return versions.iterator.Close()
+}
+
+// moveTo positions iterator at record on passed position inside of passed
+// block, or at the first record of the next block that has one. Iterator
+// becomes invalid after the last block or if a block can't be read.
+func (versions *VersionIterator) moveTo(block int, position int) {
+	for versions.iterator.loadBlock(block) {
+		if position < len(versions.iterator.records) {
+			versions.position = position
+			return
+		}
+		block, position = block+1, 0
+	}
+	versions.position = -1
+}
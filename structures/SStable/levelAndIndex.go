@@ -1,23 +1,59 @@
 package SStable
 
 import (
+	"errors"
 	"io/ioutil"
+	"napredni/structures/record"
+	"napredni/structures/storageErrors"
+	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
 
+// Directories inside of the root directory that hold sstable files.
+// SingleFileDir holds sstables that are formed as a single file, and
+// QuarantineDir holds files of sstables that couldn't be read, which
+// are not part of the store anymore.
+const (
+	DataDir       = "data"
+	IndexDir      = "index"
+	SummaryDir    = "summary"
+	FilterDir     = "filter"
+	MetadataDir   = "metadata"
+	TOCDir        = "toc"
+	SingleFileDir = "sstable"
+	QuarantineDir = "quarantine"
+)
+
+var sstableDirs = []string{DataDir, IndexDir, SummaryDir, FilterDir, MetadataDir, TOCDir, SingleFileDir}
+
+// FormDirectories creates all directories for sstable
+// files inside of passed root directory.
+func FormDirectories(dir string) error {
+	for _, subDir := range sstableDirs {
+		path := filepath.Join(dir, subDir)
+		err := os.MkdirAll(path, 0777)
+		if err != nil {
+			return storageErrors.NewIO("mkdir", path, err)
+		}
+	}
+	return nil
+}
+
 // FormFilePathsForSSTable forms all file paths for sstable
-// based on passed level and index
-func FormFilePathsForSSTable(level int, index int) []string {
+// inside of passed root directory based on passed level and index
+func FormFilePathsForSSTable(dir string, level int, index int) []string {
 	levelAndIndexFormat := strconv.Itoa(level) + "_" + strconv.Itoa(index)
 
-	dataFilePath := "data/data/usertable_" + levelAndIndexFormat + "_data.db"
-	indexFilePath := "data/index/usertable_" + levelAndIndexFormat + "_index.db"
-	summaryFilePath := "data/summary/usertable_" + levelAndIndexFormat + "_summary.db"
-	filterFilePath := "data/filter/usertable_" + levelAndIndexFormat + "_filter.db"
-	metadataFilePath := "data/metadata/usertable_" + levelAndIndexFormat + "_metadata.db"
-	tocFilePath := "data/toc/usertable_" + levelAndIndexFormat + "_toc.txt"
+	dataFilePath := filepath.Join(dir, DataDir, "usertable_"+levelAndIndexFormat+"_data.db")
+	indexFilePath := filepath.Join(dir, IndexDir, "usertable_"+levelAndIndexFormat+"_index.db")
+	summaryFilePath := filepath.Join(dir, SummaryDir, "usertable_"+levelAndIndexFormat+"_summary.db")
+	filterFilePath := filepath.Join(dir, FilterDir, "usertable_"+levelAndIndexFormat+"_filter.db")
+	metadataFilePath := filepath.Join(dir, MetadataDir, "usertable_"+levelAndIndexFormat+"_metadata.db")
+	tocFilePath := filepath.Join(dir, TOCDir, "usertable_"+levelAndIndexFormat+"_toc.txt")
 
 	filePaths := make([]string, 0)
 	filePaths = append(filePaths, dataFilePath, indexFilePath, summaryFilePath, filterFilePath, metadataFilePath,
@@ -26,19 +62,103 @@ func FormFilePathsForSSTable(level int, index int) []string {
 	return filePaths
 }
 
+// FormSingleFilePathForSSTable forms path of single-file sstable
+// inside of passed root directory based on passed level and index.
+func FormSingleFilePathForSSTable(dir string, level int, index int) string {
+	return filepath.Join(dir, SingleFileDir, "usertable_"+strconv.Itoa(level)+"_"+strconv.Itoa(index)+"_sstable.db")
+}
+
+// FormSSTableForLevelAndIndex forms sstable from passed records inside
+// of passed root directory with passed level and index, as passed
+// options decide.
+func FormSSTableForLevelAndIndex(records []record.Record, dir string, level int, index int,
+	options Options) (*SSTable, error) {
+	if options.SingleFile {
+		return FormSingleFileSSTable(records, options, FormSingleFilePathForSSTable(dir, level, index))
+	}
+	filePaths := FormFilePathsForSSTable(dir, level, index)
+	return FormSSTable(records, options, filePaths[0], filePaths[1], filePaths[2], filePaths[3], filePaths[4],
+		filePaths[5])
+}
+
+// GetSSTableForLevelAndIndex returns SSTable object for sstable
+// inside of passed root directory with passed level and index.
+// If single file of the sstable exists, sstable is in that format.
+func GetSSTableForLevelAndIndex(dir string, level int, index int) SSTable {
+	singleFilePath := FormSingleFilePathForSSTable(dir, level, index)
+	if _, err := os.Stat(singleFilePath); err == nil {
+		return SSTable{FilePath: singleFilePath}
+	}
+	filePaths := FormFilePathsForSSTable(dir, level, index)
+	return SSTable{DataFilePath: filePaths[0], IndexFilePath: filePaths[1],
+		SummaryFilePath: filePaths[2], FilterFilePath: filePaths[3], MetadataFilePath: filePaths[4],
+		TOCFilePath: filePaths[5]}
+}
+
+// FindSSTables returns every sstable inside of passed root directory that
+// has at least one file, sorted by level and index. Some of its files may
+// be missing if forming or deleting of the sstable was interrupted.
+func FindSSTables(dir string) ([]SSTable, error) {
+	found := make(map[[2]int]bool)
+	for _, subDir := range sstableDirs {
+		path := filepath.Join(dir, subDir)
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, storageErrors.NewIO("read", path, err)
+		}
+		for _, file := range files {
+			if strings.HasSuffix(file.Name(), tmpSuffix) {
+				continue
+			}
+			level, index, err := GetLevelAndIndexForFileName(file.Name())
+			if err == nil {
+				found[[2]int{level, index}] = true
+			}
+		}
+	}
+
+	levelsAndIndexes := make([][2]int, 0, len(found))
+	for levelAndIndex := range found {
+		levelsAndIndexes = append(levelsAndIndexes, levelAndIndex)
+	}
+	sort.Slice(levelsAndIndexes, func(i, j int) bool {
+		if levelsAndIndexes[i][0] != levelsAndIndexes[j][0] {
+			return levelsAndIndexes[i][0] < levelsAndIndexes[j][0]
+		}
+		return levelsAndIndexes[i][1] < levelsAndIndexes[j][1]
+	})
+	sstables := make([]SSTable, 0, len(levelsAndIndexes))
+	for _, levelAndIndex := range levelsAndIndexes {
+		sstables = append(sstables, GetSSTableForLevelAndIndex(dir, levelAndIndex[0], levelAndIndex[1]))
+	}
+	return sstables, nil
+}
+
 // GetNewIndexForLevel returns new index for passed level
-func GetNewIndexForLevel(level int) int {
-	return getLastIndexForLevel(level) + 1
+// of sstables inside of passed root directory
+func GetNewIndexForLevel(dir string, level int) int {
+	return getLastIndexForLevel(dir, level) + 1
 }
 
 // GetLevelAndIndexForFileName returns index and level
-// for passed value of file name,
-func GetLevelAndIndexForFileName(fileName string) (int, int) {
-	return getLevelForFileName(fileName), getIndexForFileName(fileName)
+// for passed value of file name, or an error if the name
+// is not a name of sstable file.
+func GetLevelAndIndexForFileName(fileName string) (int, int, error) {
+	level, err := getLevelForFileName(fileName)
+	if err != nil {
+		return 0, 0, err
+	}
+	index, err := getIndexForFileName(fileName)
+	if err != nil {
+		return 0, 0, err
+	}
+	return level, index, nil
 }
 
-func getLastIndexForLevel(level int) int {
-	files, _ := ioutil.ReadDir("data/data")
+func getLastIndexForLevel(dir string, level int) int {
+	files, _ := ioutil.ReadDir(filepath.Join(dir, DataDir))
+	singleFiles, _ := ioutil.ReadDir(filepath.Join(dir, SingleFileDir))
+	files = append(files, singleFiles...)
 	maxIndex := 0
 
 	if len(files) == 0 {
@@ -49,8 +169,8 @@ func getLastIndexForLevel(level int) int {
 		fileName := file.Name()
 
 		if FileNameMatchesLevel(fileName, level) {
-			index := getIndexForFileName(fileName)
-			if index > maxIndex {
+			index, err := getIndexForFileName(fileName)
+			if err == nil && index > maxIndex {
 				maxIndex = index
 			}
 		}
@@ -68,22 +188,18 @@ func FileNameMatchesLevel(fileName string, level int) bool {
 	return false
 }
 
-func getLevelForFileName(fileName string) int {
+func getLevelForFileName(fileName string) (int, error) {
 	fileSplitSlice := strings.Split(fileName, "_")
-	level, err := strconv.Atoi(fileSplitSlice[1])
-	if err != nil {
-		panic(err)
+	if len(fileSplitSlice) < 3 {
+		return 0, errors.New("invalid sstable file name " + fileName)
 	}
-
-	return level
+	return strconv.Atoi(fileSplitSlice[1])
 }
 
-func getIndexForFileName(fileName string) int {
+func getIndexForFileName(fileName string) (int, error) {
 	fileSplitSlice := strings.Split(fileName, "_")
-	index, err := strconv.Atoi(fileSplitSlice[2])
-	if err != nil {
-		panic(err)
+	if len(fileSplitSlice) < 3 {
+		return 0, errors.New("invalid sstable file name " + fileName)
 	}
-
-	return index
+	return strconv.Atoi(fileSplitSlice[2])
 }
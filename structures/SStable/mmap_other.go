@@ -0,0 +1,17 @@
+//go:build !unix
+
+package SStable
+
+import (
+	"errors"
+	"os"
+)
+
+// mapFile is not supported, so data files are read through open files.
+func mapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("mmap is not supported")
+}
+
+func unmapFile(mapped []byte) error {
+	return nil
+}
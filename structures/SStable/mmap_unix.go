@@ -0,0 +1,17 @@
+//go:build unix
+
+package SStable
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps passed file into memory for reading.
+func mapFile(file *os.File, size int64) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func unmapFile(mapped []byte) error {
+	return syscall.Munmap(mapped)
+}
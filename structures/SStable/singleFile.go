@@ -0,0 +1,191 @@
+package SStable
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"napredni/structures/record"
+	"napredni/structures/storageErrors"
+	"os"
+	"path/filepath"
+)
+
+// Single-file sstable holds data blocks followed by index, summary,
+// filter and metadata sections, and ends with a footer that holds
+// offset and size of every section, format version and magic number.
+const (
+	singleFileMagic   = uint64(0x53535441424c4553)
+	singleFileVersion = uint32(1)
+	footerSize        = 5*(8+8) + 4 + 8
+)
+
+// tmpSuffix is added to name of single-file sstable while it is written.
+const tmpSuffix = ".tmp"
+
+// section is a part of a file of the sstable that holds one of its
+// tables. Every table of a multi-file sstable is a whole file.
+type section struct {
+	path   string
+	offset int64
+	size   int64
+}
+
+// sections holds sections of all tables of an sstable.
+type sections struct {
+	data     section
+	index    section
+	summary  section
+	filter   section
+	metadata section
+}
+
+// openFiles keeps files of an sstable open while it is read, so that
+// all sections of a single-file sstable are read through one open file.
+type openFiles map[string]*os.File
+
+// open returns file on passed path, which is opened on the first use.
+func (files openFiles) open(path string) (*os.File, error) {
+	file, found := files[path]
+	if found {
+		return file, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, storageErrors.NewIO("open", path, err)
+	}
+	files[path] = file
+	return file, nil
+}
+
+// reader returns reader of passed section.
+func (files openFiles) reader(section section) (*io.SectionReader, error) {
+	file, err := files.open(section.path)
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(file, section.offset, section.size), nil
+}
+
+// close closes all opened files and returns the first error.
+func (files openFiles) close() error {
+	var err error
+	for path, file := range files {
+		closeErr := file.Close()
+		if err == nil {
+			err = storageErrors.NewIO("close", path, closeErr)
+		}
+		delete(files, path)
+	}
+	return err
+}
+
+// sections returns sections of all tables of the sstable. Sections of a
+// single-file sstable are read from its footer through passed files.
+func (sstable *SSTable) sections(files openFiles) (sections, error) {
+	if sstable.FilePath == "" {
+		return sections{
+			data:     section{path: sstable.DataFilePath, size: math.MaxInt64},
+			index:    section{path: sstable.IndexFilePath, size: math.MaxInt64},
+			summary:  section{path: sstable.SummaryFilePath, size: math.MaxInt64},
+			filter:   section{path: sstable.FilterFilePath, size: math.MaxInt64},
+			metadata: section{path: sstable.MetadataFilePath, size: math.MaxInt64},
+		}, nil
+	}
+
+	file, err := files.open(sstable.FilePath)
+	if err != nil {
+		return sections{}, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return sections{}, storageErrors.NewIO("stat", sstable.FilePath, err)
+	}
+	footerOffset := info.Size() - footerSize
+	if footerOffset < 0 {
+		return sections{}, storageErrors.NewCorruption(sstable.FilePath, 0, "file is smaller than footer")
+	}
+	footer := make([]byte, footerSize)
+	_, err = file.ReadAt(footer, footerOffset)
+	if err != nil {
+		return sections{}, storageErrors.NewIO("read", sstable.FilePath, err)
+	}
+	tableSections, err := decodeFooter(sstable.FilePath, footer, footerOffset)
+	if err != nil {
+		return sections{}, storageErrors.NewCorruption(sstable.FilePath, footerOffset, err.Error())
+	}
+	return tableSections, nil
+}
+
+// encodeFooter returns footer for passed sections.
+func encodeFooter(tableSections sections) []byte {
+	footer := make([]byte, 0, footerSize)
+	for _, tableSection := range tableSections.list() {
+		footer = binary.LittleEndian.AppendUint64(footer, uint64(tableSection.offset))
+		footer = binary.LittleEndian.AppendUint64(footer, uint64(tableSection.size))
+	}
+	footer = binary.LittleEndian.AppendUint32(footer, singleFileVersion)
+	return binary.LittleEndian.AppendUint64(footer, singleFileMagic)
+}
+
+// decodeFooter returns sections of file on passed path from its footer,
+// which starts at passed offset. Sections must be placed before it.
+func decodeFooter(path string, footer []byte, footerOffset int64) (sections, error) {
+	if binary.LittleEndian.Uint64(footer[footerSize-8:]) != singleFileMagic {
+		return sections{}, errors.New("invalid magic number")
+	}
+	version := binary.LittleEndian.Uint32(footer[footerSize-12:])
+	if version != singleFileVersion {
+		return sections{}, errors.New("unsupported format version")
+	}
+
+	tableSections := sections{}
+	for i, tableSection := range tableSections.pointers() {
+		offset := binary.LittleEndian.Uint64(footer[i*16:])
+		size := binary.LittleEndian.Uint64(footer[i*16+8:])
+		if offset > uint64(footerOffset) || size > uint64(footerOffset)-offset {
+			return sections{}, errors.New("section is outside of file")
+		}
+		*tableSection = section{path: path, offset: int64(offset), size: int64(size)}
+	}
+	return tableSections, nil
+}
+
+// list returns sections in the order in which they are written to footer.
+func (tableSections *sections) list() []section {
+	return []section{tableSections.data, tableSections.index, tableSections.summary,
+		tableSections.filter, tableSections.metadata}
+}
+
+func (tableSections *sections) pointers() []*section {
+	return []*section{&tableSections.data, &tableSections.index, &tableSections.summary,
+		&tableSections.filter, &tableSections.metadata}
+}
+
+// FormSingleFileSSTable forms sstable from passed records as a single
+// file on passed path, with data blocks compressed with codec of passed
+// options. File is written under a temporary name and renamed once it
+// is complete, so it appears at once.
+func FormSingleFileSSTable(recordElements []record.Record, options Options, filePath string) (*SSTable, error) {
+	writer, err := NewSingleFileWriter(options, filePath)
+	if err != nil {
+		return nil, err
+	}
+	return writer.writeAll(recordElements)
+}
+
+// RemoveUnfinishedFiles deletes single-file sstables inside of passed root
+// directory that were left unfinished by an interrupted flush or compaction.
+func RemoveUnfinishedFiles(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, SingleFileDir, "*"+tmpSuffix))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return storageErrors.NewIO("remove", path, err)
+		}
+	}
+	return nil
+}
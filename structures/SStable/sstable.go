@@ -3,14 +3,37 @@ package SStable
 import (
 	"bufio"
 	"encoding/binary"
+	"io"
 	"napredni/structures/bloomFilter"
-	"napredni/structures/merkleTree"
 	"napredni/structures/record"
+	"napredni/structures/storageErrors"
 	"os"
+	"path/filepath"
 )
 
+// indexFileInterval is index interval of sstables
+// whose options or summary don't set it.
 const indexFileInterval = 10
 
+// Options decides how new sstables are formed.
+type Options struct {
+	// SingleFile is true if sstable is formed as a single file.
+	SingleFile bool
+	// Codec is compression of data blocks.
+	Codec Codec
+	// IndexInterval is number of index entries
+	// for which summary holds a single entry.
+	IndexInterval int
+}
+
+// indexInterval returns index interval of the options.
+func (options *Options) indexInterval() int {
+	if options.IndexInterval <= 0 {
+		return indexFileInterval
+	}
+	return options.IndexInterval
+}
+
 type SSTable struct {
 	DataFilePath string
 	IndexFilePath string
@@ -18,233 +41,413 @@ type SSTable struct {
 	FilterFilePath string
 	MetadataFilePath string
 	TOCFilePath string
+	// FilePath is path of sstable that is formed as a single file,
+	// in which case paths of separate files are empty.
+	FilePath string
+	// MinKey and MaxKey are the smallest and the largest key
+	// in the sstable, and Size is size of its data file.
+	MinKey string
+	MaxKey string
+	Size   uint64
+	// Codec is compression of data blocks that the sstable was
+	// formed with, and RawSize is size that its data
+	// would have if blocks weren't compressed.
+	Codec   Codec
+	RawSize uint64
 }
 
 
 // FormSSTable forms all necessary files and returns SSTable object for
-// sstable based on passed paths and byte slice of records.
-func FormSSTable(recordElements []record.Record, dataFilePath, indexFilePath, summaryFilePath,
-	filterFilePath, metadataFilePath, tocFilePath string) *SSTable {
-	formDataWithIndexAndSummary(recordElements, dataFilePath, indexFilePath, summaryFilePath)
-	formFilter(recordElements, filterFilePath)
-	formMetadata(recordElements, metadataFilePath)
-	formTOC(dataFilePath, indexFilePath, summaryFilePath, filterFilePath, metadataFilePath, tocFilePath)
+// sstable based on passed paths and byte slice of records. Data blocks
+// are compressed with codec of passed options.
+func FormSSTable(recordElements []record.Record, options Options, dataFilePath, indexFilePath, summaryFilePath,
+	filterFilePath, metadataFilePath, tocFilePath string) (*SSTable, error) {
+	writer, err := NewWriter(options, dataFilePath, indexFilePath, summaryFilePath, filterFilePath, metadataFilePath,
+		tocFilePath)
+	if err != nil {
+		return nil, err
+	}
+	return writer.writeAll(recordElements)
+}
 
-	return &SSTable{dataFilePath, indexFilePath, summaryFilePath,
-		filterFilePath, metadataFilePath, tocFilePath}
+// Path returns path that identifies the sstable, which is path
+// of its single file or path of its data file.
+func (sstable *SSTable) Path() string {
+	if sstable.FilePath != "" {
+		return sstable.FilePath
+	}
+	return sstable.DataFilePath
 }
 
 // GetLevel returns level for SSTable object
-func (sstable *SSTable) GetLevel() int {
-	return getLevelForFileName(sstable.DataFilePath)
+func (sstable *SSTable) GetLevel() (int, error) {
+	return getLevelForFileName(filepath.Base(sstable.Path()))
 }
 
-// GetRecordInSStableForKey returns record from data file
-// and bool value that is true if record is found, otherwise false.
-func (sstable *SSTable) GetRecordInSStableForKey(key string) (*record.Record, bool) {
-	offsetIndexTable, found := getOffsetInIndexTableForKey(key, sstable.SummaryFilePath)
-	if !found {
-		return &record.Record{}, false
-	}
+// GetIndex returns index of SSTable object inside of its level
+func (sstable *SSTable) GetIndex() (int, error) {
+	return getIndexForFileName(filepath.Base(sstable.Path()))
+}
 
-	offsetDataTable, found := getOffsetInDataTableForKey(key, sstable.IndexFilePath, offsetIndexTable, indexFileInterval)
-	if !found {
-		return &record.Record{}, false
-	}
+// Stats holds size of data of an sstable with codec of its blocks.
+// CompressionRatio is size of data before compression divided by
+// its size on disk, where both include trailers of blocks.
+type Stats struct {
+	Level            int
+	Index            int
+	Codec            string
+	Size             uint64
+	RawSize          uint64
+	CompressionRatio float64
+}
 
-	foundRecord, found := getRecordInDataTableForOffset(sstable.DataFilePath, offsetDataTable)
-	if !found {
-		return &record.Record{}, false
+// Stats returns stats of the sstable.
+func (sstable *SSTable) Stats() (Stats, error) {
+	level, err := sstable.GetLevel()
+	if err != nil {
+		return Stats{}, err
 	}
-
-	return foundRecord, true
+	index, err := sstable.GetIndex()
+	if err != nil {
+		return Stats{}, err
+	}
+	stats := Stats{Level: level, Index: index, Codec: sstable.Codec.String(), Size: sstable.Size,
+		RawSize: sstable.RawSize, CompressionRatio: 1}
+	if sstable.Size > 0 {
+		stats.CompressionRatio = float64(sstable.RawSize) / float64(sstable.Size)
+	}
+	return stats, nil
 }
 
-// GetRecordsFromDataFile reads record slice from data file
-func (sstable *SSTable) GetRecordsFromDataFile() []record.Record {
-	file, err := os.OpenFile(sstable.DataFilePath, os.O_RDONLY, 0777)
+// ReadKeyRangeAndSize sets MinKey and MaxKey from the summary
+// and Size from size of the data. Codec and RawSize are not
+// known without reading all blocks, so data counts as raw.
+func (sstable *SSTable) ReadKeyRangeAndSize() error {
+	files := openFiles{}
+	defer files.close()
+	tableSections, err := sstable.sections(files)
+	if err != nil {
+		return err
+	}
+	reader, err := files.reader(tableSections.summary)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	reader := bufio.NewReader(file)
 
-	records := make([]record.Record, 0)
-	recordToRead := record.Record{}
-	for {
-		eof := recordToRead.DecodeRecord(reader)
-		if eof {
-			return records
+	summaryReader := bufio.NewReader(reader)
+	format, err := readFormatHeader(summaryReader)
+	summaryHeader := SummaryTableHeader{}
+	eof := false
+	if err == nil {
+		eof, err = summaryHeader.readHeader(summaryReader, format)
+	}
+	if err == nil && eof {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return storageErrors.NewCorruption(tableSections.summary.path, tableSections.summary.offset, err.Error())
+	}
+	sstable.MinKey = summaryHeader.MinKey
+	sstable.MaxKey = summaryHeader.MaxKey
+	sstable.Size = uint64(tableSections.data.size)
+	if sstable.FilePath == "" {
+		info, err := os.Stat(sstable.DataFilePath)
+		if err != nil {
+			return storageErrors.NewIO("stat", sstable.DataFilePath, err)
 		}
-		records = append(records, recordToRead)
+		sstable.Size = uint64(info.Size())
 	}
+	sstable.RawSize = sstable.Size
+	return nil
 }
 
-// DeleteSSTable deletes all files related to sstable based
-// on passed object SSTable
-func (sstable *SSTable) DeleteSSTable() {
-	err := os.Remove(sstable.DataFilePath)
-	if err!= nil {
-		panic(err)
+// ReadFilter reads bloom filter of the sstable.
+func (sstable *SSTable) ReadFilter() (*bloomFilter.BloomFilter, error) {
+	files := openFiles{}
+	defer files.close()
+	tableSections, err := sstable.sections(files)
+	if err != nil {
+		return nil, err
 	}
+	return readFilter(files, tableSections.filter)
+}
 
-	err = os.Remove(sstable.IndexFilePath)
-	if err!= nil {
-		panic(err)
+// readFilter decodes bloom filter from filter section.
+func readFilter(files openFiles, filterSection section) (*bloomFilter.BloomFilter, error) {
+	reader, err := files.reader(filterSection)
+	if err != nil {
+		return nil, err
+	}
+	filter := &bloomFilter.BloomFilter{}
+	err = filter.Decode(reader)
+	if err != nil {
+		return nil, storageErrors.NewCorruption(filterSection.path, filterSection.offset, err.Error())
 	}
+	return filter, nil
+}
+
+// GetRecordInSStableForKey returns record from data file
+// and bool value that is true if record is found, otherwise false.
+func (sstable *SSTable) GetRecordInSStableForKey(key string) (*record.Record, bool, error) {
+	return sstable.GetRecordInSStableForKeyAt(key, record.MaxSeqNum)
+}
 
-	err = os.Remove(sstable.SummaryFilePath)
-	if err!= nil {
-		panic(err)
+// GetRecordInSStableForKeyAt works like GetRecordInSStableForKey, but
+// returns the newest version that is not newer than passed sequence number.
+// Files of the sstable are opened and its summary is read for the lookup,
+// while TableCache.GetRecordAt keeps them open.
+func (sstable *SSTable) GetRecordInSStableForKeyAt(key string, seqNum uint64) (*record.Record, bool, error) {
+	files := openFiles{}
+	defer files.close()
+	table, err := sstable.loadTable(files)
+	if err != nil {
+		return &record.Record{}, false, err
 	}
+	return table.getRecord(files, key, seqNum)
+}
 
-	err = os.Remove(sstable.FilterFilePath)
-	if err!= nil {
-		panic(err)
+// getRecord returns the newest version of passed key that is not newer
+// than passed sequence number from the table, read through passed files.
+func (table *cachedTable) getRecord(files openFiles, key string, seqNum uint64) (*record.Record, bool, error) {
+	offsetIndexTable, found := table.summary.getOffsetInIndexTableForKey(key)
+	if !found {
+		return &record.Record{}, false, nil
 	}
 
-	err = os.Remove(sstable.MetadataFilePath)
-	if err!= nil {
-		panic(err)
+	format := table.summary.format
+	indexEntry, found, err := getBlockForKey(key, files, table.sections.index, format, offsetIndexTable)
+	if err != nil || !found {
+		return &record.Record{}, false, err
 	}
 
-	err = os.Remove(sstable.TOCFilePath)
-	if err!= nil {
-		panic(err)
+	data := table.data
+	if data == nil {
+		data, err = files.reader(table.sections.data)
+		if err != nil {
+			return &record.Record{}, false, err
+		}
 	}
+	return getVersionInDataBlock(data, table.sections.data.path, format, indexEntry, key, seqNum)
 }
 
-// formDataWithIndexAndSummary forms index and summary file based on record elements passed to the function.
-func formDataWithIndexAndSummary(recordElements []record.Record, dataFilePath, indexFilePath, summaryFilePath string) {
-	dataFile, err := os.OpenFile(dataFilePath, os.O_WRONLY|os.O_CREATE, 0777)
+// GetRecordsFromDataFile reads record slice from data file, block by block.
+func (sstable *SSTable) GetRecordsFromDataFile() ([]record.Record, error) {
+	files := openFiles{}
+	defer files.close()
+	tableSections, err := sstable.sections(files)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	dataFileWriter := bufio.NewWriter(dataFile)
-
-	indexFile, err := os.OpenFile(indexFilePath, os.O_WRONLY|os.O_CREATE, 0777)
+	entries, format, err := readIndexEntries(files, tableSections.index)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	indexFileWriter := bufio.NewWriter(indexFile)
-
-	summaryFile, err := os.OpenFile(summaryFilePath, os.O_WRONLY|os.O_CREATE, 0777)
+	reader, err := files.reader(tableSections.data)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	summaryFileWriter := bufio.NewWriter(summaryFile)
 
-	// Initialization of header in summary file. We know that
-	// first key will be min and last max because the slice
-	// is sorted.
-	summaryHeader := SummaryTableHeader{}
-	summaryHeader.MinKey = recordElements[0].Key
-	summaryHeader.MinKeySize = uint64(len(summaryHeader.MinKey))
-	summaryHeader.MaxKey = recordElements[len(recordElements)-1].Key
-	summaryHeader.MaxKeySize = uint64(len(summaryHeader.MaxKey))
-
-	summaryEntries := make([]SummaryTableEntry, 0)
-
-	offsetInDataFile := uint64(0)
-	offsetInIndexFile := uint64(0)
-
-	for index, recordElement := range recordElements {
-		// Writing record to data file
-		WriteRecordToDataFile(&recordElement, dataFileWriter)
-
-		// Forming index entry and writing it to the index file.
-		indexEntry := IndexTableEntry{KeySize: uint64(len(recordElement.Key)),
-			Key: recordElement.Key, Offset: offsetInDataFile}
-		indexEntry.WriteEntryToIndexFile(indexFileWriter)
-		offsetInDataFile += recordElement.GetSize()
-
-		// indexFileInterval represents distance between
-		// 2 index entries in index file that are written
-		// in summary file.
-		if index%indexFileInterval == 0 || index == len(recordElements)-1 {
-			summaryEntry := SummaryTableEntry{KeySize: indexEntry.KeySize, Key: indexEntry.Key,
-				Offset: offsetInIndexFile}
-			summaryEntries = append(summaryEntries, summaryEntry)
-
-			summaryHeader.EntriesSize += summaryEntry.GetSize()
+	records := make([]record.Record, 0)
+	for i := range entries {
+		blockRecords, err := readBlock(reader, tableSections.data.path, format, &entries[i])
+		if err != nil {
+			return nil, err
 		}
-		offsetInIndexFile += indexEntry.GetSize()
+		records = append(records, blockRecords...)
 	}
+	return records, nil
+}
 
-	// After EntriesSize in summaryHeader is calculated,
-	// summaryHeader and all summary entries are written
-	// to summary file.
-	summaryHeader.WriteHeaderToSummaryFile(summaryFileWriter)
-	for _, summaryEntry := range summaryEntries {
-		summaryEntry.WriteEntryToSummaryFile(summaryFileWriter)
+// DeleteSSTable deletes all files related to sstable based
+// on passed object SSTable
+func (sstable *SSTable) DeleteSSTable() error {
+	for _, filePath := range sstable.filePaths() {
+		err := os.Remove(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			return storageErrors.NewIO("remove", filePath, err)
+		}
 	}
-
-	dataFileWriter.Flush()
-	dataFile.Close()
-	indexFileWriter.Flush()
-	indexFile.Close()
-	summaryFileWriter.Flush()
-	summaryFile.Close()
+	return nil
 }
 
-// Function that forms bloom filter based on byte slice of records
-// and file path that is passed.
-func formFilter(recordElements []record.Record, filterFilePath string) {
-	filter := bloomFilter.CreateBloomFilter(len(recordElements), 0.01)
-	for _, recordElement := range recordElements {
-		filter.AddData(recordElement.Key)
+// Quarantine moves files of the sstable to the quarantine directory
+// inside of passed root directory, so that they are kept for inspection
+// while the sstable is no longer found in the store.
+func (sstable *SSTable) Quarantine(dir string) error {
+	quarantinePath := filepath.Join(dir, QuarantineDir)
+	err := os.MkdirAll(quarantinePath, 0777)
+	if err != nil {
+		return storageErrors.NewIO("mkdir", quarantinePath, err)
+	}
+	for _, filePath := range sstable.filePaths() {
+		err = os.Rename(filePath, filepath.Join(quarantinePath, filepath.Base(filePath)))
+		if err != nil && !os.IsNotExist(err) {
+			return storageErrors.NewIO("rename", filePath, err)
+		}
 	}
-	filter.EncodeBloomFilter(filterFilePath)
+	return nil
 }
 
-// Function that forms metadata based on byte slice of records
-// and file path that is passed.
-func formMetadata(recordElements []record.Record, metadataFilePath string) {
-	recordElementsBytes :=  make([][]byte, 0)
-	for _, recordElement := range recordElements {
-		recordElementBytes := recordElement.EncodeRecord()
-		recordElementsBytes = append(recordElementsBytes, recordElementBytes)
+// filePaths returns paths of all files that form the sstable.
+func (sstable *SSTable) filePaths() []string {
+	if sstable.FilePath != "" {
+		return []string{sstable.FilePath}
 	}
+	return []string{sstable.DataFilePath, sstable.IndexFilePath, sstable.SummaryFilePath,
+		sstable.FilterFilePath, sstable.MetadataFilePath, sstable.TOCFilePath}
+}
 
-	metadata := merkleTree.MerkleTree{}
-	metadata.Build(recordElementsBytes)
-	metadata.Serialize(metadataFilePath)
+// sync flushes all files of the sstable to disk.
+func (sstable *SSTable) sync() error {
+	for _, filePath := range sstable.filePaths() {
+		file, err := os.Open(filePath)
+		if err != nil {
+			return storageErrors.NewIO("open", filePath, err)
+		}
+		err = file.Sync()
+		file.Close()
+		if err != nil {
+			return storageErrors.NewIO("sync", filePath, err)
+		}
+	}
+	return nil
 }
 
+// tableWriter writes records to data writer in blocks compressed with codec of its options, an entry for every
+// block to index writer and, once it is finished, summary of every index interval of entries to summary writer.
+// Tables are written in prefix format, where every index entry that summary points to is a restart point.
+type tableWriter struct {
+	options           Options
+	dataWriter        io.Writer
+	indexWriter       io.Writer
+	summaryHeader     SummaryTableHeader
+	summaryEntries    []SummaryTableEntry
+	indexEntries      []IndexTableEntry
+	offsetInDataFile  uint64
+	offsetInIndexFile uint64
+	previousIndexKey  string
+	rawSize           uint64
+	numRecords        int
+	block             blockWriter
+}
 
-// Function that forms table of content based on file
-// paths passed to the function.
-func formTOC(dataFilePath, indexFilePath, summaryFilePath, filterFilePath, metadataFilePath, TOCFilePath string) {
-	tocFile, err := os.OpenFile(TOCFilePath, os.O_WRONLY|os.O_CREATE, 0777)
+func newTableWriter(options Options, dataWriter, indexWriter io.Writer) (*tableWriter, error) {
+	err := writeFormatHeader(indexWriter, formatPrefix)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	tocFileWriter := bufio.NewWriter(tocFile)
+	return &tableWriter{options: options, dataWriter: dataWriter, indexWriter: indexWriter,
+		summaryHeader: SummaryTableHeader{IndexInterval: uint64(options.indexInterval())},
+		offsetInIndexFile: formatHeaderSize, block: blockWriter{codec: options.Codec}}, nil
+}
 
-	err = binary.Write(tocFileWriter, binary.LittleEndian, []byte(dataFilePath + "\n"))
-	if err != nil {
-		return
+// add adds record to the current block, which is finished first if it is full.
+// Records must be added sorted, so the first key is min and the last one max.
+func (writer *tableWriter) add(rec *record.Record) error {
+	if writer.block.isFullBefore(rec) {
+		err := writer.finishBlock()
+		if err != nil {
+			return err
+		}
+	}
+	if writer.numRecords == 0 {
+		writer.summaryHeader.MinKey = rec.Key
 	}
+	writer.summaryHeader.MaxKey = rec.Key
+	writer.block.add(rec)
+	writer.numRecords++
+	return nil
+}
 
-	err = binary.Write(tocFileWriter, binary.LittleEndian, []byte(indexFilePath + "\n"))
+// finishBlock writes the block to data writer and its entry, which
+// holds the last key of the block, to index writer.
+func (writer *tableWriter) finishBlock() error {
+	lastKey := writer.block.lastKey
+	blockSize, blockRawSize, err := writer.block.finish(writer.dataWriter)
 	if err != nil {
-		return
+		return err
 	}
-
-	err = binary.Write(tocFileWriter, binary.LittleEndian, []byte(summaryFilePath + "\n"))
+	writer.rawSize += blockRawSize
+
+	indexEntry := IndexTableEntry{KeySize: uint64(len(lastKey)), Key: lastKey,
+		Offset: writer.offsetInDataFile, Size: blockSize}
+	writer.offsetInDataFile += blockSize
+
+	// Index interval represents distance between
+	// 2 index entries in index file that are written
+	// in summary file. Those entries are restart points.
+	if len(writer.indexEntries)%writer.options.indexInterval() == 0 {
+		summaryEntry := SummaryTableEntry{KeySize: indexEntry.KeySize, Key: indexEntry.Key,
+			Offset: writer.offsetInIndexFile}
+		writer.summaryEntries = append(writer.summaryEntries, summaryEntry)
+		writer.summaryHeader.EntriesSize += summaryEntry.getSize(formatPrefix)
+		writer.previousIndexKey = ""
+	}
+	encoded := indexEntry.appendEntry(nil, writer.previousIndexKey)
+	_, err = writer.indexWriter.Write(encoded)
 	if err != nil {
-		return
+		return err
+	}
+	writer.offsetInIndexFile += uint64(len(encoded))
+	writer.previousIndexKey = indexEntry.Key
+	writer.indexEntries = append(writer.indexEntries, indexEntry)
+	return nil
+}
+
+// finish finishes the last block and writes summary to summary writer.
+// It returns size of written data and its size before compression.
+func (writer *tableWriter) finish(summaryWriter io.Writer) (uint64, uint64, error) {
+	if !writer.block.isEmpty() {
+		err := writer.finishBlock()
+		if err != nil {
+			return 0, 0, err
+		}
 	}
 
-	err = binary.Write(tocFileWriter, binary.LittleEndian, []byte(filterFilePath + "\n"))
+	// After EntriesSize in summaryHeader is calculated,
+	// summaryHeader and all summary entries are written
+	// to summary file.
+	err := writeFormatHeader(summaryWriter, formatPrefix)
+	if err != nil {
+		return 0, 0, err
+	}
+	writer.summaryHeader.MinKeySize = uint64(len(writer.summaryHeader.MinKey))
+	writer.summaryHeader.MaxKeySize = uint64(len(writer.summaryHeader.MaxKey))
+	summary := writer.summaryHeader.appendHeader(nil)
+	for _, summaryEntry := range writer.summaryEntries {
+		summary = summaryEntry.appendEntry(summary)
+	}
+	_, err = summaryWriter.Write(summary)
 	if err != nil {
-		return
+		return 0, 0, err
 	}
+	return writer.offsetInDataFile, writer.rawSize, nil
+}
 
-	err = binary.Write(tocFileWriter, binary.LittleEndian, []byte(metadataFilePath + "\n"))
+// Function that forms table of content based on file
+// paths passed to the function.
+func formTOC(dataFilePath, indexFilePath, summaryFilePath, filterFilePath, metadataFilePath, TOCFilePath string) error {
+	tocFile, err := os.OpenFile(TOCFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0777)
 	if err != nil {
-		return
+		return storageErrors.NewIO("create", TOCFilePath, err)
+	}
+	defer tocFile.Close()
+	tocFileWriter := bufio.NewWriter(tocFile)
+
+	for _, filePath := range []string{dataFilePath, indexFilePath, summaryFilePath, filterFilePath, metadataFilePath} {
+		err = binary.Write(tocFileWriter, binary.LittleEndian, []byte(filePath + "\n"))
+		if err != nil {
+			return storageErrors.NewIO("write", TOCFilePath, err)
+		}
 	}
 
-	tocFileWriter.Flush()
-	tocFile.Close()
-}
\ No newline at end of file
+	return storageErrors.NewIO("write", TOCFilePath, tocFileWriter.Flush())
+}
+
+// unexpectedEOF turns io.EOF in the middle of an entry into io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
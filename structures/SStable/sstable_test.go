@@ -0,0 +1,232 @@
+package SStable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"napredni/structures/record"
+	"napredni/structures/storageErrors"
+)
+
+// testRecords returns passed number of records sorted by key,
+// with keys that share a long prefix.
+func testRecords(n int) []record.Record {
+	records := make([]record.Record, 0, n)
+	for i := 0; i < n; i++ {
+		rec := record.CreateRecord(fmt.Sprintf("tenant/123/user/%05d", i), []byte(fmt.Sprintf("value %d", i)), 0)
+		rec.SeqNum = uint64(i + 1)
+		records = append(records, *rec)
+	}
+	return records
+}
+
+// formTestTable forms an sstable from passed records on the first
+// level inside of a temporary root directory.
+func formTestTable(t *testing.T, records []record.Record, options Options) *SSTable {
+	t.Helper()
+	dir := t.TempDir()
+	err := FormDirectories(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sstable, err := FormSSTableForLevelAndIndex(records, dir, 1, 1, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sstable
+}
+
+// Lengths read from a damaged index or summary must be reported
+// as corruption instead of being allocated.
+func TestCorruptLengthsAreReported(t *testing.T) {
+	const huge = 1 << 40
+	entry := SummaryTableEntry{KeySize: 1, Key: "a"}
+	validHeader := SummaryTableHeader{MinKeySize: 1, MinKey: "a", MaxKeySize: 1, MaxKey: "z",
+		EntriesSize: entry.GetSize()}
+	for _, test := range []struct {
+		name    string
+		header  SummaryTableHeader
+		entries []SummaryTableEntry
+		index   []byte
+	}{
+		{"summary min key", SummaryTableHeader{MinKeySize: huge}, nil, nil},
+		{"summary max key", SummaryTableHeader{MinKeySize: 1, MinKey: "a", MaxKeySize: huge}, nil, nil},
+		{"summary entries", SummaryTableHeader{MinKeySize: 1, MinKey: "a", MaxKeySize: 1, MaxKey: "z",
+			EntriesSize: huge}, nil, nil},
+		{"summary entry key", validHeader, []SummaryTableEntry{{KeySize: huge}}, nil},
+		{"index key", validHeader, []SummaryTableEntry{entry}, binary.LittleEndian.AppendUint64(nil, huge)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sstable := formTestTable(t, testRecords(10), Options{})
+			summary := new(bytes.Buffer)
+			test.header.WriteHeaderToSummaryFile(summary)
+			for _, summaryEntry := range test.entries {
+				summaryEntry.WriteEntryToSummaryFile(summary)
+			}
+			summary.WriteString("rest of the file")
+			err := os.WriteFile(sstable.SummaryFilePath, summary.Bytes(), 0777)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(sstable.IndexFilePath, append(test.index, "rest of the file"...), 0777)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, err = sstable.GetRecordInSStableForKey("m")
+			if !errors.Is(err, storageErrors.ErrCorruption) {
+				t.Fatalf("get: got %v, want corruption", err)
+			}
+		})
+	}
+}
+
+// copyBaselineTable copies files of the sstable from data fixtures, which
+// was written before the format header was added, to a temporary root
+// directory and returns it.
+func copyBaselineTable(t *testing.T) SSTable {
+	t.Helper()
+	dir := t.TempDir()
+	err := FormDirectories(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture := GetSSTableForLevelAndIndex(filepath.Join("..", "..", "data"), 1, 1)
+	sstable := GetSSTableForLevelAndIndex(dir, 1, 1)
+	for i, filePath := range fixture.filePaths() {
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(sstable.filePaths()[i], data, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sstable
+}
+
+// Tables in baseline format have an index entry for every record without
+// its size, and their records use timestamps as sequence numbers.
+func TestBaselineTableIsRead(t *testing.T) {
+	sstable := copyBaselineTable(t)
+	for _, key := range []string{"pera1", "pera2", "pera3", "pera4"} {
+		rec, found, err := sstable.GetRecordInSStableForKey(key)
+		if err != nil || !found || string(rec.Value) != "peki123" {
+			t.Fatalf("get %s: got %q, %v, %v", key, rec.Value, found, err)
+		}
+		if rec.SeqNum != uint64(rec.Timestamp) {
+			t.Fatalf("get %s: sequence number %d, timestamp %d", key, rec.SeqNum, rec.Timestamp)
+		}
+		_, found, err = sstable.GetRecordInSStableForKeyAt(key, rec.SeqNum-1)
+		if err != nil || found {
+			t.Fatalf("get %s before it was written: %v, %v", key, found, err)
+		}
+	}
+	for _, key := range []string{"pera0", "pera11", "pera5"} {
+		_, found, err := sstable.GetRecordInSStableForKey(key)
+		if err != nil || found {
+			t.Fatalf("get %s: %v, %v", key, found, err)
+		}
+	}
+
+	it, err := sstable.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0)
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		keys = append(keys, it.Key())
+	}
+	it.Seek("pera25")
+	if !it.Valid() || it.Key() != "pera3" {
+		t.Fatalf("seek pera25: valid %v", it.Valid())
+	}
+	err = it.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(keys) != "[pera4 pera3 pera2 pera1]" {
+		t.Fatalf("keys from the last one: %v", keys)
+	}
+}
+
+// Crc of records in baseline format covers their value.
+func TestBaselineRecordCrcIsChecked(t *testing.T) {
+	sstable := copyBaselineTable(t)
+	data, err := os.ReadFile(sstable.DataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last byte of value of the second record.
+	data[2*41-1] ^= 0xff
+	err = os.WriteFile(sstable.DataFilePath, data, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = sstable.GetRecordInSStableForKey("pera2")
+	if !errors.Is(err, storageErrors.ErrCorruption) {
+		t.Fatalf("get: got %v, want corruption", err)
+	}
+	_, found, err := sstable.GetRecordInSStableForKey("pera1")
+	if err != nil || !found {
+		t.Fatalf("get pera1: %v, %v", found, err)
+	}
+}
+
+// Sstables in baseline format are formed as multiple files, and they are
+// opened by the lsm tree, the table cache and compaction like new ones.
+func TestBaselineTableIsOpenedLikeNewOnes(t *testing.T) {
+	sstable := copyBaselineTable(t)
+	err := sstable.ReadKeyRangeAndSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sstable.MinKey != "pera1" || sstable.MaxKey != "pera4" || sstable.Size != 4*41 {
+		t.Fatalf("key range %s-%s, size %d", sstable.MinKey, sstable.MaxKey, sstable.Size)
+	}
+
+	filter, err := sstable.ReadFilter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"pera1", "pera2", "pera3", "pera4"} {
+		if !filter.FindData(key) {
+			t.Fatalf("filter doesn't hold %s", key)
+		}
+	}
+
+	for _, mmap := range []bool{false, true} {
+		cache := NewTableCache(0, mmap)
+		rec, found, err := cache.GetRecordAt(&sstable, "pera3", record.MaxSeqNum)
+		if err != nil || !found || string(rec.Value) != "peki123" {
+			t.Fatalf("mmap %v: got %q, %v, %v", mmap, rec.Value, found, err)
+		}
+		err = cache.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions, err := sstable.NewVersionIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0)
+	for ; versions.Valid(); versions.Next() {
+		keys = append(keys, versions.Record().Key)
+	}
+	err = versions.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(keys) != "[pera1 pera2 pera3 pera4]" {
+		t.Fatalf("versions: %v", keys)
+	}
+}
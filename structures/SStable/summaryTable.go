@@ -6,16 +6,19 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"os"
+	"napredni/structures/storageErrors"
+	"sort"
 )
 
 // SummaryTableHeader contains min and max key from index file, and it's sizes.
+// IndexInterval is number of index entries for every summary entry.
 type SummaryTableHeader struct {
-	MinKeySize  uint64
-	MinKey      string
-	MaxKeySize  uint64
-	MaxKey      string
-	EntriesSize uint64
+	MinKeySize    uint64
+	MinKey        string
+	MaxKeySize    uint64
+	MaxKey        string
+	EntriesSize   uint64
+	IndexInterval uint64
 }
 
 // SummaryTableEntry contains key, key size, and it's offset in the index file.
@@ -32,6 +35,7 @@ func (summaryHeader *SummaryTableHeader) Print() {
 	fmt.Println("Max key size:", summaryHeader.MaxKeySize)
 	fmt.Println("Max key:", summaryHeader.MaxKey)
 	fmt.Println("Summary entries size:", summaryHeader.EntriesSize)
+	fmt.Println("Index interval:", summaryHeader.IndexInterval)
 }
 
 // Print prints a summary entry info to terminal.
@@ -41,198 +45,288 @@ func (summaryEntry *SummaryTableEntry) Print() {
 	fmt.Println("Offset:", summaryEntry.Offset)
 }
 
-// GetSize returns size in bytes of a single summary entry.
+// GetSize returns size in bytes of a single summary entry in baseline format.
 func (summaryEntry *SummaryTableEntry) GetSize() uint64 {
 	return 8 + summaryEntry.KeySize + 8
 }
 
-// WriteHeaderToSummaryFile writes a summary header to file.
-func (summaryHeader *SummaryTableHeader) WriteHeaderToSummaryFile(writer *bufio.Writer) {
+// getSize returns size in bytes of the entry in passed format.
+func (summaryEntry *SummaryTableEntry) getSize(format tableFormat) uint64 {
+	if format == formatBaseline {
+		return summaryEntry.GetSize()
+	}
+	return uint64(len(summaryEntry.appendEntry(nil)))
+}
+
+// appendHeader appends the header in prefix format.
+// Keys of summary are restart points of the index, so they are whole.
+func (summaryHeader *SummaryTableHeader) appendHeader(buffer []byte) []byte {
+	buffer = appendString(buffer, summaryHeader.MinKey)
+	buffer = appendString(buffer, summaryHeader.MaxKey)
+	buffer = binary.AppendUvarint(buffer, summaryHeader.EntriesSize)
+	return binary.AppendUvarint(buffer, summaryHeader.IndexInterval)
+}
+
+// readHeader reads a header in passed format. It returns true if reader is at the end.
+// Tables in baseline format have the default index interval.
+func (summaryHeader *SummaryTableHeader) readHeader(reader *bufio.Reader, format tableFormat) (bool, error) {
+	summaryHeader.IndexInterval = indexFileInterval
+	if format == formatBaseline {
+		return summaryHeader.ReadHeaderFromSummaryFile(reader)
+	}
+	minKey, err := readBytes(reader)
+	if err != nil {
+		if err == io.EOF {
+			return true, nil
+		}
+		return false, err
+	}
+	summaryHeader.MinKey = string(minKey)
+	summaryHeader.MinKeySize = uint64(len(minKey))
+
+	maxKey, err := readBytes(reader)
+	if err != nil {
+		return false, unexpectedEOF(err)
+	}
+	summaryHeader.MaxKey = string(maxKey)
+	summaryHeader.MaxKeySize = uint64(len(maxKey))
+
+	summaryHeader.EntriesSize, err = binary.ReadUvarint(reader)
+	if err != nil {
+		return false, unexpectedEOF(err)
+	}
+	summaryHeader.IndexInterval, err = binary.ReadUvarint(reader)
+	return false, unexpectedEOF(err)
+}
+
+// appendEntry appends the entry in prefix format.
+func (summaryEntry *SummaryTableEntry) appendEntry(buffer []byte) []byte {
+	buffer = appendString(buffer, summaryEntry.Key)
+	return binary.AppendUvarint(buffer, summaryEntry.Offset)
+}
+
+// readEntry reads an entry in passed format. It returns true if reader is at the end.
+func (summaryEntry *SummaryTableEntry) readEntry(reader *bufio.Reader, format tableFormat) (bool, error) {
+	if format == formatBaseline {
+		return summaryEntry.ReadEntryFromSummaryFile(reader)
+	}
+	key, err := readBytes(reader)
+	if err != nil {
+		if err == io.EOF {
+			return true, nil
+		}
+		return false, err
+	}
+	summaryEntry.Key = string(key)
+	summaryEntry.KeySize = uint64(len(key))
+
+	summaryEntry.Offset, err = binary.ReadUvarint(reader)
+	return false, unexpectedEOF(err)
+}
+
+// WriteHeaderToSummaryFile writes a summary header to file in baseline format.
+func (summaryHeader *SummaryTableHeader) WriteHeaderToSummaryFile(writer io.Writer) error {
 	err := binary.Write(writer, binary.LittleEndian, summaryHeader.MinKeySize)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	err = binary.Write(writer, binary.LittleEndian, []byte(summaryHeader.MinKey))
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	err = binary.Write(writer, binary.LittleEndian, summaryHeader.MaxKeySize)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	err = binary.Write(writer, binary.LittleEndian, []byte(summaryHeader.MaxKey))
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	err = binary.Write(writer, binary.LittleEndian, summaryHeader.EntriesSize)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	return nil
 }
 
-// ReadHeaderFromSummaryFile reads a header from file.
-func (summaryHeader *SummaryTableHeader) ReadHeaderFromSummaryFile(reader *bufio.Reader) bool {
+// ReadHeaderFromSummaryFile reads a header in baseline format from file.
+// It returns true if reader is at the end.
+func (summaryHeader *SummaryTableHeader) ReadHeaderFromSummaryFile(reader *bufio.Reader) (bool, error) {
 	err := binary.Read(reader, binary.LittleEndian, &summaryHeader.MinKeySize)
 	if err != nil {
 		if err == io.EOF {
-			return true
+			return true, nil
 		}
-		panic(err)
+		return false, err
 	}
 
-	minKeyByteSlice := make([]byte, summaryHeader.MinKeySize)
-	err = binary.Read(reader, binary.LittleEndian, &minKeyByteSlice)
+	minKeyByteSlice, err := readSizedBytes(reader, summaryHeader.MinKeySize)
 	if err != nil {
-		if err == io.EOF {
-			return true
-		}
-		panic(err)
+		return false, err
 	}
 	summaryHeader.MinKey = string(minKeyByteSlice)
 
 	err = binary.Read(reader, binary.LittleEndian, &summaryHeader.MaxKeySize)
 	if err != nil {
-		if err == io.EOF {
-			return true
-		}
-		panic(err)
+		return false, unexpectedEOF(err)
 	}
 
-	maxKeyByteSlice := make([]byte, summaryHeader.MaxKeySize)
-	err = binary.Read(reader, binary.LittleEndian, &maxKeyByteSlice)
+	maxKeyByteSlice, err := readSizedBytes(reader, summaryHeader.MaxKeySize)
 	if err != nil {
-		if err == io.EOF {
-			return true
-		}
-		panic(err)
+		return false, err
 	}
 	summaryHeader.MaxKey = string(maxKeyByteSlice)
 
 	err = binary.Read(reader, binary.LittleEndian, &summaryHeader.EntriesSize)
 	if err != nil {
-		if err == io.EOF {
-			return true
-		}
-		panic(err)
+		return false, unexpectedEOF(err)
 	}
 
-	return false
+	return false, nil
 }
 
-// WriteEntryToSummaryFile writes a summary entry to file.
-func (summaryEntry *SummaryTableEntry) WriteEntryToSummaryFile(writer *bufio.Writer) {
+// WriteEntryToSummaryFile writes a summary entry to file in baseline format.
+func (summaryEntry *SummaryTableEntry) WriteEntryToSummaryFile(writer io.Writer) error {
 	err := binary.Write(writer, binary.LittleEndian, summaryEntry.KeySize)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	err = binary.Write(writer, binary.LittleEndian, []byte(summaryEntry.Key))
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	err = binary.Write(writer, binary.LittleEndian, summaryEntry.Offset)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	return nil
 }
 
-// ReadEntryFromSummaryFile reads an entry from file.
-func (summaryEntry *SummaryTableEntry) ReadEntryFromSummaryFile(reader *bufio.Reader) bool {
+// ReadEntryFromSummaryFile reads an entry in baseline format from file.
+// It returns true if reader is at the end.
+func (summaryEntry *SummaryTableEntry) ReadEntryFromSummaryFile(reader *bufio.Reader) (bool, error) {
 	err := binary.Read(reader, binary.LittleEndian, &summaryEntry.KeySize)
 	if err != nil {
 		if err == io.EOF {
-			return true
+			return true, nil
 		}
-		panic(err)
+		return false, err
 	}
 
-	keyByteSlice := make([]byte, summaryEntry.KeySize)
-	err = binary.Read(reader, binary.LittleEndian, &keyByteSlice)
+	keyByteSlice, err := readSizedBytes(reader, summaryEntry.KeySize)
 	if err != nil {
-		if err == io.EOF {
-			return true
-		}
-		panic(err)
+		return false, err
 	}
 	summaryEntry.Key = string(keyByteSlice)
 
 	err = binary.Read(reader, binary.LittleEndian, &summaryEntry.Offset)
 	if err != nil {
-		if err == io.EOF {
-			return true
-		}
-		panic(err)
+		return false, unexpectedEOF(err)
 	}
 
-	return false
+	return false, nil
 }
 
-// GetOffsetInIndexTableForKey returns offset for index table for passed key and
-// bool value that is true if offset is found, otherwise false.
-func getOffsetInIndexTableForKey(key string, filePath string) (uint64, bool) {
-	file, err := os.Open(filePath)
+// tableSummary is the whole summary of an sstable together with format of
+// the table. It is loaded once and kept in the table cache.
+type tableSummary struct {
+	format  tableFormat
+	header  SummaryTableHeader
+	entries []SummaryTableEntry
+}
+
+// loadSummary reads the header and all entries of summary section.
+func loadSummary(files openFiles, summary section) (*tableSummary, error) {
+	sectionReader, err := files.reader(summary)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer file.Close()
-	reader := bufio.NewReader(file)
-
-	summaryHeader := SummaryTableHeader{}
-	eof := summaryHeader.ReadHeaderFromSummaryFile(reader)
-	if eof {
-		return 0, false
+	reader := bufio.NewReader(sectionReader)
+	format, err := readFormatHeader(reader)
+	if err != nil {
+		return nil, storageErrors.NewCorruption(summary.path, summary.offset, err.Error())
 	}
 
-	if summaryHeader.MinKey > key {
-		return 0, false
+	loaded := &tableSummary{format: format}
+	eof, err := loaded.header.readHeader(reader, format)
+	if err == nil && eof {
+		err = io.ErrUnexpectedEOF
 	}
-
-	if summaryHeader.MaxKey < key {
-		return 0, false
+	if err != nil {
+		return nil, storageErrors.NewCorruption(summary.path, summary.offset, err.Error())
 	}
 
-	buf := make([]byte, summaryHeader.EntriesSize)
-	_, err = io.ReadFull(reader, buf)
+	buf, err := readSizedBytes(reader, loaded.header.EntriesSize)
 	if err != nil {
-		panic(err)
+		return nil, storageErrors.NewCorruption(summary.path, summary.offset, err.Error())
 	}
-
 	reader = bufio.NewReader(bytes.NewBuffer(buf))
-	prevSummaryEntry := SummaryTableEntry{}
-	nextSummaryEntry := SummaryTableEntry{}
-
 	for {
-		prevSummaryEntry = nextSummaryEntry
-		eof = nextSummaryEntry.ReadEntryFromSummaryFile(reader)
-		if eof {
-			return prevSummaryEntry.Offset, true
+		summaryEntry := SummaryTableEntry{}
+		eof, err = summaryEntry.readEntry(reader, format)
+		if err != nil {
+			return nil, storageErrors.NewCorruption(summary.path, summary.offset, err.Error())
 		}
-
-		if prevSummaryEntry.Key <= key && key < nextSummaryEntry.Key {
-			break
+		if eof {
+			return loaded, nil
 		}
+		loaded.entries = append(loaded.entries, summaryEntry)
 	}
+}
 
-	return prevSummaryEntry.Offset, true
+// getOffsetInIndexTableForKey returns offset in index table from which index
+// entry for passed key is searched and bool value that is true if the key is
+// inside of key range of the table, otherwise false. Summary entries hold
+// keys of index entries, so binary search finds the first summary entry whose
+// key is not less than passed key, and the search starts from the one before.
+func (summary *tableSummary) getOffsetInIndexTableForKey(key string) (uint64, bool) {
+	if summary.header.MinKey > key || summary.header.MaxKey < key {
+		return 0, false
+	}
+	position := sort.Search(len(summary.entries), func(i int) bool {
+		return summary.entries[i].Key >= key
+	})
+	if position > 0 {
+		return summary.entries[position-1].Offset, true
+	}
+	// Index entries start after the format header.
+	if summary.format != formatBaseline {
+		return formatHeaderSize, true
+	}
+	return 0, true
 }
 
-func (sstable *SSTable) PrintSummaryFile() {
-	file, err := os.Open(sstable.SummaryFilePath)
-	if err!= nil {
-		panic(err)
+func (sstable *SSTable) PrintSummaryFile() error {
+	files := openFiles{}
+	defer files.close()
+	tableSections, err := sstable.sections(files)
+	if err != nil {
+		return err
+	}
+	sectionReader, err := files.reader(tableSections.summary)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(sectionReader)
+	summary := tableSections.summary
+	format, err := readFormatHeader(reader)
+	if err != nil {
+		return storageErrors.NewCorruption(summary.path, summary.offset, err.Error())
 	}
-	defer file.Close()
-	reader := bufio.NewReader(file)
 
 	summaryHeader := SummaryTableHeader{}
-	eof := summaryHeader.ReadHeaderFromSummaryFile(reader)
+	eof, err := summaryHeader.readHeader(reader, format)
+	if err != nil {
+		return storageErrors.NewCorruption(summary.path, summary.offset, err.Error())
+	}
 	if eof {
-		return
+		return nil
 	}
 
 	fmt.Println("****************************Header****************************")
@@ -243,9 +337,12 @@ func (sstable *SSTable) PrintSummaryFile() {
 	i := 1
 	summaryEntry := SummaryTableEntry{}
 	for {
-		eof := summaryEntry.ReadEntryFromSummaryFile(reader)
+		eof, err := summaryEntry.readEntry(reader, format)
+		if err != nil {
+			return storageErrors.NewCorruption(summary.path, summary.offset, err.Error())
+		}
 		if eof {
-			return
+			return nil
 		}
 
 		fmt.Println("Entry", i)
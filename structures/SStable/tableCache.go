@@ -0,0 +1,260 @@
+package SStable
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"napredni/structures/bloomFilter"
+	"napredni/structures/record"
+	"napredni/structures/storageErrors"
+	"sync"
+)
+
+// TableCache keeps sstables open for lookups, together with their decoded
+// bloom filters and summaries, so that a lookup reads only an index entry
+// and a data block. Number of files that the cache keeps open is bounded,
+// and the least recently used sstable is closed when it is exceeded.
+// Sstables are also evicted when compaction deletes them.
+type TableCache struct {
+	mutex sync.Mutex
+	// maxOpenFiles is the bound on open files,
+	// which is not applied if it isn't positive.
+	maxOpenFiles int
+	// mmap is true if data of sstables is mapped into memory.
+	mmap      bool
+	openFiles int
+	tables    map[string]*cachedTable
+	// lru holds paths of sstables from the most recently used one.
+	lru list.List
+}
+
+// cachedTable holds what a lookup in an sstable needs before it reads
+// the index. Sections, summary and filter don't change once it is
+// loaded, and files are closed once the table is evicted and the last
+// lookup that uses it is done.
+type cachedTable struct {
+	sections sections
+	summary  *tableSummary
+	filter   *bloomFilter.BloomFilter
+	files    openFiles
+	// data reads mapped data of the sstable,
+	// and it is nil if data isn't mapped.
+	data    io.ReaderAt
+	mapped  []byte
+	element *list.Element
+	refs    int
+	evicted bool
+}
+
+// NewTableCache returns cache that keeps at most maxOpenFiles files open, or
+// any number of them if maxOpenFiles isn't positive. Data of sstables is
+// mapped into memory if mmap is true.
+func NewTableCache(maxOpenFiles int, mmap bool) *TableCache {
+	return &TableCache{maxOpenFiles: maxOpenFiles, mmap: mmap, tables: make(map[string]*cachedTable)}
+}
+
+// GetRecordAt works like GetRecordInSStableForKeyAt, but opens the sstable
+// only on the first lookup, and it doesn't read data of the sstable if its
+// bloom filter doesn't hold the key.
+func (cache *TableCache) GetRecordAt(sstable *SSTable, key string, seqNum uint64) (*record.Record, bool, error) {
+	table, err := cache.acquire(sstable)
+	if err != nil {
+		return &record.Record{}, false, err
+	}
+	defer cache.release(table)
+	if !table.filter.FindData(key) {
+		return &record.Record{}, false, nil
+	}
+	return table.getRecord(table.files, key, seqNum)
+}
+
+// MayContain returns false if passed sstable doesn't hold the key,
+// which is decided by its key range and bloom filter.
+func (cache *TableCache) MayContain(sstable *SSTable, key string) (bool, error) {
+	if key < sstable.MinKey || key > sstable.MaxKey {
+		return false, nil
+	}
+	table, err := cache.acquire(sstable)
+	if err != nil {
+		return false, err
+	}
+	defer cache.release(table)
+	return table.filter.FindData(key), nil
+}
+
+// Evict removes passed sstable from the cache. It is called once no
+// lookup uses the sstable, so that a lookup doesn't add it again.
+func (cache *TableCache) Evict(sstable *SSTable) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	table, found := cache.tables[sstable.Path()]
+	if !found {
+		return nil
+	}
+	return cache.remove(sstable.Path(), table)
+}
+
+// Close evicts all sstables from the cache.
+func (cache *TableCache) Close() error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	var err error
+	for path, table := range cache.tables {
+		removeErr := cache.remove(path, table)
+		if err == nil {
+			err = removeErr
+		}
+	}
+	return err
+}
+
+// acquire returns passed sstable from the cache, which is opened if it isn't
+// in the cache. Sstable is opened without the lock, so concurrent lookups can
+// open it more than once, and only one of them adds it to the cache.
+func (cache *TableCache) acquire(sstable *SSTable) (*cachedTable, error) {
+	path := sstable.Path()
+	cache.mutex.Lock()
+	table, found := cache.tables[path]
+	if found {
+		table.refs++
+		cache.lru.MoveToFront(table.element)
+		cache.mutex.Unlock()
+		return table, nil
+	}
+	cache.mutex.Unlock()
+
+	opened, err := cache.open(sstable)
+	if err != nil {
+		return nil, err
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	table, found = cache.tables[path]
+	if found {
+		opened.close()
+		table.refs++
+		cache.lru.MoveToFront(table.element)
+		return table, nil
+	}
+	opened.refs = 1
+	opened.element = cache.lru.PushFront(path)
+	cache.tables[path] = opened
+	cache.openFiles += len(opened.files)
+	for cache.maxOpenFiles > 0 && cache.openFiles > cache.maxOpenFiles && cache.lru.Len() > 1 {
+		lastPath := cache.lru.Back().Value.(string)
+		err = cache.remove(lastPath, cache.tables[lastPath])
+		if err != nil {
+			opened.refs--
+			return nil, err
+		}
+	}
+	return opened, nil
+}
+
+// release ends a lookup that uses passed table, and closes
+// files of the table if it was evicted in the meantime.
+func (cache *TableCache) release(table *cachedTable) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	table.refs--
+	if table.evicted && table.refs == 0 {
+		table.close()
+	}
+}
+
+// remove removes table on passed path from the cache and closes its
+// files, unless a lookup still uses it. It is called under the lock.
+func (cache *TableCache) remove(path string, table *cachedTable) error {
+	delete(cache.tables, path)
+	cache.lru.Remove(table.element)
+	cache.openFiles -= len(table.files)
+	table.evicted = true
+	if table.refs > 0 {
+		return nil
+	}
+	return table.close()
+}
+
+// open opens files of passed sstable and reads its sections,
+// summary and bloom filter.
+func (cache *TableCache) open(sstable *SSTable) (*cachedTable, error) {
+	files := openFiles{}
+	table, err := sstable.loadTable(files)
+	if err == nil {
+		table.filter, err = readFilter(files, table.sections.filter)
+	}
+	// Only files that lookups read are kept open, and they are
+	// opened now, since lookups share them and don't change files.
+	if err == nil {
+		_, err = files.open(table.sections.index.path)
+	}
+	if err == nil {
+		_, err = files.open(table.sections.data.path)
+	}
+	for path, file := range files {
+		if err == nil && path != table.sections.index.path && path != table.sections.data.path {
+			err = storageErrors.NewIO("close", path, file.Close())
+			delete(files, path)
+		}
+	}
+	if err == nil && cache.mmap {
+		err = table.mapData()
+	}
+	if err != nil {
+		files.close()
+		return nil, err
+	}
+	return table, nil
+}
+
+// loadTable reads sections and summary of the sstable through passed files.
+func (sstable *SSTable) loadTable(files openFiles) (*cachedTable, error) {
+	tableSections, err := sstable.sections(files)
+	if err != nil {
+		return nil, err
+	}
+	summary, err := loadSummary(files, tableSections.summary)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedTable{sections: tableSections, summary: summary, files: files}, nil
+}
+
+// mapData maps the file that holds data of the table into memory.
+func (table *cachedTable) mapData() error {
+	data := table.sections.data
+	file := table.files[data.path]
+	info, err := file.Stat()
+	if err != nil {
+		return storageErrors.NewIO("stat", data.path, err)
+	}
+	if info.Size() == 0 {
+		return nil
+	}
+	mapped, err := mapFile(file, info.Size())
+	if err != nil {
+		return storageErrors.NewIO("mmap", data.path, err)
+	}
+	end := data.offset + data.size
+	if end > info.Size() || end < data.offset {
+		end = info.Size()
+	}
+	table.mapped = mapped
+	table.data = bytes.NewReader(mapped[data.offset:end])
+	return nil
+}
+
+// close unmaps data of the table and closes its files.
+func (table *cachedTable) close() error {
+	var err error
+	if table.mapped != nil {
+		err = storageErrors.NewIO("munmap", table.sections.data.path, unmapFile(table.mapped))
+		table.mapped = nil
+		table.data = nil
+	}
+	closeErr := table.files.close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
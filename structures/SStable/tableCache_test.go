@@ -0,0 +1,100 @@
+package SStable
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+// expectCachedRecord looks passed record up through the cache.
+func expectCachedRecord(t *testing.T, cache *TableCache, sstable *SSTable, key, value string) {
+	t.Helper()
+	rec, found, err := cache.GetRecordAt(sstable, key, ^uint64(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || string(rec.Value) != value {
+		t.Fatalf("get %q: found %v, value %q, want %q", key, found, rec.Value, value)
+	}
+}
+
+// expectClosed fails if any file of passed table is still open.
+func expectClosed(t *testing.T, table *cachedTable) {
+	t.Helper()
+	for path, file := range table.files {
+		_, err := file.Stat()
+		if !errors.Is(err, os.ErrClosed) {
+			t.Fatalf("%s is not closed: %v", path, err)
+		}
+	}
+}
+
+// Cache closes the least recently used table once it keeps more than
+// the maximum number of files open, and opens it again when it is used.
+func TestTableCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	records := testRecords(100)
+	tables := make([]*SSTable, 3)
+	for i := range tables {
+		tables[i] = formTestTable(t, records, Options{})
+	}
+	// Table in separate files keeps its index and data file open.
+	cache := NewTableCache(4, false)
+	defer cache.Close()
+
+	expectCachedRecord(t, cache, tables[0], "tenant/123/user/00001", "value 1")
+	expectCachedRecord(t, cache, tables[1], "tenant/123/user/00002", "value 2")
+	expectCachedRecord(t, cache, tables[0], "tenant/123/user/00003", "value 3")
+	evicted := cache.tables[tables[1].Path()]
+	expectCachedRecord(t, cache, tables[2], "tenant/123/user/00004", "value 4")
+
+	if cache.openFiles != 4 || len(cache.tables) != 2 {
+		t.Fatalf("%d files of %d tables are open", cache.openFiles, len(cache.tables))
+	}
+	if _, found := cache.tables[tables[1].Path()]; found {
+		t.Fatal("the least recently used table is still cached")
+	}
+	expectClosed(t, evicted)
+
+	expectCachedRecord(t, cache, tables[1], "tenant/123/user/00005", "value 5")
+	if _, found := cache.tables[tables[0].Path()]; found {
+		t.Fatal("table used before the last two is still cached")
+	}
+}
+
+// Table that is evicted while a lookup uses it is closed once the lookup
+// is done, and a table that compaction deletes leaves the cache.
+func TestTableCacheEvictsCompactedTables(t *testing.T) {
+	records := testRecords(100)
+	sstable := formTestTable(t, records, Options{})
+	cache := NewTableCache(0, false)
+	defer cache.Close()
+
+	table, err := cache.acquire(sstable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cache.Evict(sstable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.tables) != 0 || cache.openFiles != 0 {
+		t.Fatalf("%d files of %d tables are open", cache.openFiles, len(cache.tables))
+	}
+	for path, file := range table.files {
+		_, err = file.Stat()
+		if err != nil {
+			t.Fatalf("%s is closed while it is used: %v", path, err)
+		}
+	}
+	cache.release(table)
+	expectClosed(t, table)
+
+	err = sstable.DeleteSSTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = cache.GetRecordAt(sstable, "tenant/123/user/00001", ^uint64(0))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("lookup in deleted table: %v", err)
+	}
+}
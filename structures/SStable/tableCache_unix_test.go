@@ -0,0 +1,34 @@
+//go:build unix
+
+package SStable
+
+import "testing"
+
+// With mmap, data of cached tables is read from the mapping, including
+// data of single-file tables, which starts after the file header.
+func TestTableCacheMapsData(t *testing.T) {
+	records := testRecords(1000)
+	for _, options := range []Options{{}, {SingleFile: true}, {SingleFile: true, Codec: CodecFlate}} {
+		sstable := formTestTable(t, records, options)
+		cache := NewTableCache(0, true)
+		for _, i := range []int{0, 17, 500, 999} {
+			expectCachedRecord(t, cache, sstable, records[i].Key, string(records[i].Value))
+		}
+		_, found, err := cache.GetRecordAt(sstable, "tenant/123/user/01000", ^uint64(0))
+		if err != nil || found {
+			t.Fatalf("missing key: found %v, err %v", found, err)
+		}
+		table := cache.tables[sstable.Path()]
+		if table.mapped == nil || table.data == nil {
+			t.Fatalf("options %+v: data is not mapped", options)
+		}
+		err = cache.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if table.mapped != nil {
+			t.Fatalf("options %+v: data is not unmapped", options)
+		}
+		expectClosed(t, table)
+	}
+}
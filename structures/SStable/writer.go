@@ -0,0 +1,263 @@
+package SStable
+
+import (
+	"bufio"
+	"bytes"
+	"napredni/structures/bloomFilter"
+	"napredni/structures/merkleTree"
+	"napredni/structures/record"
+	"napredni/structures/storageErrors"
+	"os"
+)
+
+// Writer forms an sstable from records that are added one by one, sorted
+// by key and with versions of a key from the newest one, so that records
+// of the sstable don't have to be in memory at once. Only the current data
+// block, the index and hashes of records for Merkle metadata are kept.
+// Bloom filter is sized by number of records, so it is built from data
+// blocks that are read back once all of them are written.
+type Writer struct {
+	sstable SSTable
+	options Options
+	// file holds data of the sstable, which is either its data
+	// file or its single file under a temporary name.
+	file       *os.File
+	dataPath   string
+	dataWriter *bufio.Writer
+	index      bytes.Buffer
+	table      *tableWriter
+	leaves     []*merkleTree.Node
+	size       uint64
+}
+
+// NewWriter returns writer of sstable with passed paths of its files.
+func NewWriter(options Options, dataFilePath, indexFilePath, summaryFilePath, filterFilePath, metadataFilePath,
+	tocFilePath string) (*Writer, error) {
+	sstable := SSTable{DataFilePath: dataFilePath, IndexFilePath: indexFilePath, SummaryFilePath: summaryFilePath,
+		FilterFilePath: filterFilePath, MetadataFilePath: metadataFilePath, TOCFilePath: tocFilePath}
+	return newWriter(sstable, options, dataFilePath)
+}
+
+// NewSingleFileWriter returns writer of sstable that is formed as a single
+// file on passed path. File is written under a temporary name and renamed
+// once it is complete, so it appears at once.
+func NewSingleFileWriter(options Options, filePath string) (*Writer, error) {
+	return newWriter(SSTable{FilePath: filePath}, options, filePath+tmpSuffix)
+}
+
+// NewWriterForLevelAndIndex returns writer of sstable inside of passed
+// root directory with passed level and index, as passed options decide.
+func NewWriterForLevelAndIndex(dir string, level int, index int, options Options) (*Writer, error) {
+	if options.SingleFile {
+		return NewSingleFileWriter(options, FormSingleFilePathForSSTable(dir, level, index))
+	}
+	filePaths := FormFilePathsForSSTable(dir, level, index)
+	return NewWriter(options, filePaths[0], filePaths[1], filePaths[2], filePaths[3], filePaths[4], filePaths[5])
+}
+
+func newWriter(sstable SSTable, options Options, dataPath string) (*Writer, error) {
+	file, err := os.OpenFile(dataPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0777)
+	if err != nil {
+		return nil, storageErrors.NewIO("create", dataPath, err)
+	}
+	writer := &Writer{sstable: sstable, options: options, file: file, dataPath: dataPath,
+		dataWriter: bufio.NewWriter(file)}
+	writer.table, err = newTableWriter(options, writer.dataWriter, &writer.index)
+	if err != nil {
+		writer.Abort()
+		return nil, err
+	}
+	return writer, nil
+}
+
+// Add writes passed record to the sstable.
+func (writer *Writer) Add(rec *record.Record) error {
+	err := writer.table.add(rec)
+	if err != nil {
+		return storageErrors.NewIO("write", writer.dataPath, err)
+	}
+	leaf := merkleTree.FormLeaf(rec.EncodeRecord())
+	writer.leaves = append(writer.leaves, &leaf)
+	writer.size += rec.GetSize()
+	return nil
+}
+
+// Size returns size of records that were added to the sstable.
+func (writer *Writer) Size() uint64 {
+	return writer.size
+}
+
+// Empty returns true if no record was added to the sstable.
+func (writer *Writer) Empty() bool {
+	return writer.table.numRecords == 0
+}
+
+// Finish writes the rest of the sstable and returns it. Files of the
+// sstable are on disk once it returns, and they are deleted if it fails.
+// At least one record must be added before.
+func (writer *Writer) Finish() (*SSTable, error) {
+	sstable, err := writer.finish()
+	if err != nil {
+		writer.Abort()
+		return nil, err
+	}
+	return sstable, nil
+}
+
+func (writer *Writer) finish() (*SSTable, error) {
+	summary := new(bytes.Buffer)
+	dataSize, rawSize, err := writer.table.finish(summary)
+	if err == nil {
+		err = writer.dataWriter.Flush()
+	}
+	if err != nil {
+		return nil, storageErrors.NewIO("write", writer.dataPath, err)
+	}
+	filter, err := writer.buildFilter()
+	if err != nil {
+		return nil, err
+	}
+	metadata := &merkleTree.MerkleTree{}
+	metadata.BuildTree(writer.leaves)
+
+	sstable := writer.sstable
+	sstable.MinKey = writer.table.summaryHeader.MinKey
+	sstable.MaxKey = writer.table.summaryHeader.MaxKey
+	sstable.Size = dataSize
+	sstable.Codec = writer.options.Codec
+	sstable.RawSize = rawSize
+	if sstable.FilePath != "" {
+		err = writer.finishSingleFile(dataSize, summary, filter, metadata)
+	} else {
+		err = writer.finishFiles(summary, filter, metadata)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sstable, nil
+}
+
+// buildFilter returns bloom filter with keys of all records, which
+// are read from data blocks that are already written.
+func (writer *Writer) buildFilter() (*bloomFilter.BloomFilter, error) {
+	filter := bloomFilter.CreateBloomFilter(writer.table.numRecords, 0.01)
+	for i := range writer.table.indexEntries {
+		records, err := readBlock(writer.file, writer.dataPath, formatPrefix, &writer.table.indexEntries[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, blockRecord := range records {
+			filter.AddData(blockRecord.Key)
+		}
+	}
+	return filter, nil
+}
+
+// finishFiles writes index, summary, filter, metadata and table of
+// contents to their files and syncs all files of the sstable.
+func (writer *Writer) finishFiles(summary *bytes.Buffer, filter *bloomFilter.BloomFilter,
+	metadata *merkleTree.MerkleTree) error {
+	sstable := &writer.sstable
+	err := writer.file.Close()
+	writer.file = nil
+	if err != nil {
+		return storageErrors.NewIO("write", sstable.DataFilePath, err)
+	}
+	err = os.WriteFile(sstable.IndexFilePath, writer.index.Bytes(), 0777)
+	if err != nil {
+		return storageErrors.NewIO("write", sstable.IndexFilePath, err)
+	}
+	err = os.WriteFile(sstable.SummaryFilePath, summary.Bytes(), 0777)
+	if err != nil {
+		return storageErrors.NewIO("write", sstable.SummaryFilePath, err)
+	}
+	err = filter.EncodeBloomFilter(sstable.FilterFilePath)
+	if err != nil {
+		return err
+	}
+	err = metadata.Serialize(sstable.MetadataFilePath)
+	if err != nil {
+		return err
+	}
+	err = formTOC(sstable.DataFilePath, sstable.IndexFilePath, sstable.SummaryFilePath, sstable.FilterFilePath,
+		sstable.MetadataFilePath, sstable.TOCFilePath)
+	if err != nil {
+		return err
+	}
+	// Files must be on disk before the sstable is
+	// recorded in the manifest of the lsm tree.
+	return sstable.sync()
+}
+
+// finishSingleFile writes index, summary, filter and metadata sections
+// after data, followed by the footer, and renames the complete file.
+func (writer *Writer) finishSingleFile(dataSize uint64, summary *bytes.Buffer, filter *bloomFilter.BloomFilter,
+	metadata *merkleTree.MerkleTree) error {
+	filterBuffer := new(bytes.Buffer)
+	err := filter.Encode(filterBuffer)
+	if err != nil {
+		return storageErrors.NewIO("write", writer.dataPath, err)
+	}
+	metadataBuffer := new(bytes.Buffer)
+	err = metadata.SerializeTo(metadataBuffer)
+	if err != nil {
+		return storageErrors.NewIO("write", writer.dataPath, err)
+	}
+
+	tableSections := sections{data: section{size: int64(dataSize)}}
+	offset := int64(dataSize)
+	for i, buffer := range []*bytes.Buffer{&writer.index, summary, filterBuffer, metadataBuffer} {
+		tableSection := tableSections.pointers()[i+1]
+		*tableSection = section{offset: offset, size: int64(buffer.Len())}
+		offset += tableSection.size
+		_, err = writer.dataWriter.Write(buffer.Bytes())
+		if err != nil {
+			return storageErrors.NewIO("write", writer.dataPath, err)
+		}
+	}
+	_, err = writer.dataWriter.Write(encodeFooter(tableSections))
+	if err == nil {
+		err = writer.dataWriter.Flush()
+	}
+	if err == nil {
+		err = writer.file.Sync()
+	}
+	closeErr := writer.file.Close()
+	writer.file = nil
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return storageErrors.NewIO("write", writer.dataPath, err)
+	}
+	err = os.Rename(writer.dataPath, writer.sstable.FilePath)
+	if err != nil {
+		return storageErrors.NewIO("rename", writer.dataPath, err)
+	}
+	return nil
+}
+
+// Abort closes the writer and deletes files of the sstable.
+func (writer *Writer) Abort() {
+	if writer.file != nil {
+		writer.file.Close()
+		writer.file = nil
+	}
+	if writer.sstable.FilePath != "" {
+		os.Remove(writer.dataPath)
+		return
+	}
+	writer.sstable.DeleteSSTable()
+}
+
+// writeAll adds passed records to the sstable and finishes it.
+func (writer *Writer) writeAll(recordElements []record.Record) (*SSTable, error) {
+	for i := range recordElements {
+		err := writer.Add(&recordElements[i])
+		if err != nil {
+			writer.Abort()
+			return nil, err
+		}
+	}
+	return writer.Finish()
+}
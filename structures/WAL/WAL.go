@@ -1,49 +1,135 @@
 package WAL
 
 import (
-	"bufio"
-	"github.com/edsrzf/mmap-go"
+	"encoding/binary"
+	"errors"
 	"hash/crc32"
 	"io/ioutil"
-	"log"
 	"napredni/structures/record"
+	"napredni/structures/storageErrors"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// seqNumFileName is name of the file inside of wal directory that keeps
+// the last used sequence number while there are no segments holding it.
+const seqNumFileName = "sequence"
+
+// Every segment starts with a header that holds magic number and format
+// of its records. Segments written before the header was added don't
+// have it, and they hold records in baseline format.
+const (
+	segmentMagic      = uint64(0x544e454d47455357)
+	segmentHeaderSize = 8 + 1
+)
+
+// SyncPolicy decides when appended records are synced to disk.
+type SyncPolicy int
+
+const (
+	// SyncAlways syncs the segment after every append.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval syncs the segment periodically, so records
+	// appended since the last sync can be lost in a crash.
+	SyncInterval
+	// SyncNever leaves syncing to the operating system.
+	SyncNever
+)
+
+// ParseSyncPolicy returns sync policy for its name in configuration:
+// "always", "interval" or "never".
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch name {
+	case "always", "":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	}
+	return SyncAlways, errors.New("unknown wal sync policy " + name)
+}
+
 type WAL struct {
 	LastSegmentPath string
 	SegmentPaths    []string
 	DirPath         string
-	Lwm             uint8
-	MaxNumOfRecords uint8
-	NumOfRecords    uint8
+	// Lwm is the least number of segments that are kept after
+	// their records are flushed, for recovery and replication.
+	Lwm uint8
+	// MaxSegmentSize is size in bytes after which a new segment is started.
+	MaxSegmentSize uint64
+	SyncPolicy     SyncPolicy
+	LastSeqNum     uint64
+	// file is the last segment, which stays open while records
+	// are appended to it at offset, and dirty is true if some of
+	// them are not synced yet.
+	file   *os.File
+	offset uint64
+	dirty  bool
+	// failure is an error of a failed write or sync. Once
+	// it happens, nothing is appended to the wal anymore.
+	failure error
+	stop    chan struct{}
+	stopped chan struct{}
+	// GroupCommitWindow is time that the leader of group commit
+	// waits for more writes before it writes the group.
+	GroupCommitWindow time.Duration
+	// queue holds writes that wait for group commit, and leading
+	// is true while a leader writes a group. Only the leader uses
+	// the last segment while leading is true.
+	queue           []*PendingWrite
+	leading         bool
+	committedSeqNum uint64
+	stats           CommitStats
+	// validLengths holds length of the readable part of every
+	// segment found when the wal was opened, and Corruptions
+	// holds errors for parts that are not readable.
+	validLengths map[string]uint64
+	Corruptions  []error
+	// maxSeqNums holds the greatest sequence number
+	// of records in every segment that has any.
+	maxSeqNums map[string]uint64
+	// mutex guards segments, since flushed segments are
+	// deleted in the background while records are appended,
+	// and cond signals that a group is committed.
+	mutex sync.Mutex
+	cond  *sync.Cond
 }
 
-func CreateWAL(path string, lwm uint8, maxRecords uint8) (*WAL, error) {
+// CreateWAL opens wal whose segments are kept in directory on passed
+// path. Directory is created if it doesn't exist. The last used sequence
+// number is restored from the sequence file and records in segments,
+// which are recovered with passed mode first. With SyncInterval policy,
+// segment is synced every syncInterval. Wal must be closed with Close.
+func CreateWAL(path string, lwm uint8, maxSegmentSize uint64, syncPolicy SyncPolicy,
+	syncInterval time.Duration, recoveryMode RecoveryMode) (*WAL, error) {
 	var filePath string
-	paths := make([]string, 0)
 
-	files, err := ioutil.ReadDir(path)
+	err := os.MkdirAll(path, 0777)
+	if err != nil {
+		return nil, storageErrors.NewIO("mkdir", path, err)
+	}
+	paths, err := listSegments(path)
 	if err != nil {
 		return nil, err
 	}
-	numOfFiles := len(files)
-	if numOfFiles == 0 {
-		filePath = path + "wal_1.bin"
+	if len(paths) == 0 {
+		filePath = filepath.Join(path, "wal_1.bin")
 		paths = append(paths, filePath)
-		numOfFiles++
 		file, err := os.OpenFile(filePath, os.O_CREATE, 0777)
 		if err != nil {
-			log.Fatal(err)
+			return nil, storageErrors.NewIO("create", filePath, err)
 		}
 		defer file.Close()
 
 	} else {
-		filePath = path + files[numOfFiles-1].Name()
-		for i := 0; i < numOfFiles; i++ {
-			paths = append(paths, path+files[i].Name())
-		}
+		filePath = paths[len(paths)-1]
 	}
 
 	wal := &WAL{
@@ -51,140 +137,328 @@ func CreateWAL(path string, lwm uint8, maxRecords uint8) (*WAL, error) {
 		SegmentPaths:    paths,
 		DirPath:         path,
 		Lwm:             lwm,
-		MaxNumOfRecords: maxRecords,
+		MaxSegmentSize:  maxSegmentSize,
+		SyncPolicy:      syncPolicy,
+	}
+	wal.cond = sync.NewCond(&wal.mutex)
+	wal.LastSeqNum, err = loadSeqNum(filepath.Join(path, seqNumFileName))
+	if err != nil {
+		return nil, err
+	}
+	err = wal.recover(recoveryMode)
+	if err != nil {
+		return nil, err
+	}
+	wal.committedSeqNum = wal.LastSeqNum
+	err = wal.openLastSegment()
+	if err != nil {
+		return nil, err
+	}
+	if syncPolicy == SyncInterval {
+		wal.stop = make(chan struct{})
+		wal.stopped = make(chan struct{})
+		go wal.syncPeriodically(syncInterval)
 	}
-	wal.NumOfRecords = uint8(wal.CalculateNumOfRecords())
 	return wal, nil
 }
 
-func (wal *WAL) Update() {
-	filePath := wal.DirPath + "wal_1.bin"
-	paths := make([]string, 0)
-	paths = append(paths, filePath)
-	file, err := os.OpenFile(filePath, os.O_CREATE, 0777)
+// openLastSegment opens the last segment for appending and writes the
+// header to it if it is empty. Records are not appended to a segment in
+// baseline format, so a new segment is started after it.
+func (wal *WAL) openLastSegment() error {
+	file, err := os.OpenFile(wal.LastSegmentPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0777)
 	if err != nil {
-		log.Fatal(err)
+		return storageErrors.NewIO("open", wal.LastSegmentPath, err)
 	}
-	defer file.Close()
-	wal.LastSegmentPath = filePath
-	wal.SegmentPaths = paths
-	wal.NumOfRecords = 0
-}
-
-func (wal *WAL) AddData(key string, value []byte) bool {
-	return wal.AppendData(key, value, 0)
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return storageErrors.NewIO("stat", wal.LastSegmentPath, err)
+	}
+	wal.file = file
+	wal.offset = uint64(info.Size())
+	wal.dirty = false
+	if wal.offset == 0 {
+		_, err = file.Write(encodeSegmentHeader())
+		if err != nil {
+			return storageErrors.NewIO("write", wal.LastSegmentPath, err)
+		}
+		wal.offset = segmentHeaderSize
+		wal.dirty = true
+		return nil
+	}
+	header := make([]byte, segmentHeaderSize)
+	_, err = file.ReadAt(header, 0)
+	if err != nil || binary.LittleEndian.Uint64(header) != segmentMagic {
+		return wal.addSegment()
+	}
+	return nil
 }
 
-func (wal *WAL) DeleteData(key string, value []byte) bool {
-	return wal.AppendData(key, value, 1)
+// encodeSegmentHeader returns header of a new segment.
+func encodeSegmentHeader() []byte {
+	header := binary.LittleEndian.AppendUint64(make([]byte, 0, segmentHeaderSize), segmentMagic)
+	return append(header, byte(record.FormatSeqNum))
 }
 
-func (wal *WAL) AppendData(key string, value []byte, del byte) bool {
-	if wal.NumOfRecords == wal.MaxNumOfRecords {
-		wal.NumOfRecords = 0
-		newPath := wal.DirPath + "wal_" + strconv.Itoa(len(wal.SegmentPaths)+1) + ".bin"
-		wal.SegmentPaths = append(wal.SegmentPaths, newPath)
-		wal.LastSegmentPath = newPath
-		_, err := os.Create(newPath)
-		if err != nil {
-			return false
-		}
+// closeLastSegment syncs the last segment, unless policy is SyncNever, and closes it.
+func (wal *WAL) closeLastSegment() error {
+	err := wal.syncIfDirty()
+	closeErr := wal.file.Close()
+	wal.file = nil
+	if err != nil {
+		return err
 	}
+	return storageErrors.NewIO("close", wal.LastSegmentPath, closeErr)
+}
 
-	newRecord := record.CreateRecord(key, value, del)
-	recordBytes := newRecord.EncodeRecord()
-	file, err := os.OpenFile(wal.LastSegmentPath, os.O_RDWR, 0777)
-	if err != nil {
-		return false
+// syncIfDirty syncs records appended since the last sync.
+func (wal *WAL) syncIfDirty() error {
+	if !wal.dirty || wal.SyncPolicy == SyncNever {
+		return nil
 	}
-	defer file.Close()
-	err = appendWAL(file, recordBytes)
+	err := wal.file.Sync()
 	if err != nil {
-		return false
+		return storageErrors.NewIO("sync", wal.LastSegmentPath, err)
 	}
-	wal.NumOfRecords++
-	return true
+	wal.dirty = false
+	return nil
 }
 
-func (wal *WAL) CalculateNumOfRecords() int {
-	numOfRecords := 0
-	file, err := os.OpenFile(wal.LastSegmentPath, os.O_RDWR, 0777)
-	if err != nil {
-		return -1
+// syncPeriodically syncs the last segment every interval until the wal
+// is closed. Tick is skipped while a leader writes a group.
+func (wal *WAL) syncPeriodically(interval time.Duration) {
+	defer close(wal.stopped)
+	if interval <= 0 {
+		interval = time.Second
 	}
-	defer file.Close()
-	reader := bufio.NewReader(file)
-	record := record.Record{}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
-		if record.DecodeRecord(reader) {
-			break
+		select {
+		case <-ticker.C:
+			wal.mutex.Lock()
+			if !wal.leading && wal.failure == nil {
+				wal.failure = wal.syncIfDirty()
+			}
+			wal.mutex.Unlock()
+		case <-wal.stop:
+			return
 		}
-		numOfRecords++
 	}
-	return numOfRecords
 }
 
-func (wal *WAL) DeleteSegments(pathsForDelete []string){
-	for i := 0; i < len(pathsForDelete); i++ {
-		err := os.Remove(wal.SegmentPaths[i])
-		if err != nil {
-			panic(err)
-		}
+// Close waits for queued writes, stops the periodic
+// sync, syncs the last segment and closes it.
+func (wal *WAL) Close() error {
+	if wal.stop != nil {
+		close(wal.stop)
+		<-wal.stopped
 	}
-	files, err := ioutil.ReadDir(wal.DirPath)
-	paths := make([]string, 0)
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	wal.waitForQueue()
+	if wal.file == nil {
+		return nil
+	}
+	return wal.closeLastSegment()
+}
+
+// listSegments returns paths of all segments in wal directory ordered by their index.
+func listSegments(path string) ([]string, error) {
+	files, err := ioutil.ReadDir(path)
 	if err != nil {
-		panic(err)
+		return nil, storageErrors.NewIO("read", path, err)
 	}
-	for i := 0; i < len(files); i++ {
-		newPath := wal.DirPath + "wal_" + strconv.Itoa(i+1) + ".bin"
-		paths = append(paths, newPath)
-		err := os.Rename(wal.DirPath+files[i].Name(), newPath)
+	indexes := make([]int, 0)
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, "wal_") || !strings.HasSuffix(name, ".bin") {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "wal_"), ".bin"))
 		if err != nil {
-			panic(err)
+			continue
 		}
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	paths := make([]string, 0)
+	for _, index := range indexes {
+		paths = append(paths, filepath.Join(path, "wal_"+strconv.Itoa(index)+".bin"))
 	}
-	wal.SegmentPaths = paths
+	return paths, nil
 }
 
-func (wal *WAL) DeleteAllSegments() {
-	for i := 0; i < len(wal.SegmentPaths); i++ {
-		err := os.Remove(wal.SegmentPaths[i])
-		if err != nil {
-			panic(err)
-		}
+// loadSeqNum reads sequence number from passed file, or returns 0 if file doesn't exist.
+func loadSeqNum(filePath string) (uint64, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, storageErrors.NewIO("read", filePath, err)
 	}
-	wal.Update()
+	if len(data) != 8 {
+		return 0, storageErrors.NewCorruption(filePath, 0, "invalid sequence number")
+	}
+	return binary.LittleEndian.Uint64(data), nil
 }
 
-func CRC32(data []byte) uint32 {
-	return crc32.ChecksumIEEE(data)
+// saveSeqNum writes the last used sequence number to the sequence file,
+// so that it isn't lost when segments that hold it are deleted.
+func (wal *WAL) saveSeqNum() error {
+	filePath := filepath.Join(wal.DirPath, seqNumFileName)
+	tmpFilePath := filePath + ".tmp"
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, wal.LastSeqNum)
+	file, err := os.OpenFile(tmpFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0777)
+	if err != nil {
+		return storageErrors.NewIO("create", tmpFilePath, err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return storageErrors.NewIO("write", tmpFilePath, err)
+	}
+	err = os.Rename(tmpFilePath, filePath)
+	if err != nil {
+		return storageErrors.NewIO("rename", tmpFilePath, err)
+	}
+	return syncDir(wal.DirPath)
 }
 
-func fileLen(file *os.File) (int64, error) {
-	info, err := file.Stat()
+// syncDir syncs passed directory, so that a file
+// renamed inside of it stays renamed after a crash.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
 	if err != nil {
-		return 0, err
+		return storageErrors.NewIO("open", path, err)
 	}
-	return info.Size(), nil
+	err = dir.Sync()
+	dir.Close()
+	return storageErrors.NewIO("sync", path, err)
 }
 
-func appendWAL(file *os.File, data []byte) error {
-	currentLen, err := fileLen(file)
-	if err != nil {
-		return err
+// SkipSeqNumsUpTo makes sure that new records get sequence numbers
+// greater than passed one. It is called when the wal is opened with the
+// greatest sequence number that is durable in sstables, since segments
+// that held it can be deleted before the sequence file reaches the disk.
+func (wal *WAL) SkipSeqNumsUpTo(seqNum uint64) {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	if seqNum > wal.LastSeqNum {
+		wal.LastSeqNum = seqNum
 	}
-	err = file.Truncate(currentLen + int64(len(data)))
-	if err != nil {
-		return err
+	if seqNum > wal.committedSeqNum {
+		wal.committedSeqNum = seqNum
+	}
+}
+
+// nextSeqNum returns a new sequence number, greater than all previous ones.
+func (wal *WAL) nextSeqNum() uint64 {
+	wal.LastSeqNum++
+	return wal.LastSeqNum
+}
+
+func (wal *WAL) AddData(key string, value []byte) error {
+	return wal.AppendData(key, value, 0)
+}
+
+func (wal *WAL) DeleteData(key string, value []byte) error {
+	return wal.AppendData(key, value, 1)
+}
+
+func (wal *WAL) AppendData(key string, value []byte, del byte) error {
+	return wal.AppendRecord(record.CreateRecord(key, value, del))
+}
+
+// AppendRecord appends passed record to the wal and waits until it is
+// committed. Record that doesn't have a sequence number yet gets the next
+// one, while a record that already has it keeps it.
+func (wal *WAL) AppendRecord(rec *record.Record) error {
+	return wal.Enqueue(rec, nil).Wait()
+}
+
+// AppendBatch appends all passed records as a single batch record and
+// waits until it is committed. Records without sequence numbers get
+// consecutive ones.
+func (wal *WAL) AppendBatch(records []record.Record) error {
+	return wal.EnqueueBatch(records, nil).Wait()
+}
+
+// Rotate starts a new segment, so that new records are appended to it
+// while records of the old segments are flushed. Queued writes are
+// committed to the old segment first.
+func (wal *WAL) Rotate() error {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	wal.waitForQueue()
+	return wal.addSegment()
+}
+
+// addSegment creates a new segment after the last one.
+func (wal *WAL) addSegment() error {
+	index := 1
+	if len(wal.SegmentPaths) != 0 {
+		lastName := filepath.Base(wal.SegmentPaths[len(wal.SegmentPaths)-1])
+		lastIndex, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(lastName, "wal_"), ".bin"))
+		if err != nil {
+			return storageErrors.NewCorruption(wal.SegmentPaths[len(wal.SegmentPaths)-1], 0, "invalid segment name")
+		}
+		index = lastIndex + 1
+	}
+	newPath := filepath.Join(wal.DirPath, "wal_"+strconv.Itoa(index)+".bin")
+	if wal.file != nil {
+		err := wal.closeLastSegment()
+		if err != nil {
+			return err
+		}
 	}
-	//mmapf, err := mmap.MapRegion(file, int(currentLen)+len(data), mmap.RDWR, 0, 0)
-	mmapf, err := mmap.Map(file, mmap.RDWR, 0)
+	wal.SegmentPaths = append(wal.SegmentPaths, newPath)
+	wal.LastSegmentPath = newPath
+	return wal.openLastSegment()
+}
+
+// DeleteSegmentsUpTo deletes the oldest segments whose records all have
+// sequence numbers smaller than or equal to passed one, which means that
+// they are durable in sstables. At least Lwm newest segments are kept,
+// and the last segment is never deleted, since records are appended to it.
+func (wal *WAL) DeleteSegmentsUpTo(seqNum uint64) error {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	err := wal.saveSeqNum()
 	if err != nil {
 		return err
 	}
-	defer mmapf.Unmap()
-	copy(mmapf[currentLen:], data)
-	mmapf.Flush()
+	keep := int(wal.Lwm)
+	if keep < 1 {
+		keep = 1
+	}
+	deleted := 0
+	for deleted < len(wal.SegmentPaths)-keep {
+		path := wal.SegmentPaths[deleted]
+		if wal.maxSeqNums[path] > seqNum {
+			break
+		}
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return storageErrors.NewIO("remove", path, err)
+		}
+		delete(wal.maxSeqNums, path)
+		delete(wal.validLengths, path)
+		deleted++
+	}
+	wal.SegmentPaths = wal.SegmentPaths[deleted:]
 	return nil
-}
\ No newline at end of file
+}
+
+func CRC32(data []byte) uint32 {
+	return crc32.ChecksumIEEE(data)
+}
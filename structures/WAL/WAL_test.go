@@ -0,0 +1,118 @@
+package WAL
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"napredni/structures/record"
+)
+
+// copySegments copies segments with passed names from
+// the wal directory of data fixtures to passed directory.
+func copySegments(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join("..", "..", "data", "wal", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(dir, name), data, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// replayKeys returns keys of all records in the wal and their sequence numbers.
+func replayKeys(t *testing.T, wal *WAL) ([]string, []uint64) {
+	t.Helper()
+	keys := make([]string, 0)
+	seqNums := make([]uint64, 0)
+	err := wal.Replay(func(rec record.Record) error {
+		keys = append(keys, rec.Key)
+		seqNums = append(seqNums, rec.SeqNum)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys, seqNums
+}
+
+// Segments written before segments had a header are read in the baseline
+// record layout, and new records are appended to a new segment after them.
+func TestBaselineSegmentsAreRead(t *testing.T) {
+	dir := t.TempDir()
+	copySegments(t, dir, "wal_1.bin", "wal_2.bin")
+
+	wal, err := CreateWAL(dir, 9, 1<<20, SyncAlways, 0, RecoverStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wal.Corruptions) != 0 {
+		t.Fatalf("corruptions: %v", wal.Corruptions)
+	}
+	keys, seqNums := replayKeys(t, wal)
+	if len(keys) != 6 || keys[0] != "pera5" || keys[1] != "pera2" {
+		t.Fatalf("keys: %v", keys)
+	}
+	for i := 1; i < len(seqNums); i++ {
+		if seqNums[i] <= seqNums[i-1] {
+			t.Fatalf("sequence numbers are not increasing: %v", seqNums)
+		}
+	}
+
+	err = wal.AddData("pera1", []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(wal.LastSegmentPath) != "wal_3.bin" {
+		t.Fatalf("appended to %s", wal.LastSegmentPath)
+	}
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err = CreateWAL(dir, 9, 1<<20, SyncAlways, 0, RecoverStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	keys, newSeqNums := replayKeys(t, wal)
+	if len(keys) != 7 || keys[6] != "pera1" {
+		t.Fatalf("keys after reopen: %v", keys)
+	}
+	if newSeqNums[6] <= seqNums[5] {
+		t.Fatalf("new sequence number %d is not greater than %d", newSeqNums[6], seqNums[5])
+	}
+}
+
+// Segment whose header holds an unknown format is neither truncated
+// nor skipped, so the wal is not opened in either recovery mode.
+func TestUnknownSegmentFormatIsNotOpened(t *testing.T) {
+	for _, mode := range []RecoveryMode{RecoverStrict, RecoverSkip} {
+		dir := t.TempDir()
+		segment := append(encodeSegmentHeader()[:8], 99)
+		segment = append(segment, "records of a newer version"...)
+		path := filepath.Join(dir, "wal_1.bin")
+		err := os.WriteFile(path, segment, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = CreateWAL(dir, 9, 1<<20, SyncAlways, 0, mode)
+		if !errors.Is(err, record.ErrUnsupportedFormat) {
+			t.Fatalf("mode %d: got %v, want unsupported format", mode, err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != len(segment) {
+			t.Fatalf("mode %d: segment was truncated to %d bytes", mode, len(data))
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package WAL
+
+import (
+	"napredni/structures/record"
+	"napredni/structures/storageErrors"
+	"time"
+)
+
+// PendingWrite is a write queued for group commit. Writes are committed
+// in the order in which they are queued, which is also the order of
+// their sequence numbers.
+type PendingWrite struct {
+	wal      *WAL
+	data     []byte
+	seqNum   uint64
+	apply    func()
+	enqueued time.Time
+	done     bool
+	err      error
+}
+
+// CommitStats holds counters of group commit since the wal was opened.
+// Writes/Groups is average size of a group and Latency/Writes is average
+// time that a write spends from being queued until it is committed.
+type CommitStats struct {
+	Groups     uint64
+	Writes     uint64
+	Bytes      uint64
+	Syncs      uint64
+	Latency    time.Duration
+	MaxLatency time.Duration
+}
+
+// Enqueue queues passed record for group commit and returns the write,
+// which must be waited for. Record that doesn't have a sequence number
+// yet gets the next one. Passed apply function, if it isn't nil, is
+// called once the record is written, before writes queued after it are
+// applied, so it is used to add the record to the memtable.
+func (wal *WAL) Enqueue(rec *record.Record, apply func()) *PendingWrite {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	if rec.SeqNum == 0 {
+		rec.SeqNum = wal.nextSeqNum()
+	}
+	return wal.enqueue(rec, apply)
+}
+
+// EnqueueBatch works like Enqueue for all passed records, which are
+// written as a single batch record. Records without sequence numbers
+// get consecutive ones.
+func (wal *WAL) EnqueueBatch(records []record.Record, apply func()) *PendingWrite {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	for i := range records {
+		if records[i].SeqNum == 0 {
+			records[i].SeqNum = wal.nextSeqNum()
+		}
+	}
+	batchRecord := record.CreateBatchRecord(records)
+	batchRecord.SeqNum = records[len(records)-1].SeqNum
+	return wal.enqueue(batchRecord, apply)
+}
+
+func (wal *WAL) enqueue(rec *record.Record, apply func()) *PendingWrite {
+	write := &PendingWrite{
+		wal:      wal,
+		data:     rec.EncodeRecord(),
+		seqNum:   rec.SeqNum,
+		apply:    apply,
+		enqueued: time.Now(),
+	}
+	wal.queue = append(wal.queue, write)
+	return write
+}
+
+// Wait waits until the write is committed and returns its error. If no
+// group is being written, the caller becomes the leader and commits all
+// queued writes, including writes of other callers, as one group.
+func (write *PendingWrite) Wait() error {
+	wal := write.wal
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	for !write.done && wal.leading {
+		wal.cond.Wait()
+	}
+	if !write.done {
+		wal.lead()
+	}
+	return write.err
+}
+
+// CommittedSeqNum returns sequence number of the last committed write.
+// Every write with a smaller or equal sequence number is applied.
+func (wal *WAL) CommittedSeqNum() uint64 {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	return wal.committedSeqNum
+}
+
+// PinCommittedSeqNum calls passed function with the committed sequence
+// number while no group is being applied, so that writes newer than the
+// number are not applied before the function returns.
+func (wal *WAL) PinCommittedSeqNum(pin func(seqNum uint64)) uint64 {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	for wal.leading {
+		wal.cond.Wait()
+	}
+	pin(wal.committedSeqNum)
+	return wal.committedSeqNum
+}
+
+// Stats returns counters of group commit.
+func (wal *WAL) Stats() CommitStats {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	return wal.stats
+}
+
+// lead writes all queued writes as one group with a single sync and
+// applies them in order. Mutex is held when lead is called and when it
+// returns, but it is released while the group is written, so that other
+// writes can be queued for the next group in the meantime.
+func (wal *WAL) lead() {
+	wal.leading = true
+	if wal.GroupCommitWindow > 0 {
+		wal.mutex.Unlock()
+		time.Sleep(wal.GroupCommitWindow)
+		wal.mutex.Lock()
+	}
+	group := wal.queue
+	wal.queue = nil
+	size := uint64(0)
+	for _, write := range group {
+		size += uint64(len(write.data))
+	}
+	err := wal.failure
+	if err == nil && wal.offset > segmentHeaderSize && wal.offset+size > wal.MaxSegmentSize {
+		err = wal.addSegment()
+	}
+	wal.mutex.Unlock()
+
+	synced := false
+	if err == nil {
+		synced, err = wal.writeGroup(group, size)
+	}
+	if err == nil {
+		for _, write := range group {
+			if write.apply != nil {
+				write.apply()
+			}
+		}
+	}
+
+	wal.mutex.Lock()
+	if err != nil && wal.failure == nil {
+		wal.failure = err
+	}
+	now := time.Now()
+	for _, write := range group {
+		write.err = err
+		write.done = true
+		if err == nil && write.seqNum > wal.committedSeqNum {
+			wal.committedSeqNum = write.seqNum
+		}
+		if err == nil && write.seqNum > wal.maxSeqNums[wal.LastSegmentPath] {
+			wal.maxSeqNums[wal.LastSegmentPath] = write.seqNum
+		}
+		latency := now.Sub(write.enqueued)
+		wal.stats.Latency += latency
+		if latency > wal.stats.MaxLatency {
+			wal.stats.MaxLatency = latency
+		}
+	}
+	wal.stats.Groups++
+	wal.stats.Writes += uint64(len(group))
+	if err == nil {
+		wal.stats.Bytes += size
+	}
+	if synced {
+		wal.stats.Syncs++
+	}
+	wal.leading = false
+	wal.cond.Broadcast()
+}
+
+// writeGroup writes data of all passed writes to the last segment with a
+// single write and syncs it if policy is SyncAlways. It returns true if
+// the segment was synced.
+func (wal *WAL) writeGroup(group []*PendingWrite, size uint64) (bool, error) {
+	data := make([]byte, 0, size)
+	for _, write := range group {
+		data = append(data, write.data...)
+	}
+	_, err := wal.file.Write(data)
+	if err != nil {
+		return false, storageErrors.NewIO("write", wal.LastSegmentPath, err)
+	}
+	wal.offset += size
+	wal.dirty = true
+	if wal.SyncPolicy != SyncAlways {
+		return false, nil
+	}
+	return true, wal.syncIfDirty()
+}
+
+// waitForQueue commits all queued writes, so that the last segment
+// can be changed. If no group is being written, the caller leads the
+// next one instead of waiting for writers. Mutex must be held.
+func (wal *WAL) waitForQueue() {
+	for wal.leading || len(wal.queue) != 0 {
+		if wal.leading {
+			wal.cond.Wait()
+		} else {
+			wal.lead()
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package WAL
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"napredni/structures/record"
+	"napredni/structures/storageErrors"
+	"os"
+)
+
+// RecoveryMode decides what happens with corrupt records in segments
+// other than the last one when the wal is opened. Corrupt or partial
+// record in the last segment is always left by an interrupted write,
+// so the last segment is truncated before it.
+type RecoveryMode int
+
+const (
+	// RecoverStrict refuses to open the wal.
+	RecoverStrict RecoveryMode = iota
+	// RecoverSkip skips the rest of the segment from the corrupt record,
+	// since records after it can't be found, and reports it in Corruptions.
+	RecoverSkip
+)
+
+// ParseRecoveryMode returns recovery mode for its name
+// in configuration: "strict" or "skip".
+func ParseRecoveryMode(name string) (RecoveryMode, error) {
+	switch name {
+	case "strict", "":
+		return RecoverStrict, nil
+	case "skip":
+		return RecoverSkip, nil
+	}
+	return RecoverStrict, errors.New("unknown wal recovery mode " + name)
+}
+
+// recover checks records of every segment, truncates the last segment
+// at its first corrupt record and restores the last used sequence number
+// and the greatest sequence number of every segment.
+func (wal *WAL) recover(mode RecoveryMode) error {
+	wal.validLengths = make(map[string]uint64)
+	wal.maxSeqNums = make(map[string]uint64)
+	for _, segmentPath := range wal.SegmentPaths {
+		length, err := readSegment(segmentPath, math.MaxInt64, func(rec record.Record) error {
+			if rec.SeqNum > wal.LastSeqNum {
+				wal.LastSeqNum = rec.SeqNum
+			}
+			if rec.SeqNum > wal.maxSeqNums[segmentPath] {
+				wal.maxSeqNums[segmentPath] = rec.SeqNum
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, storageErrors.ErrCorruption) {
+			return err
+		}
+		if err != nil {
+			if segmentPath == wal.LastSegmentPath {
+				truncateErr := os.Truncate(segmentPath, int64(length))
+				if truncateErr != nil {
+					return storageErrors.NewIO("truncate", segmentPath, truncateErr)
+				}
+			} else if mode == RecoverStrict {
+				return err
+			}
+			wal.Corruptions = append(wal.Corruptions, err)
+		}
+		wal.validLengths[segmentPath] = length
+	}
+	return nil
+}
+
+// Replay calls passed function for every record in segments, from the
+// oldest one. Records of a write batch are passed one by one, after the
+// whole batch is read. Parts of segments that were found corrupt when
+// the wal was opened are not read.
+func (wal *WAL) Replay(apply func(rec record.Record) error) error {
+	for _, segmentPath := range wal.SegmentPaths {
+		length, found := wal.validLengths[segmentPath]
+		if !found {
+			length = math.MaxInt64
+		}
+		_, err := readSegment(segmentPath, length, func(rec record.Record) error {
+			if !rec.IsBatch() {
+				return apply(rec)
+			}
+			records, _ := rec.DecodeBatch()
+			for _, batchRecord := range records {
+				err := apply(batchRecord)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSegment calls passed function for every record in the first length
+// bytes of segment and returns length of its part that holds the header and
+// whole records with valid crc. If it finds a partial or corrupt record, it
+// returns corruption error together with the length of the part before it.
+func readSegment(segmentPath string, length uint64, fn func(rec record.Record) error) (uint64, error) {
+	file, err := os.Open(segmentPath)
+	if err != nil {
+		return 0, storageErrors.NewIO("open", segmentPath, err)
+	}
+	defer file.Close()
+	reader := bufio.NewReader(io.LimitReader(file, int64(length)))
+
+	offset := uint64(0)
+	format := record.FormatBaseline
+	header, err := reader.Peek(segmentHeaderSize)
+	if err == nil && binary.LittleEndian.Uint64(header) == segmentMagic {
+		format = record.Format(header[8])
+		reader.Discard(segmentHeaderSize)
+		offset = segmentHeaderSize
+	}
+	// Segment in an unknown format is not corrupt, so it is never
+	// truncated or skipped, and the wal can't be opened.
+	if format != record.FormatBaseline && format != record.FormatSeqNum {
+		return 0, fmt.Errorf("%s: %w %d", segmentPath, record.ErrUnsupportedFormat, format)
+	}
+	for {
+		rec := record.Record{}
+		eof, err := rec.Decode(reader, format)
+		if err != nil {
+			return offset, storageErrors.NewCorruption(segmentPath, int64(offset), err.Error())
+		}
+		if eof {
+			return offset, nil
+		}
+		if !rec.CheckCrc() {
+			return offset, storageErrors.NewCorruption(segmentPath, int64(offset), "crc mismatch")
+		}
+		if rec.IsBatch() {
+			_, err = rec.DecodeBatch()
+			if err != nil {
+				return offset, storageErrors.NewCorruption(segmentPath, int64(offset), err.Error())
+			}
+		}
+		err = fn(rec)
+		if err != nil {
+			return offset, err
+		}
+		offset += rec.GetSizeIn(format)
+	}
+}
@@ -0,0 +1,220 @@
+package WAL
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"napredni/structures/record"
+	"napredni/structures/storageErrors"
+)
+
+// testRecordSize is size of every record that writeTestSegments appends.
+const testRecordSize = 4 + 8 + 8 + 1 + 8 + 8 + 3 + 1
+
+// writeTestSegments writes two segments with three records each,
+// with keys k01 to k06 and sequence numbers 1 to 6.
+func writeTestSegments(t *testing.T, dir string) {
+	t.Helper()
+	wal, err := CreateWAL(dir, 9, 1<<20, SyncAlways, 0, RecoverStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 6; i++ {
+		err = wal.AddData(fmt.Sprintf("k%02d", i), []byte("v"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 3 {
+			err = wal.Rotate()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// crash drops the wal without closing it, as if the process stopped.
+func crash(wal *WAL) {
+	wal.file.Close()
+	wal.file = nil
+}
+
+func TestRecovery(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		segment string
+		damage  func(data []byte) []byte
+		// offset is where corruption is reported, and length is
+		// length of the damaged segment after recovery.
+		offset     int64
+		length     int64
+		strictFail bool
+		keys       string
+	}{
+		{
+			name:    "cut off last record",
+			segment: "wal_2.bin",
+			damage:  func(data []byte) []byte { return data[:len(data)-10] },
+			offset:  segmentHeaderSize + 2*testRecordSize,
+			length:  segmentHeaderSize + 2*testRecordSize,
+			keys:    "[k01 k02 k03 k04 k05]",
+		},
+		{
+			name:    "corrupt last record",
+			segment: "wal_2.bin",
+			damage: func(data []byte) []byte {
+				data[len(data)-1] ^= 0xff
+				return data
+			},
+			offset: segmentHeaderSize + 2*testRecordSize,
+			length: segmentHeaderSize + 2*testRecordSize,
+			keys:   "[k01 k02 k03 k04 k05]",
+		},
+		{
+			name:    "corrupt record of older segment",
+			segment: "wal_1.bin",
+			damage: func(data []byte) []byte {
+				data[segmentHeaderSize+2*testRecordSize-1] ^= 0xff
+				return data
+			},
+			offset:     segmentHeaderSize + testRecordSize,
+			length:     segmentHeaderSize + 3*testRecordSize,
+			strictFail: true,
+			keys:       "[k01 k04 k05 k06]",
+		},
+	} {
+		for _, mode := range []RecoveryMode{RecoverStrict, RecoverSkip} {
+			t.Run(fmt.Sprintf("%s mode %d", test.name, mode), func(t *testing.T) {
+				dir := t.TempDir()
+				writeTestSegments(t, dir)
+				path := filepath.Join(dir, test.segment)
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = os.WriteFile(path, test.damage(data), 0777)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				wal, err := CreateWAL(dir, 9, 1<<20, SyncAlways, 0, mode)
+				if test.strictFail && mode == RecoverStrict {
+					var corruption *storageErrors.CorruptionError
+					if !errors.As(err, &corruption) || corruption.File != path || corruption.Offset != test.offset {
+						t.Fatalf("open: got %v, want corruption of %s at %d", err, path, test.offset)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(wal.Corruptions) != 1 {
+					t.Fatalf("corruptions: %v", wal.Corruptions)
+				}
+				var corruption *storageErrors.CorruptionError
+				if !errors.As(wal.Corruptions[0], &corruption) || corruption.File != path ||
+					corruption.Offset != test.offset {
+					t.Fatalf("corruption: got %v, want %s at %d", wal.Corruptions[0], path, test.offset)
+				}
+				info, err := os.Stat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Size() != test.length {
+					t.Fatalf("length of %s: got %d, want %d", test.segment, info.Size(), test.length)
+				}
+				keys, _ := replayKeys(t, wal)
+				if fmt.Sprint(keys) != test.keys {
+					t.Fatalf("keys: got %v, want %s", keys, test.keys)
+				}
+
+				// Sequence numbers continue after the last readable
+				// record even if the wal crashes once more.
+				err = wal.AddData("k07", []byte("v"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				crash(wal)
+				wal, err = CreateWAL(dir, 9, 1<<20, SyncAlways, 0, mode)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer wal.Close()
+				keys, seqNums := replayKeys(t, wal)
+				if keys[len(keys)-1] != "k07" {
+					t.Fatalf("keys after second crash: %v", keys)
+				}
+				for i := 1; i < len(seqNums); i++ {
+					if seqNums[i] <= seqNums[i-1] {
+						t.Fatalf("sequence numbers are not increasing: %v", seqNums)
+					}
+				}
+				err = wal.AddData("k08", []byte("v"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if wal.LastSeqNum != seqNums[len(seqNums)-1]+1 {
+					t.Fatalf("k08 got sequence number %d after %v", wal.LastSeqNum, seqNums)
+				}
+			})
+		}
+	}
+}
+
+// Batch is a single record, so a batch torn in the middle is dropped
+// whole on replay, while records appended before it survive.
+func TestTornBatchIsDroppedWhole(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := CreateWAL(dir, 9, 1<<20, SyncAlways, 0, RecoverStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"k01", "k02"} {
+		err = wal.AddData(key, []byte("v"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	batch := []record.Record{*record.CreateRecord("k03", []byte("v"), 0),
+		*record.CreateRecord("k04", []byte("v"), 0), *record.CreateRecord("k05", nil, 1)}
+	err = wal.AppendBatch(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(wal)
+
+	path := filepath.Join(dir, "wal_1.bin")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batchStart := int64(segmentHeaderSize + 2*testRecordSize)
+	err = os.Truncate(path, (batchStart+info.Size())/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err = CreateWAL(dir, 9, 1<<20, SyncAlways, 0, RecoverStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	keys, _ := replayKeys(t, wal)
+	if fmt.Sprint(keys) != "[k01 k02]" {
+		t.Fatalf("keys: %v", keys)
+	}
+	info, err = os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != batchStart {
+		t.Fatalf("segment is truncated to %d, want %d", info.Size(), batchStart)
+	}
+}
@@ -2,25 +2,37 @@ package bloomFilter
 
 import (
 	"encoding/gob"
+	"errors"
 	"github.com/spaolacci/murmur3"
 	"hash"
+	"io"
 	"math"
+	"napredni/structures/storageErrors"
 	"os"
 	"time"
 )
 
+// Formats of the filter. Filters written before formatSeedPerFunction
+// have no format, and all their hash functions use the same seed.
+const (
+	formatSharedSeed      = 0
+	formatSeedPerFunction = 1
+)
+
 type BloomFilter struct{
 	M uint
 	K uint
 	Ts uint
 	hashFunctions []hash.Hash32
 	Bits []int
+	Format uint
 }
 
 func CreateBloomFilter(expectedElements int, falsePositiveRate float64) *BloomFilter{
 	bf := &BloomFilter{}
 	bf.M = CalculateM(expectedElements, falsePositiveRate)
 	bf.K = CalculateK(expectedElements, bf.M)
+	bf.Format = formatSeedPerFunction
 	bf.CreateHashFunctions()
 	bf.Bits = make([]int, bf.M, bf.M)
 	return bf
@@ -32,11 +44,20 @@ func (bf *BloomFilter) CreateHashFunctions() {
 		bf.Ts = uint(time.Now().Unix())
 	}
 	for i := uint(0); i < bf.K; i++ {
-		h = append(h, murmur3.New32WithSeed(uint32(bf.Ts+1)))
+		h = append(h, murmur3.New32WithSeed(bf.seed(i)))
 	}
 	bf.hashFunctions = h
 }
 
+// seed returns seed of hash function on passed position. Filters in
+// the shared seed format use the same seed for all hash functions.
+func (bf *BloomFilter) seed(i uint) uint32 {
+	if bf.Format == formatSharedSeed {
+		return uint32(bf.Ts + 1)
+	}
+	return uint32(bf.Ts + 1 + i)
+}
+
 func (bf *BloomFilter) AddData(data string){
 	for i:=0; i < int(bf.K); i++{
 		bf.hashFunctions[i].Reset()
@@ -48,13 +69,16 @@ func (bf *BloomFilter) AddData(data string){
 	}
 }
 
+// FindData returns false if data was surely not added to the filter.
+// It hashes data with new hash functions instead of the ones of the
+// filter, which keep state, so it can be called concurrently.
 func (bf *BloomFilter) FindData(data string) bool{
-	for i := 0; i < int(bf.K); i++{
-		bf.hashFunctions[i].Reset()
-		if _, err := bf.hashFunctions[i].Write([]byte(data)); err != nil{
+	for i := uint(0); i < bf.K; i++{
+		hashFunction := murmur3.New32WithSeed(bf.seed(i))
+		if _, err := hashFunction.Write([]byte(data)); err != nil{
 			panic(err)
 		}
-		index := bf.hashFunctions[i].Sum32() % uint32(bf.M)
+		index := hashFunction.Sum32() % uint32(bf.M)
 		if bf.Bits[index] == 0 {
 			return false
 		}
@@ -62,29 +86,47 @@ func (bf *BloomFilter) FindData(data string) bool{
 	return true
 }
 
-func (bf *BloomFilter) EncodeBloomFilter(filterFilePath string) {
+func (bf *BloomFilter) EncodeBloomFilter(filterFilePath string) error {
 	file, err := os.Create(filterFilePath)
 	if err != nil {
-		panic(err)
+		return storageErrors.NewIO("create", filterFilePath, err)
 	}
 	defer file.Close()
-	encoder := gob.NewEncoder(file)
-	if err = encoder.Encode(&bf); err != nil {
-		panic(err)
+	if err = bf.Encode(file); err != nil {
+		return storageErrors.NewIO("write", filterFilePath, err)
 	}
+	return nil
 }
 
-func (bf *BloomFilter) DecodeBloomFilter(filterFilePath string) {
-	file, err := os.OpenFile(filterFilePath, os.O_RDWR, 0777)
+// Encode writes the filter to passed writer.
+func (bf *BloomFilter) Encode(writer io.Writer) error {
+	return gob.NewEncoder(writer).Encode(&bf)
+}
+
+func (bf *BloomFilter) DecodeBloomFilter(filterFilePath string) error {
+	file, err := os.OpenFile(filterFilePath, os.O_RDONLY, 0777)
 	if err != nil {
-		panic(err)
+		return storageErrors.NewIO("open", filterFilePath, err)
 	}
 	defer file.Close()
-	decoder := gob.NewDecoder(file)
-	if err = decoder.Decode(&bf); err != nil{
-		panic(err)
+	if err = bf.Decode(file); err != nil{
+		return storageErrors.NewCorruption(filterFilePath, 0, err.Error())
+	}
+	return nil
+}
+
+// Decode reads the filter written by Encode from passed reader.
+// Filter whose size doesn't match its bits is an error.
+func (bf *BloomFilter) Decode(reader io.Reader) error {
+	err := gob.NewDecoder(reader).Decode(&bf)
+	if err != nil {
+		return err
+	}
+	if bf.M == 0 || bf.M > math.MaxUint32 || uint(len(bf.Bits)) != bf.M || bf.K == 0 || bf.K > bf.M {
+		return errors.New("invalid bloom filter size")
 	}
 	bf.CreateHashFunctions()
+	return nil
 }
 
 func CalculateM(expectedElements int, falsePositiveRate float64) uint {
@@ -3,35 +3,89 @@ package configReader
 import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"napredni/structures/storageErrors"
+	"os"
+	"path/filepath"
 	"time"
 )
 
+// ConfigFilePath is path of configuration file inside of the root directory.
+var ConfigFilePath = filepath.Join("configurationFile", "configuration.yaml")
+
 type Config struct {
-	SegmentSize       int           `yaml:"segment_size"`
-	Lwm               int           `yaml:"lwm"`
-	MemtableThreshold float64       `yaml:"memtable_threshold"`
-	LsmLevels         int           `yaml:"lsm_levels"`
-	LsmLevelMax       int           `yaml:"lsm_level_max"`
-	CacheSize         int           `yaml:"cache_size"`
-	TokenTime         time.Duration `yaml:"token_time"`
-	TokenRequests     int           `yaml:"token_requests"`
+	WalPath                string        `yaml:"wal_path"`
+	WalSegmentSize         int           `yaml:"wal_segment_size"`
+	WalSync                string        `yaml:"wal_sync"`
+	WalSyncInterval        time.Duration `yaml:"wal_sync_interval"`
+	WalGroupCommitWindow   time.Duration `yaml:"wal_group_commit_window"`
+	WalRecovery            string        `yaml:"wal_recovery"`
+	SegmentSize            int           `yaml:"segment_size"`
+	Lwm                    int           `yaml:"lwm"`
+	MemtableThreshold      float64       `yaml:"memtable_threshold"`
+	MaxImmutableMemtables  int           `yaml:"max_immutable_memtables"`
+	LsmLevels              int           `yaml:"lsm_levels"`
+	LsmLevelMax            int           `yaml:"lsm_level_max"`
+	LsmBaseLevelSize       uint64        `yaml:"lsm_base_level_size"`
+	LsmLevelSizeMultiplier int           `yaml:"lsm_level_size_multiplier"`
+	SSTableSingleFile      bool          `yaml:"sstable_single_file"`
+	SSTableCompression     []string      `yaml:"sstable_compression"`
+	SSTableIndexInterval   int           `yaml:"sstable_index_interval"`
+	SSTableMaxOpenFiles    int           `yaml:"sstable_max_open_files"`
+	SSTableMmap            bool          `yaml:"sstable_mmap"`
+	SSTableTargetSize      uint64        `yaml:"sstable_target_size"`
+	CompactionStrategy     string        `yaml:"compaction_strategy"`
+	SizeTieredThreshold    int           `yaml:"size_tiered_threshold"`
+	CacheSize              int           `yaml:"cache_size"`
+	TokenTime              time.Duration `yaml:"token_time"`
+	TokenRequests          int           `yaml:"token_requests"`
+}
+
+// FillDefaults sets default values of all parameters.
+func (config *Config) FillDefaults() {
+	config.WalPath = "wal"
+	config.WalSegmentSize = 1048576
+	config.WalSync = "always"
+	config.WalSyncInterval = 100000000
+	config.WalRecovery = "strict"
+	config.Lwm = 9
+	config.SegmentSize = 5
+	config.LsmLevels = 5
+	config.LsmLevelMax = 4
+	config.LsmBaseLevelSize = 10485760
+	config.LsmLevelSizeMultiplier = 10
+	config.SSTableCompression = []string{"none", "flate", "flate", "zlib"}
+	config.SSTableIndexInterval = 10
+	config.SSTableMaxOpenFiles = 500
+	config.SSTableTargetSize = 2097152
+	config.CompactionStrategy = "leveled"
+	config.SizeTieredThreshold = 4
+	config.MemtableThreshold = 0.8
+	config.MaxImmutableMemtables = 2
+	config.TokenTime = 10000000000
+	config.TokenRequests = 3
+	config.CacheSize = 10
+}
+
+// ReadConfig reads configuration file from passed root directory.
+// Parameters that are missing from the file keep their default values.
+func (config *Config) ReadConfig(dir string) error {
+	config.FillDefaults()
+	path := filepath.Join(dir, ConfigFilePath)
+	file, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) || len(file) == 0 {
+		return nil
+	}
+	if err != nil {
+		return storageErrors.NewIO("read", path, err)
+	}
+	return yaml.Unmarshal(file, config)
 }
 
-func (config *Config) ReadConfig() {
-	file, err := ioutil.ReadFile("data/configurationFile/configuration.yaml")
-	if err != nil || len(file) == 0 {
-		config.Lwm = 9
-		config.SegmentSize = 5
-		config.LsmLevels = 5
-		config.LsmLevelMax = 4
-		config.MemtableThreshold = 0.8
-		config.TokenTime = 10000000000
-		config.TokenRequests = 3
-		config.CacheSize = 10
-	} else {
-		err = yaml.Unmarshal(file, config)
-		if err != nil {
-			panic(err)
-		}
+// GetWalPath returns path of wal directory. Relative wal_path
+// is resolved against passed root directory.
+func (config *Config) GetWalPath(dir string) string {
+	if filepath.IsAbs(config.WalPath) {
+		return config.WalPath
 	}
+	return filepath.Join(dir, config.WalPath)
 }
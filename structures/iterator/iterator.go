@@ -0,0 +1,220 @@
+package iterator
+
+import (
+	"napredni/structures/record"
+)
+
+// Iterator walks through live key-value pairs in key order.
+// Seek positions iterator at the first key that is not less than
+// passed key. Key and Value may be called only while Valid is true.
+// Close releases resources and returns the first error that the
+// iterator ran into, since an error also makes the iterator invalid.
+type Iterator interface {
+	SeekToFirst()
+	SeekToLast()
+	Seek(key string)
+	Next()
+	Prev()
+	Valid() bool
+	Key() string
+	Value() []byte
+	Close() error
+}
+
+// RecordIterator walks through records of one source, such as
+// memtable or sstable, in key order. Source holds at most one
+// record per key and deleted keys are returned as tombstones.
+type RecordIterator interface {
+	SeekToFirst()
+	SeekToLast()
+	Seek(key string)
+	Next()
+	Prev()
+	Valid() bool
+	Key() string
+	Record() *record.Record
+	Close() error
+}
+
+// KeyValue is a single pair returned by a scan.
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// MergingIterator merges several record iterators into one Iterator.
+// When more than one source holds the same key, the most recent record
+// wins, and keys whose most recent record is a tombstone are skipped.
+type MergingIterator struct {
+	children []RecordIterator
+	key      string
+	record   *record.Record
+	forward  bool
+}
+
+// NewMergingIterator returns iterator over passed sources.
+func NewMergingIterator(children []RecordIterator) *MergingIterator {
+	return &MergingIterator{children: children, forward: true}
+}
+
+func (it *MergingIterator) SeekToFirst() {
+	for _, child := range it.children {
+		child.SeekToFirst()
+	}
+	it.forward = true
+	it.findSmallest()
+	it.skipDeletedForward()
+}
+
+func (it *MergingIterator) SeekToLast() {
+	for _, child := range it.children {
+		child.SeekToLast()
+	}
+	it.forward = false
+	it.findLargest()
+	it.skipDeletedBackward()
+}
+
+func (it *MergingIterator) Seek(key string) {
+	for _, child := range it.children {
+		child.Seek(key)
+	}
+	it.forward = true
+	it.findSmallest()
+	it.skipDeletedForward()
+}
+
+func (it *MergingIterator) Next() {
+	if !it.forward {
+		// Children are positioned at or before current key,
+		// so they are moved to the first key not less than it.
+		for _, child := range it.children {
+			child.Seek(it.key)
+		}
+		it.forward = true
+	}
+	it.next()
+	it.skipDeletedForward()
+}
+
+func (it *MergingIterator) Prev() {
+	if it.forward {
+		// Children are positioned at or after current key,
+		// so they are moved to the last key less than it.
+		for _, child := range it.children {
+			child.Seek(it.key)
+			if child.Valid() {
+				child.Prev()
+			} else {
+				child.SeekToLast()
+			}
+		}
+		it.forward = false
+		it.findLargest()
+	} else {
+		it.prev()
+	}
+	it.skipDeletedBackward()
+}
+
+func (it *MergingIterator) Valid() bool {
+	return it.record != nil
+}
+
+func (it *MergingIterator) Key() string {
+	return it.key
+}
+
+func (it *MergingIterator) Value() []byte {
+	return it.record.Value
+}
+
+// Record returns the most recent record for current key.
+func (it *MergingIterator) Record() *record.Record {
+	return it.record
+}
+
+// Close closes all sources and returns the first error.
+func (it *MergingIterator) Close() error {
+	var firstErr error
+	for _, child := range it.children {
+		err := child.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	it.record = nil
+	return firstErr
+}
+
+// next moves every source positioned at current key past it.
+func (it *MergingIterator) next() {
+	for _, child := range it.children {
+		if child.Valid() && child.Key() == it.key {
+			child.Next()
+		}
+	}
+	it.findSmallest()
+}
+
+// prev moves every source positioned at current key before it.
+func (it *MergingIterator) prev() {
+	for _, child := range it.children {
+		if child.Valid() && child.Key() == it.key {
+			child.Prev()
+		}
+	}
+	it.findLargest()
+}
+
+func (it *MergingIterator) skipDeletedForward() {
+	for it.record != nil && it.record.Tombstone == 1 {
+		it.next()
+	}
+}
+
+func (it *MergingIterator) skipDeletedBackward() {
+	for it.record != nil && it.record.Tombstone == 1 {
+		it.prev()
+	}
+}
+
+// findSmallest sets current key to the smallest key among sources.
+func (it *MergingIterator) findSmallest() {
+	it.record = nil
+	for _, child := range it.children {
+		if child.Valid() && (it.record == nil || child.Key() < it.key) {
+			it.key = child.Key()
+			it.record = child.Record()
+		}
+	}
+	it.pickMostRecent()
+}
+
+// findLargest sets current key to the largest key among sources.
+func (it *MergingIterator) findLargest() {
+	it.record = nil
+	for _, child := range it.children {
+		if child.Valid() && (it.record == nil || child.Key() > it.key) {
+			it.key = child.Key()
+			it.record = child.Record()
+		}
+	}
+	it.pickMostRecent()
+}
+
+// pickMostRecent sets current record to the most recent
+// record of current key among all sources.
+func (it *MergingIterator) pickMostRecent() {
+	if it.record == nil {
+		return
+	}
+	for _, child := range it.children {
+		if child.Valid() && child.Key() == it.key {
+			rec := child.Record()
+			if rec.IsNewerThan(it.record) {
+				it.record = rec
+			}
+		}
+	}
+}
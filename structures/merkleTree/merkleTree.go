@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"crypto/sha1"
 	"encoding/hex"
+	"io"
 	"io/ioutil"
+	"napredni/structures/storageErrors"
 	"os"
 	"strings"
 )
@@ -98,15 +100,23 @@ func (merkle *MerkleTree) BuildTree(row []*Node) []*Node {
 	}
 }
 
-func (merkle *MerkleTree) Serialize(merkleFilePath string) {
+func (merkle *MerkleTree) Serialize(merkleFilePath string) error {
 	file, err := os.OpenFile(merkleFilePath, os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
-		panic(err)
+		return storageErrors.NewIO("open", merkleFilePath, err)
 	}
 	defer file.Close()
 
 	writer := bufio.NewWriter(file)
+	err = merkle.SerializeTo(writer)
+	if err != nil {
+		return storageErrors.NewIO("write", merkleFilePath, err)
+	}
+	return storageErrors.NewIO("write", merkleFilePath, writer.Flush())
+}
 
+// SerializeTo writes hashes of all nodes to passed writer, level by level.
+func (merkle *MerkleTree) SerializeTo(writer io.Writer) error {
 	queue := make([]*Node, 0, 1)
 	queue = append(queue, merkle.root)
 
@@ -123,22 +133,23 @@ func (merkle *MerkleTree) Serialize(merkleFilePath string) {
 
 		_, err := writer.Write([]byte(node.String() + ";"))
 		if err != nil {
-			panic(err)
+			return err
 		}
 	}
-	writer.Flush()
+	return nil
 }
 
-func (merkle *MerkleTree) Deserialize(merkleFilePath string) {
+func (merkle *MerkleTree) Deserialize(merkleFilePath string) error {
 
 	file, err := os.OpenFile(merkleFilePath, os.O_RDONLY, 0666)
 	if err != nil {
-		panic(err)
+		return storageErrors.NewIO("open", merkleFilePath, err)
 	}
 
 	allData, err := ioutil.ReadAll(file)
 	if err != nil {
-		panic(err)
+		file.Close()
+		return storageErrors.NewIO("read", merkleFilePath, err)
 	}
 
 	strHashes := strings.Split(string(allData), ";")
@@ -149,7 +160,10 @@ func (merkle *MerkleTree) Deserialize(merkleFilePath string) {
 	nodes := make([]Node, len(strHashes), len(strHashes))
 
 	for i := 0; i < len(strHashes); i++ {
-		decoded, _ := hex.DecodeString(strHashes[i])
+		decoded, err := hex.DecodeString(strHashes[i])
+		if err != nil || len(decoded) != 20 {
+			return storageErrors.NewCorruption(merkleFilePath, int64(i*41), "invalid hash")
+		}
 
 		var newData [20]byte
 		for j := 0; j < 20; j++ {
@@ -165,7 +179,7 @@ func (merkle *MerkleTree) Deserialize(merkleFilePath string) {
 
 	if len(nodes) == 0 {
 		merkle.root = nil
-		return
+		return nil
 	}
 
 	queue := make([]*Node, 0, 1)
@@ -192,6 +206,7 @@ func (merkle *MerkleTree) Deserialize(merkleFilePath string) {
 		i++
 		queue = append(queue, node.right)
 	}
+	return nil
 }
 
 //func main() {
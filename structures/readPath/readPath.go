@@ -3,63 +3,106 @@ package readPath
 import (
 	"napredni/structures/LRU"
 	"napredni/structures/LSM"
-	"napredni/structures/WAL"
-	"napredni/structures/bloomFilter"
+	"napredni/structures/Memtable"
 	"napredni/structures/record"
+	"napredni/structures/storageErrors"
 )
 
-func Get(cache *LRU.CacheLRU, lsm *LSM.LSM, key string) (bool, []byte){
-	found, value:=lsm.MemTable.GetRecord(key)
+// Get returns value for passed key. If there is no live value
+// for the key, storageErrors.ErrNotFound is returned.
+func Get(cache *LRU.ShardedCache, lsm *LSM.LSM, key string) ([]byte, error){
+	// Value that is read is cached only if the key wasn't
+	// removed from the cache by a write in the meantime.
+	generation := cache.Generation(key)
+	mem, version := lsm.Acquire()
+	defer version.Release()
+	found, value:=getFromMemTables(&mem, version, key, record.MaxSeqNum)
 	if found {
-		cache.Add(key, value)
-		return true, value
+		cache.AddIfGeneration(key, value, generation)
+		return value, nil
 	}else{
 		if value!=nil{
-			return false,nil
+			return nil, storageErrors.ErrNotFound
 		}
 	}
 	found, value = cache.Get(key)
 	if found{
-		return true, value
+		return value, nil
 	}
 
+	mostRecentRecord, found, err := getFromSSTables(lsm, version, key, record.MaxSeqNum)
+	if err != nil {
+		return nil, err
+	}
+	if found && mostRecentRecord.Tombstone == 0 {
+		cache.AddIfGeneration(mostRecentRecord.Key, mostRecentRecord.Value, generation)
+		return mostRecentRecord.Value, nil
+	}
+
+	return nil, storageErrors.ErrNotFound
+}
+
+// GetAt returns value that passed key had at passed sequence number.
+// Cache is not used, since it keeps only the newest values.
+func GetAt(lsm *LSM.LSM, key string, seqNum uint64) ([]byte, error) {
+	mem, version := lsm.Acquire()
+	defer version.Release()
+	found, value := getFromMemTables(&mem, version, key, seqNum)
+	if found {
+		return value, nil
+	}
+	if value != nil {
+		return nil, storageErrors.ErrNotFound
+	}
+
+	mostRecentRecord, found, err := getFromSSTables(lsm, version, key, seqNum)
+	if err != nil {
+		return nil, err
+	}
+	if found && mostRecentRecord.Tombstone == 0 {
+		return mostRecentRecord.Value, nil
+	}
+	return nil, storageErrors.ErrNotFound
+}
+
+// getFromMemTables looks for passed key in the memtable and then in immutable
+// memtables, from the newest one. It returns the same as MemTable.GetRecordAt
+// for the first memtable that has a version of the key visible at seqNum.
+func getFromMemTables(mem *Memtable.MemTable, version *LSM.Version, key string, seqNum uint64) (bool, []byte) {
+	found, value := mem.GetRecordAt(key, seqNum)
+	for i := len(version.Immutables) - 1; i >= 0 && !found && value == nil; i-- {
+		found, value = version.Immutables[i].GetRecordAt(key, seqNum)
+	}
+	return found, value
+}
+
+// getFromSSTables returns the most recent record for passed key from all
+// sstables whose key range holds it, ignoring versions newer than passed
+// sequence number.
+func getFromSSTables(lsm *LSM.LSM, version *LSM.Version, key string, seqNum uint64) (record.Record, bool, error) {
 	mostRecentRecord := record.Record{}
 	var foundInSSTable bool
-	for i:=0;i<int(lsm.MaxNumOfLvl);i++{
-		for j:=0;j<len(lsm.Levels[i]);j++{
-			bfPath := lsm.Levels[i][j].FilterFilePath
-			bFilter := bloomFilter.BloomFilter{} //parametri
-			// bFilter := bloomFilter.createBloomFilter(100, 0.01)
-			bFilter.DecodeBloomFilter(bfPath)
-			found = bFilter.FindData(key)
-			if !found {
+	for i:=0;i<len(version.Levels);i++{
+		for j:=len(version.Levels[i])-1;j>=0;j--{
+			// With leveled compaction tables of levels after the first
+			// one don't overlap, so at most one table of such level is read.
+			if key < version.Levels[i][j].MinKey || key > version.Levels[i][j].MaxKey {
 				continue
 			}
 
-			tmpRecord, found := lsm.Levels[i][j].GetRecordInSStableForKey(key)
+			tmpRecord, found, err := lsm.Tables.GetRecordAt(&version.Levels[i][j], key, seqNum)
+			if err != nil {
+				return record.Record{}, false, err
+			}
 			if !found {
 				continue
 			}
 
-			if tmpRecord.Timestamp > mostRecentRecord.Timestamp {
+			if !foundInSSTable || tmpRecord.IsNewerThan(&mostRecentRecord) {
 				foundInSSTable = true
 				mostRecentRecord = *tmpRecord
 			}
 		}
 	}
-	if found || foundInSSTable{
-		if mostRecentRecord.Tombstone ==1 {
-			return false, nil
-
-		} else {
-			if WAL.CRC32(mostRecentRecord.Value) != mostRecentRecord.Crc {
-				panic("CRC is not compatible!")
-				return false, nil //?
-			}
-			cache.Add(mostRecentRecord.Key, mostRecentRecord.Value)
-			return true, mostRecentRecord.Value
-		}
-	}
-
-	return false, nil
+	return mostRecentRecord, foundInSSTable, nil
 }
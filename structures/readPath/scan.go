@@ -0,0 +1,92 @@
+package readPath
+
+import (
+	"napredni/structures/LSM"
+	"napredni/structures/iterator"
+	"napredni/structures/record"
+)
+
+// NewIterator returns iterator over live records from the memtable,
+// immutable memtables and all sstables in lsm. Sources are ordered from
+// the newest to the oldest: memtable first, then immutable memtables,
+// then levels from the first one, and inside of a level the most
+// recently added sstable first.
+func NewIterator(lsm *LSM.LSM) (*iterator.MergingIterator, error) {
+	return NewIteratorAt(lsm, record.MaxSeqNum)
+}
+
+// NewIteratorAt works like NewIterator, but ignores
+// versions newer than passed sequence number.
+func NewIteratorAt(lsm *LSM.LSM, seqNum uint64) (*iterator.MergingIterator, error) {
+	// Sstable iterators keep their data files open and index in memory,
+	// so the version is needed only while they are created.
+	mem, version := lsm.Acquire()
+	defer version.Release()
+	children := make([]iterator.RecordIterator, 0)
+	children = append(children, mem.NewIteratorAt(seqNum))
+	for i := len(version.Immutables) - 1; i >= 0; i-- {
+		children = append(children, version.Immutables[i].NewIteratorAt(seqNum))
+	}
+	for i := 0; i < len(version.Levels); i++ {
+		for j := len(version.Levels[i]) - 1; j >= 0; j-- {
+			sstable := version.Levels[i][j]
+			sstableIterator, err := sstable.NewIteratorAt(seqNum)
+			if err != nil {
+				iterator.NewMergingIterator(children).Close()
+				return nil, err
+			}
+			children = append(children, sstableIterator)
+		}
+	}
+	return iterator.NewMergingIterator(children), nil
+}
+
+// Scan returns live pairs whose keys are in range [start, end) in key
+// order. Empty end means that range has no upper bound, and limit that
+// is not positive means that number of returned pairs is not limited.
+func Scan(lsm *LSM.LSM, start, end string, limit int) ([]iterator.KeyValue, error) {
+	return ScanAt(lsm, start, end, limit, record.MaxSeqNum)
+}
+
+// ScanAt works like Scan, but ignores versions newer than passed sequence number.
+func ScanAt(lsm *LSM.LSM, start, end string, limit int, seqNum uint64) ([]iterator.KeyValue, error) {
+	it, err := NewIteratorAt(lsm, seqNum)
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := make([]iterator.KeyValue, 0)
+	for it.Seek(start); it.Valid(); it.Next() {
+		if end != "" && it.Key() >= end {
+			break
+		}
+		if limit > 0 && len(pairs) == limit {
+			break
+		}
+		pairs = append(pairs, iterator.KeyValue{Key: it.Key(), Value: it.Value()})
+	}
+
+	err = it.Close()
+	if err != nil {
+		return nil, err
+	}
+	return pairs, nil
+}
+
+// PrefixScan returns all live pairs whose keys start with prefix, in key order.
+func PrefixScan(lsm *LSM.LSM, prefix string) ([]iterator.KeyValue, error) {
+	return Scan(lsm, prefix, prefixEnd(prefix), 0)
+}
+
+// prefixEnd returns the smallest key that is greater than every key
+// with passed prefix, or empty string if there is no such key.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
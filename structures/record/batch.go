@@ -0,0 +1,49 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+)
+
+// BatchTombstone is tombstone value of a record whose value holds
+// encoded records of a whole write batch. Crc of such record covers
+// every record of the batch, so the batch is either read whole or not at all.
+const BatchTombstone = 2
+
+// CreateBatchRecord returns a single record that holds all passed records.
+func CreateBatchRecord(records []Record) *Record {
+	value := make([]byte, 0)
+	for _, rec := range records {
+		value = append(value, rec.EncodeRecord()...)
+	}
+	return CreateRecord("", value, BatchTombstone)
+}
+
+// IsBatch returns true if record holds a write batch.
+func (record *Record) IsBatch() bool {
+	return record.Tombstone == BatchTombstone
+}
+
+// DecodeBatch returns records that are held by a batch record.
+func (record *Record) DecodeBatch() ([]Record, error) {
+	if !record.IsBatch() {
+		return nil, errors.New("record is not a batch")
+	}
+	reader := bufio.NewReader(bytes.NewReader(record.Value))
+	records := make([]Record, 0)
+	for {
+		rec := Record{}
+		eof, err := rec.DecodeRecord(reader)
+		if err != nil {
+			return nil, err
+		}
+		if eof {
+			return records, nil
+		}
+		if !rec.CheckCrc() {
+			return nil, errors.New("crc mismatch in batch")
+		}
+		records = append(records, rec)
+	}
+}
@@ -4,15 +4,44 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"math"
 	"time"
 )
 
+// MaxSeqNum is a sequence number that sees every version of a key.
+const MaxSeqNum = math.MaxUint64
+
+// Format is layout of encoded records. Records don't hold their format,
+// so files that hold records record it.
+type Format byte
+
+const (
+	// FormatBaseline is layout of records written before sequence numbers
+	// were added, whose crc covers only the value. Timestamp of such record
+	// is used as its sequence number.
+	FormatBaseline Format = iota
+	// FormatSeqNum holds sequence number after the timestamp,
+	// and its crc covers every other field of the record.
+	FormatSeqNum
+)
+
+// ErrUnsupportedFormat is returned for records in a format that is not known,
+// e.g. one written by a newer version.
+var ErrUnsupportedFormat = errors.New("unsupported record format")
+
+// Record is a single version of a key. Versions of the same key are
+// ordered by SeqNum, which is assigned by the wal when the record is
+// appended to it, while Timestamp only keeps wall-clock time of the write.
+// Crc covers every other field of the encoded record, and it is set
+// again whenever the record is encoded.
 type Record struct {
 	Crc       uint32
 	Timestamp int64
+	SeqNum    uint64
 	Tombstone uint8
 	KeySize   uint64
 	ValueSize uint64
@@ -21,27 +50,51 @@ type Record struct {
 }
 
 func CreateRecord(key string, value []byte, delete byte) *Record {
-	crc := CRC32(value)
 	timestamp := time.Now().Unix()
 	tombstone := delete
 	keySize := uint64(len([]byte(key)))
 	valueSize := uint64(len(value))
-	return &Record{crc, timestamp, tombstone, keySize, valueSize, key, value}
+	record := &Record{0, timestamp, 0, tombstone, keySize, valueSize, key, value}
+	record.EncodeRecord()
+	return record
 }
 
 func CRC32(data []byte) uint32 {
 	return crc32.ChecksumIEEE(data)
 }
 
+// CheckCrc returns true if stored crc matches the rest of the record.
+func (record *Record) CheckCrc() bool {
+	return record.Crc == binary.LittleEndian.Uint32(record.encode())
+}
+
 func (record *Record) GetSize() uint64 {
-	return 4 + 8 + 1 + 8 + 8 + record.KeySize + record.ValueSize
+	return 4 + 8 + 8 + 1 + 8 + 8 + record.KeySize + record.ValueSize
 }
 
+// GetSizeIn returns size of the record encoded in passed format.
+func (record *Record) GetSizeIn(format Format) uint64 {
+	if format == FormatBaseline {
+		return record.GetSize() - 8
+	}
+	return record.GetSize()
+}
+
+// EncodeRecord returns the record encoded as it is written to files.
+// Crc is calculated over the encoded record without the crc itself.
 func (record *Record) EncodeRecord() []byte {
+	recordBytes := record.encode()
+	if recordBytes != nil {
+		record.Crc = binary.LittleEndian.Uint32(recordBytes)
+	}
+	return recordBytes
+}
+
+func (record *Record) encode() []byte {
 	recordBytes := make([]byte, 0, record.GetSize())
 	w := bytes.NewBuffer(recordBytes)
 
-	err := binary.Write(w, binary.LittleEndian, record.Crc)
+	err := binary.Write(w, binary.LittleEndian, uint32(0))
 	if err != nil {
 		return nil
 	}
@@ -51,6 +104,11 @@ func (record *Record) EncodeRecord() []byte {
 		return nil
 	}
 
+	err = binary.Write(w, binary.LittleEndian, record.SeqNum)
+	if err != nil {
+		return nil
+	}
+
 	err = binary.Write(w, binary.LittleEndian, record.Tombstone)
 	if err != nil {
 		return nil
@@ -76,78 +134,116 @@ func (record *Record) EncodeRecord() []byte {
 		return nil
 	}
 
-	return w.Bytes()
+	recordBytes = w.Bytes()
+	binary.LittleEndian.PutUint32(recordBytes, CRC32(recordBytes[4:]))
+	return recordBytes
+}
+
+// DecodeRecord reads a record from reader. It returns true if reader
+// is at the end, and io.ErrUnexpectedEOF if a record is cut off.
+func (record *Record) DecodeRecord(reader *bufio.Reader) (bool, error) {
+	return record.Decode(reader, FormatSeqNum)
 }
 
-func (record *Record) DecodeRecord(reader *bufio.Reader) bool {
+// Decode reads a record in passed format from reader. Crc of a record in
+// baseline format is checked while it is read, and then it is set as in
+// the current format, so records of both formats are used the same way.
+func (record *Record) Decode(reader *bufio.Reader, format Format) (bool, error) {
+	if format != FormatBaseline && format != FormatSeqNum {
+		return false, ErrUnsupportedFormat
+	}
 	err := binary.Read(reader, binary.LittleEndian, &record.Crc)
 	if err != nil {
 		if err == io.EOF {
-			return true
+			return true, nil
 		}
-		panic(err)
+		return false, err
 	}
 
 	err = binary.Read(reader, binary.LittleEndian, &record.Timestamp)
 	if err != nil {
-		if err == io.EOF {
-			return true
+		return false, unexpectedEOF(err)
+	}
+
+	record.SeqNum = uint64(record.Timestamp)
+	if format != FormatBaseline {
+		err = binary.Read(reader, binary.LittleEndian, &record.SeqNum)
+		if err != nil {
+			return false, unexpectedEOF(err)
 		}
-		panic(err)
 	}
 
 	err = binary.Read(reader, binary.LittleEndian, &record.Tombstone)
 	if err != nil {
-		if err == io.EOF {
-			return true
-		}
-		panic(err)
+		return false, unexpectedEOF(err)
 	}
 
 	err = binary.Read(reader, binary.LittleEndian, &record.KeySize)
 	if err != nil {
-		if err == io.EOF {
-			return true
-		}
-		panic(err)
+		return false, unexpectedEOF(err)
 	}
 
 	err = binary.Read(reader, binary.LittleEndian, &record.ValueSize)
 	if err != nil {
-		if err == io.EOF {
-			return true
-		}
-		panic(err)
+		return false, unexpectedEOF(err)
 	}
 
-	keyByteSlice := make([]byte, record.KeySize)
-	err = binary.Read(reader, binary.LittleEndian, &keyByteSlice)
+	keyByteSlice, err := readBytes(reader, record.KeySize)
 	if err != nil {
-		if err == io.EOF {
-			return true
-		}
-		panic(err)
+		return false, err
 	}
 	record.Key = string(keyByteSlice)
 
-	record.Value = make([]byte, record.ValueSize)
-	err = binary.Read(reader, binary.LittleEndian, &record.Value)
+	record.Value, err = readBytes(reader, record.ValueSize)
 	if err != nil {
-		if err == io.EOF {
-			return true
+		return false, err
+	}
+
+	if format == FormatBaseline {
+		if record.Crc != CRC32(record.Value) {
+			return false, errors.New("crc mismatch")
 		}
-		panic(err)
+		record.EncodeRecord()
 	}
+	return false, nil
+}
+
+// readBytes reads passed number of bytes. Memory grows while bytes
+// are read, so a size damaged by a torn write can't exhaust it.
+func readBytes(reader io.Reader, size uint64) ([]byte, error) {
+	if size > math.MaxInt64 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, int64(size)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) != size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data, nil
+}
 
-	return false
+// IsNewerThan returns true if record is a more recent version than other.
+func (record *Record) IsNewerThan(other *Record) bool {
+	return record.SeqNum > other.SeqNum
 }
 
 func (record *Record) Print() {
 	fmt.Println("Crc:", record.Crc)
 	fmt.Println("TimeStamp:", record.Timestamp)
+	fmt.Println("Sequence number:", record.SeqNum)
 	fmt.Println("Tombstone:", record.Tombstone)
 	fmt.Println("Key size:", record.KeySize)
 	fmt.Println("Value size:", record.ValueSize)
 	fmt.Println("Key:", record.Key)
 	fmt.Println("Value:", record.Value)
 }
+
+// unexpectedEOF turns io.EOF in the middle of a record into io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
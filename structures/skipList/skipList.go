@@ -4,150 +4,271 @@ import (
 	"fmt"
 	"math/rand"
 	"napredni/structures/record"
+	"sync/atomic"
 )
 
+// MaxLevel is the greatest level that an element can have.
+const MaxLevel = 32
+
+// Element holds the newest version of a key and older versions that
+// are still needed. Links and state of an element are read atomically,
+// so readers don't need a lock while the only writer changes the list.
 type Element struct {
 	Level int
-	Rec       record.Record
-	Next      []*Element
-	Prev      []*Element
-	Tombstone bool
+	key   string
+	next  []atomic.Pointer[Element]
+	state atomic.Pointer[elementState]
+}
+
+// elementState is replaced as a whole on every change,
+// so readers never see a half updated element.
+type elementState struct {
+	rec       record.Record
+	tombstone bool
+	// versions are older versions of the key, from the newest to the oldest.
+	versions []record.Record
 }
 
+// SkipList is safe for one writer and any number of concurrent readers.
+// Writes must be serialized by the caller, while reads take no locks.
 type SkipList struct {
-	Begin    Element
-	Elements []Element
+	Begin  Element
+	height atomic.Int32
+	size   atomic.Int64
 }
 
-func (sl *SkipList) PrintSL() {
+// New returns an empty skip list.
+func New() *SkipList {
+	sl := &SkipList{}
+	sl.Begin.Level = MaxLevel
+	sl.Begin.next = make([]atomic.Pointer[Element], MaxLevel)
+	sl.height.Store(1)
+	return sl
+}
 
-	for i := len(sl.Begin.Next) - 1; i >= 0; i-- {
-		fmt.Print(sl.Begin.Next[i])
+// Len returns number of elements in the list.
+func (sl *SkipList) Len() int {
+	return int(sl.size.Load())
+}
+
+func (sl *SkipList) PrintSL() {
+	for i := int(sl.height.Load()) - 1; i >= 0; i-- {
+		fmt.Print(i)
 		fmt.Print("\t")
-		for j := 0; j < len(sl.Elements); j++ {
-			if len(sl.Elements[j].Next) <= i {
+		for el := sl.First(); el != nil; el = el.Next() {
+			if el.Level <= i {
 				fmt.Print("\t/\t")
 			} else {
-				if sl.Elements[j].Next[i] == nil {
-					fmt.Print("\tnull\t")
-				} else {
-					fmt.Print(sl.Elements[j].Next[i])
-					fmt.Print("\t")
-				}
+				fmt.Print(el.key)
+				fmt.Print("\t")
 			}
 		}
 		fmt.Print("\n")
 	}
-	fmt.Print("/\t")
-	for j := 0; j < len(sl.Elements); j++ {
-		fmt.Print(sl.Elements[j].Rec.Key)
-		fmt.Print("\t")
-	}}
+}
 
 func (sl *SkipList) AddEl(r record.Record, tombstone bool) {
-	var found, path = sl.FindEl(r.Key)
-	if found {
-		var el = path[len(path)-1]
-		el.Rec.Value = r.Value
-		el.Tombstone = false
+	var prevs, el = sl.findPrevs(r.Key)
+	if el != nil {
+		el.update(r, tombstone)
 		return
 	}
 
-	//refill
-	for {
-		if len(path) < len(sl.Begin.Next) {
-			path = append(path, path[len(path)-1])
-		} else {
-			break
-		}
+	var Level = calcLevel()
+	var height = int(sl.height.Load())
+	for i := height; i < Level; i++ {
+		prevs[i] = &sl.Begin
 	}
-
-	//reverse
-	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
-		path[i], path[j] = path[j], path[i]
+	el = &Element{
+		Level: Level,
+		key:   r.Key,
+		next:  make([]atomic.Pointer[Element], Level),
 	}
-	var Level = calcLevel()
-	var max = len(sl.Begin.Next)
-	var el = Element{
-		Level:     Level,
-		Rec:       r,
-		Next:      nil,
-		Prev:      nil,
-		Tombstone: tombstone,
-	}
-
-	for i := 0; i < min(max, Level); i++ {
-		el.Next = append(el.Next, path[i].Next[i])
-		el.Prev = append(el.Prev, path[i])
-		if path[i].Next[i] != nil {
-			path[i].Next[i].Prev[i] = &el
-		}
-		path[i].Next[i] = &el
+	el.state.Store(&elementState{rec: r, tombstone: tombstone})
+
+	// Element is linked from the lowest level, so a reader that finds
+	// it on some level can always go on from it on lower levels.
+	for i := 0; i < Level; i++ {
+		el.next[i].Store(prevs[i].next[i].Load())
+		prevs[i].next[i].Store(el)
 	}
-	for i := max; i < Level; i++ {
-		el.Next = append(el.Next, nil)
-		el.Prev = append(el.Prev, &sl.Begin)
-		sl.Begin.Next = append(sl.Begin.Next, &el)
+	if Level > height {
+		sl.height.Store(int32(Level))
 	}
-	sl.Begin.Level = len(sl.Begin.Next)
-	sl.Elements = append(sl.Elements, el)
+	sl.size.Add(1)
 }
 
 func (sl *SkipList) UpdateEl(r record.Record) {
 	sl.AddEl(r, false)
 }
 
-func (sl *SkipList) FindEl(k string) (found bool, path []*Element) {
-
-	if len(sl.Elements) == 0 {
+// FindEl returns element with key k, if it exists.
+func (sl *SkipList) FindEl(k string) (found bool, el *Element) {
+	el = sl.FindFirstGreaterOrEqual(k)
+	if el == nil || el.key != k {
 		return false, nil
 	}
+	return true, el
+}
+
+// findPrevs returns the last element before key k on every level,
+// and element with key k if it exists.
+func (sl *SkipList) findPrevs(k string) (prevs [MaxLevel]*Element, el *Element) {
 	var current = &sl.Begin
-	for i := len(sl.Begin.Next) - 1; i >= 0; i-- {
+	for i := int(sl.height.Load()) - 1; i >= 0; i-- {
 		for {
-			if current.Next[i] != nil {
-				if current.Next[i].Rec.Key == k {
-					path = append(path, current)
-					current = current.Next[i]
-					path = append(path, current)
-					return true, path
-				}
-				if current.Next[i].Rec.Key > k {
-					break
-				}
-				current = current.Next[i]
-			} else {
+			next := current.next[i].Load()
+			if next == nil || next.key >= k {
+				break
+			}
+			current = next
+		}
+		prevs[i] = current
+	}
+	next := current.next[0].Load()
+	if next != nil && next.key == k {
+		return prevs, next
+	}
+	return prevs, nil
+}
+
+// FindFirstGreaterOrEqual returns first element whose key
+// is not less than k, or nil if there is no such element.
+func (sl *SkipList) FindFirstGreaterOrEqual(k string) *Element {
+	var current = &sl.Begin
+	for i := int(sl.height.Load()) - 1; i >= 0; i-- {
+		for {
+			next := current.next[i].Load()
+			if next == nil || next.key >= k {
 				break
 			}
+			current = next
 		}
-		path = append(path, current)
 	}
-	return false, path
+	return current.next[0].Load()
+}
+
+// First returns element with the smallest key, or nil if list is empty.
+func (sl *SkipList) First() *Element {
+	return sl.Begin.next[0].Load()
+}
+
+// Last returns element with the greatest key, or nil if list is empty.
+func (sl *SkipList) Last() *Element {
+	var current = &sl.Begin
+	for i := int(sl.height.Load()) - 1; i >= 0; i-- {
+		for next := current.next[i].Load(); next != nil; next = current.next[i].Load() {
+			current = next
+		}
+	}
+	if current == &sl.Begin {
+		return nil
+	}
+	return current
+}
+
+// Previous returns the last element whose key is less than key
+// of passed element, or nil if passed element is the first one.
+func (sl *SkipList) Previous(el *Element) *Element {
+	var current = &sl.Begin
+	for i := int(sl.height.Load()) - 1; i >= 0; i-- {
+		for {
+			next := current.next[i].Load()
+			if next == nil || next.key >= el.key {
+				break
+			}
+			current = next
+		}
+	}
+	if current == &sl.Begin {
+		return nil
+	}
+	return current
 }
 
 func (sl *SkipList) DeleteEl(r record.Record) bool {
-	var found, path = sl.FindEl(r.Key)
+	var found, el = sl.FindEl(r.Key)
 	if !found {
 		sl.AddEl(r, true)
 		return false
 	}
-	var el = path[len(path)-1]
-	el.Tombstone = true
+	el.update(r, true)
 	return true
 }
 
-func min(a, b int) int {
-	if a < b {
-		return a
+// update replaces record of the element with passed record, unless the
+// element already holds a newer one. Replaced record is kept as an older
+// version, until it is pruned with SetVersions.
+func (el *Element) update(r record.Record, tombstone bool) {
+	old := el.state.Load()
+	if old.rec.IsNewerThan(&r) {
+		return
 	}
-	return b
+	versions := old.versions
+	if r.IsNewerThan(&old.rec) {
+		oldRec := old.rec
+		if old.tombstone {
+			oldRec.Tombstone = 1
+		}
+		versions = append([]record.Record{oldRec}, old.versions...)
+	}
+	el.state.Store(&elementState{rec: r, tombstone: tombstone, versions: versions})
+}
+
+// Next returns the next element on the lowest level, or nil.
+func (el *Element) Next() *Element {
+	return el.next[0].Load()
+}
+
+func (el *Element) Key() string {
+	return el.key
+}
+
+// Record returns the newest version of the element.
+func (el *Element) Record() record.Record {
+	return el.state.Load().rec
+}
+
+// IsDeleted returns true if the newest version of the element is a deletion.
+func (el *Element) IsDeleted() bool {
+	return el.state.Load().tombstone
+}
+
+// Versions returns older versions of the element, from the newest to the oldest.
+func (el *Element) Versions() []record.Record {
+	return el.state.Load().versions
+}
+
+// SetVersions replaces older versions of the element with passed ones.
+func (el *Element) SetVersions(versions []record.Record) {
+	old := el.state.Load()
+	el.state.Store(&elementState{rec: old.rec, tombstone: old.tombstone, versions: versions})
+}
+
+// VersionAt returns the newest version of the element that is not newer
+// than passed sequence number, and false if there is no such version.
+func (el *Element) VersionAt(seqNum uint64) (record.Record, bool) {
+	state := el.state.Load()
+	if state.rec.SeqNum <= seqNum {
+		rec := state.rec
+		if state.tombstone {
+			rec.Tombstone = 1
+		}
+		return rec, true
+	}
+	for _, version := range state.versions {
+		if version.SeqNum <= seqNum {
+			return version, true
+		}
+	}
+	return record.Record{}, false
 }
 
 func calcLevel() (Level int) {
 	Level = 1
 	var x = rand.Intn(2)
 	for {
-		if x == 1 {
+		if x == 1 && Level < MaxLevel {
 			Level += 1
 			x = rand.Intn(2)
 		} else {
@@ -155,4 +276,4 @@ func calcLevel() (Level int) {
 		}
 	}
 	return Level
-}
\ No newline at end of file
+}
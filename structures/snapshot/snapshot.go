@@ -0,0 +1,73 @@
+package snapshot
+
+import (
+	"napredni/structures/record"
+	"sort"
+	"sync"
+)
+
+// List keeps sequence numbers pinned by live snapshots. A snapshot
+// sees only versions whose sequence number is not greater than the
+// pinned one, so those versions must not be dropped while it is alive.
+// List is safe for concurrent use, since compaction reads it in the background.
+type List struct {
+	mutex   sync.Mutex
+	seqNums map[uint64]int
+}
+
+func NewList() *List {
+	return &List{seqNums: make(map[uint64]int)}
+}
+
+// Acquire pins passed sequence number.
+func (list *List) Acquire(seqNum uint64) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	list.seqNums[seqNum]++
+}
+
+// Release unpins sequence number pinned by Acquire.
+func (list *List) Release(seqNum uint64) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	list.seqNums[seqNum]--
+	if list.seqNums[seqNum] <= 0 {
+		delete(list.seqNums, seqNum)
+	}
+}
+
+// SeqNums returns pinned sequence numbers in ascending order.
+func (list *List) SeqNums() []uint64 {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	seqNums := make([]uint64, 0, len(list.seqNums))
+	for seqNum := range list.seqNums {
+		seqNums = append(seqNums, seqNum)
+	}
+	sort.Slice(seqNums, func(i, j int) bool {
+		return seqNums[i] < seqNums[j]
+	})
+	return seqNums
+}
+
+// KeepVersions returns versions of a single key that must be kept: the
+// newest one and the newest one visible to each live snapshot. Versions
+// must be ordered from the newest to the oldest.
+func (list *List) KeepVersions(versions []record.Record) []record.Record {
+	if len(versions) <= 1 {
+		return versions
+	}
+	seqNums := list.SeqNums()
+	kept := []record.Record{versions[0]}
+	for i := 1; i < len(versions); i++ {
+		// Version is visible to snapshots that are not older than
+		// it and older than the version that replaced it.
+		j := sort.Search(len(seqNums), func(j int) bool {
+			return seqNums[j] >= versions[i].SeqNum
+		})
+		if j < len(seqNums) && seqNums[j] < versions[i-1].SeqNum {
+			kept = append(kept, versions[i])
+		}
+	}
+	return kept
+}
@@ -0,0 +1,72 @@
+package storageErrors
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotFound is returned when there is no live value for a key.
+	ErrNotFound = errors.New("key not found")
+	// ErrCorruption is matched by every CorruptionError.
+	ErrCorruption = errors.New("data corruption")
+	// ErrIO is matched by every IOError.
+	ErrIO = errors.New("i/o error")
+	// ErrClosed is returned when a closed engine or a released snapshot is used.
+	ErrClosed = errors.New("engine is closed")
+	// ErrLocked is returned when a store is already opened by another engine.
+	ErrLocked = errors.New("store is locked by another engine")
+)
+
+// CorruptionError describes data on disk that can't be decoded
+// or doesn't match its checksum. File and Offset point to the
+// place where corrupted data starts, so the file can be quarantined.
+type CorruptionError struct {
+	File   string
+	Offset int64
+	Reason string
+}
+
+// NewCorruption returns CorruptionError for passed file, offset and reason.
+func NewCorruption(file string, offset int64, reason string) error {
+	return &CorruptionError{File: file, Offset: offset, Reason: reason}
+}
+
+func (err *CorruptionError) Error() string {
+	return fmt.Sprintf("%v: %s at offset %d: %s", ErrCorruption, err.File, err.Offset, err.Reason)
+}
+
+// Is makes errors.Is(err, ErrCorruption) true for CorruptionError.
+func (err *CorruptionError) Is(target error) bool {
+	return target == ErrCorruption
+}
+
+// IOError wraps an error returned by the file system
+// together with the operation and path that caused it.
+type IOError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+// NewIO returns IOError for passed operation, path and cause.
+// If cause is nil, nil is returned.
+func NewIO(op string, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &IOError{Op: op, Path: path, Err: err}
+}
+
+func (err *IOError) Error() string {
+	return fmt.Sprintf("%v: %s %s: %v", ErrIO, err.Op, err.Path, err.Err)
+}
+
+// Is makes errors.Is(err, ErrIO) true for IOError.
+func (err *IOError) Is(target error) bool {
+	return target == ErrIO
+}
+
+func (err *IOError) Unwrap() error {
+	return err.Err
+}
@@ -0,0 +1,194 @@
+package writePath
+
+import (
+	"napredni/structures/LSM"
+	"napredni/structures/WAL"
+	"napredni/structures/storageErrors"
+	"sync"
+)
+
+// Flusher writes immutable memtables to sstables and compacts levels in
+// the background, so that writes don't wait for them. Writes stall only
+// while maxImmutables memtables are waiting to be flushed.
+type Flusher struct {
+	wal           *WAL.WAL
+	lsm           *LSM.LSM
+	maxImmutables int
+	// writeMutex serializes making room in the memtable
+	// and queueing of writes to the wal.
+	writeMutex sync.Mutex
+	// levelMutex is held while levels of lsm change, by a flush
+	// of an immutable memtable or by manual compaction.
+	levelMutex sync.Mutex
+	mutex      sync.Mutex
+	cond       *sync.Cond
+	// pending is number of immutable memtables
+	// that wait to be flushed.
+	pending int
+	closed  bool
+	err     error
+	done    chan struct{}
+}
+
+// StartFlusher starts background flush of immutable memtables of passed lsm.
+func StartFlusher(wal *WAL.WAL, lsm *LSM.LSM, maxImmutables int) *Flusher {
+	if maxImmutables < 1 {
+		maxImmutables = 1
+	}
+	flusher := &Flusher{
+		wal:           wal,
+		lsm:           lsm,
+		maxImmutables: maxImmutables,
+		done:          make(chan struct{}),
+	}
+	flusher.cond = sync.NewCond(&flusher.mutex)
+	go flusher.run()
+	return flusher
+}
+
+// enqueue turns full memtable into an immutable one if passed keys can't
+// be added to it, and then queues a write to the wal with passed function.
+// Both happen under one lock, so every write that is queued before a swap
+// is committed to the old wal segment and applied to the old memtable.
+func (flusher *Flusher) enqueue(keys []string, enqueue func() *WAL.PendingWrite) (*WAL.PendingWrite, error) {
+	flusher.writeMutex.Lock()
+	defer flusher.writeMutex.Unlock()
+	if flusher.lsm.MemTable.IsFullFor(keys...) {
+		err := flusher.swap()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return enqueue(), nil
+}
+
+// swap turns the memtable into an immutable one and starts a new wal
+// segment for the new memtable. If too many immutable memtables are
+// waiting to be flushed, it waits until the oldest one is flushed.
+// Write lock must be held, so that no write is queued meanwhile.
+func (flusher *Flusher) swap() error {
+	flusher.mutex.Lock()
+	defer flusher.mutex.Unlock()
+	for flusher.err == nil && !flusher.closed && flusher.pending >= flusher.maxImmutables {
+		flusher.cond.Wait()
+	}
+	if flusher.err != nil {
+		return flusher.err
+	}
+	if flusher.closed {
+		return storageErrors.ErrClosed
+	}
+	err := flusher.wal.Rotate()
+	if err != nil {
+		return err
+	}
+	flusher.lsm.AddImmutable()
+	flusher.pending++
+	flusher.cond.Broadcast()
+	return nil
+}
+
+// run flushes immutable memtables one by one, from the oldest,
+// until the flusher is closed. It stops at the first error.
+func (flusher *Flusher) run() {
+	defer close(flusher.done)
+	for {
+		flusher.mutex.Lock()
+		for flusher.pending == 0 && !flusher.closed {
+			flusher.cond.Wait()
+		}
+		if flusher.pending == 0 {
+			flusher.mutex.Unlock()
+			return
+		}
+		flusher.mutex.Unlock()
+
+		flusher.levelMutex.Lock()
+		err := flusher.flushOldest()
+		flusher.levelMutex.Unlock()
+
+		flusher.mutex.Lock()
+		if err != nil {
+			flusher.err = err
+		} else {
+			flusher.pending--
+		}
+		flusher.cond.Broadcast()
+		flusher.mutex.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// flushOldest writes the oldest immutable memtable to a new sstable on
+// the first level and deletes wal segments whose records are now on disk.
+// Older memtables are already flushed, so every record with a sequence
+// number up to the greatest one in the memtable is durable once the
+// sstable is recorded in the manifest.
+func (flusher *Flusher) flushOldest() error {
+	records := flusher.lsm.OldestImmutable().Flush()
+	sstable, err := newSSTable(flusher.lsm, records)
+	if err != nil {
+		return err
+	}
+	flushedSeqNum := maxSeqNum(records)
+	err = flusher.lsm.AddFlushedSSTable(*sstable, flushedSeqNum)
+	if err != nil {
+		return err
+	}
+	return flusher.wal.DeleteSegmentsUpTo(flushedSeqNum)
+}
+
+// Flush turns the memtable into an immutable one and waits
+// until all immutable memtables are flushed.
+func (flusher *Flusher) Flush() error {
+	var err error
+	flusher.writeMutex.Lock()
+	if !flusher.lsm.MemTable.IsEmpty() {
+		err = flusher.swap()
+	}
+	flusher.writeMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	flusher.mutex.Lock()
+	defer flusher.mutex.Unlock()
+	for flusher.err == nil && !flusher.closed && flusher.pending > 0 {
+		flusher.cond.Wait()
+	}
+	return flusher.err
+}
+
+// CompactRange flushes the memtable, so that its records are compacted
+// too, and merges sstables that overlap range [start, end) into the last
+// level. It waits while an immutable memtable is being flushed.
+func (flusher *Flusher) CompactRange(start, end string) error {
+	err := flusher.Flush()
+	if err != nil {
+		return err
+	}
+	flusher.levelMutex.Lock()
+	defer flusher.levelMutex.Unlock()
+	return flusher.lsm.CompactRange(start, end)
+}
+
+// Close turns the memtable into an immutable one, waits until all
+// immutable memtables are flushed and stops the background flush.
+func (flusher *Flusher) Close() error {
+	var err error
+	flusher.writeMutex.Lock()
+	if !flusher.lsm.MemTable.IsEmpty() {
+		err = flusher.swap()
+	}
+	flusher.writeMutex.Unlock()
+	flusher.mutex.Lock()
+	flusher.closed = true
+	flusher.cond.Broadcast()
+	flusher.mutex.Unlock()
+	<-flusher.done
+	if err != nil {
+		return err
+	}
+	return flusher.err
+}
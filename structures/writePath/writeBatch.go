@@ -0,0 +1,63 @@
+package writePath
+
+import (
+	"napredni/structures/LSM"
+	"napredni/structures/WAL"
+	"napredni/structures/record"
+)
+
+// WriteBatch collects puts and deletes that are written together.
+// Batch is appended to the wal as a single record, so after a crash
+// either all of its changes are recovered or none of them.
+type WriteBatch struct {
+	Records []record.Record
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{Records: make([]record.Record, 0)}
+}
+
+// Put adds passed key with passed value to the batch.
+func (batch *WriteBatch) Put(key string, value []byte) {
+	batch.Records = append(batch.Records, *record.CreateRecord(key, value, 0))
+}
+
+// Delete adds deletion of passed key to the batch. Unlike Delete,
+// it doesn't check if the key exists.
+func (batch *WriteBatch) Delete(key string) {
+	batch.Records = append(batch.Records, *record.CreateRecord(key, []byte("0"), 1))
+}
+
+// Len returns number of changes in the batch.
+func (batch *WriteBatch) Len() int {
+	return len(batch.Records)
+}
+
+// Reset removes all changes from the batch, so it can be reused.
+func (batch *WriteBatch) Reset() {
+	batch.Records = batch.Records[:0]
+}
+
+// Write appends the batch to the wal and then applies its changes to the
+// memtable. Memtable is made room for all keys of the batch first, so that
+// the whole batch is applied to the memtable whose wal segment holds it.
+func Write(wal *WAL.WAL, lsm *LSM.LSM, flusher *Flusher, batch *WriteBatch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	keys := make([]string, 0, batch.Len())
+	for _, rec := range batch.Records {
+		keys = append(keys, rec.Key)
+	}
+	write, err := flusher.enqueue(keys, func() *WAL.PendingWrite {
+		return wal.EnqueueBatch(batch.Records, func() {
+			for _, rec := range batch.Records {
+				lsm.MemTable.AddRecord(rec)
+			}
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return write.Wait()
+}
@@ -1,7 +1,6 @@
 package writePath
 
 import (
-	"fmt"
 	"napredni/structures/CMS"
 	"napredni/structures/HLL"
 	"napredni/structures/LRU"
@@ -9,6 +8,7 @@ import (
 	"napredni/structures/Memtable"
 	"napredni/structures/SStable"
 	"napredni/structures/WAL"
+	"napredni/structures/configReader"
 	"napredni/structures/readPath"
 	"napredni/structures/record"
 	"napredni/structures/skipList"
@@ -20,26 +20,57 @@ import (
 // tombstone == 0 -> add
 // tombstone == 1 -> delete
 
-func InitializeWAL(lwm int, maxNumberOfRecords int) *WAL.WAL {
-	wal, err := WAL.CreateWAL("data/wal/", uint8(lwm), uint8(maxNumberOfRecords))
+func InitializeWAL(path string, lwm int, segmentSize int, syncPolicy string, syncInterval time.Duration,
+	groupCommitWindow time.Duration, recoveryMode string) (*WAL.WAL, error) {
+	policy, err := WAL.ParseSyncPolicy(syncPolicy)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return wal
+	mode, err := WAL.ParseRecoveryMode(recoveryMode)
+	if err != nil {
+		return nil, err
+	}
+	wal, err := WAL.CreateWAL(path, uint8(lwm), uint64(segmentSize), policy, syncInterval, mode)
+	if err != nil {
+		return nil, err
+	}
+	wal.GroupCommitWindow = groupCommitWindow
+	return wal, nil
 }
 
 func InitializeMemTable(capacity float64, threshold float64) *Memtable.MemTable {
 	mt := Memtable.MemTable{
 		Capacity:  capacity,
 		Threshold: threshold,
-		Sl:        &skipList.SkipList{},
+		Sl:        skipList.New(),
 	}
 
 	return &mt
 }
 
-func InitializeLSM(mem *Memtable.MemTable, lsmLevels, LsmLevelMax int) *LSM.LSM {
-	return LSM.CreateLSM(*mem, uint8(lsmLevels), uint8(LsmLevelMax))
+// InitializeLSM creates lsm tree inside of passed root directory
+// with levels, sstables and compaction set by passed configuration.
+func InitializeLSM(dir string, mem *Memtable.MemTable, config *configReader.Config) (*LSM.LSM, error) {
+	lsm := LSM.CreateLSM(dir, *mem, uint8(config.LsmLevels), uint8(config.LsmLevelMax))
+	lsm.BaseLevelSize = config.LsmBaseLevelSize
+	lsm.LevelSizeMultiplier = config.LsmLevelSizeMultiplier
+	lsm.TableSize = config.SSTableTargetSize
+	lsm.SingleFileSSTables = config.SSTableSingleFile
+	lsm.IndexInterval = config.SSTableIndexInterval
+	lsm.Tables = SStable.NewTableCache(config.SSTableMaxOpenFiles, config.SSTableMmap)
+	strategy, err := LSM.ParseCompactionStrategy(config.CompactionStrategy, config.SizeTieredThreshold)
+	if err != nil {
+		return nil, err
+	}
+	lsm.Strategy = strategy
+	for _, name := range config.SSTableCompression {
+		codec, err := SStable.ParseCodec(name)
+		if err != nil {
+			return nil, err
+		}
+		lsm.Codecs = append(lsm.Codecs, codec)
+	}
+	return lsm, nil
 }
 
 func InitializeTokenBucket(interval time.Duration, maxRequests int) *tokenBucket.TokenBucket {
@@ -51,71 +82,106 @@ func InitializeTokenBucket(interval time.Duration, maxRequests int) *tokenBucket
 	}
 }
 
-func Put(wal *WAL.WAL,  lsm *LSM.LSM, key string, value []byte) {
+// Put appends new value of passed key to the wal and adds it to the
+// memtable once it is committed together with concurrent writes.
+func Put(wal *WAL.WAL, lsm *LSM.LSM, flusher *Flusher, key string, value []byte) error {
 	newRecord := record.CreateRecord(key, value, 0)
-
-	if !wal.AddData(key, value) {
-		panic(key)
-		return
-	}
-	var records, success, _ = lsm.MemTable.AddRecord(*newRecord)
-	if !success {
-		return
-	}
-	if records != nil {
-		fmt.Println("Formira se sstable...")
-
-		level := 1
-		index := SStable.GetNewIndexForLevel(level)
-
-		filePaths := SStable.FormFilePathsForSSTable(level, index)
-
-		sstable := SStable.FormSSTable(records, filePaths[0], filePaths[1],
-			filePaths[2], filePaths[3], filePaths[4], filePaths[5])
-		lsm.AddSSTable(*sstable)
-		wal.DeleteAllSegments()
-		wal.AddData(key, value)
-	}
+	return commitRecord(wal, lsm, flusher, newRecord)
 }
 
-func PutHLL(wal *WAL.WAL,  lsm *LSM.LSM, key string){
+func PutHLL(wal *WAL.WAL, lsm *LSM.LSM, flusher *Flusher, key string) error {
 	hll := HLL.CreateHLL(4)
 	value := hll.DecodeHLL()
-	Put(wal, lsm, key, value)
+	return Put(wal, lsm, flusher, key, value)
 }
 
-func PutCMS(wal *WAL.WAL,  lsm *LSM.LSM, key string){
+func PutCMS(wal *WAL.WAL, lsm *LSM.LSM, flusher *Flusher, key string) error {
 	cms := CMS.CreateCountMinSketch(0.01, 0.01)
 	value := cms.DecodeCMS()
-	Put(wal, lsm, key, value)
+	return Put(wal, lsm, flusher, key, value)
 }
 
-func Delete(wal *WAL.WAL, cache *LRU.CacheLRU, lsm *LSM.LSM, key string) bool {
-	cache.Remove(key)
-	found, _ := readPath.Get(cache, lsm, key)
-	if !found {
-		return false
+// Delete deletes passed key. If key doesn't exist,
+// storageErrors.ErrNotFound is returned.
+func Delete(wal *WAL.WAL, cache *LRU.ShardedCache, lsm *LSM.LSM, flusher *Flusher, key string) error {
+	_, err := readPath.Get(cache, lsm, key)
+	if err != nil {
+		return err
 	}
 
-	if !wal.DeleteData(key, []byte("0")) {
-		panic("Couldn't delete from wal!")
+	newRecord := record.CreateRecord(key, []byte("0"), 1)
+	err = commitRecord(wal, lsm, flusher, newRecord)
+	if err != nil {
+		return err
 	}
+	// Key is removed from the cache only after the memtable is
+	// changed, so that a concurrent read can't cache the old value.
+	cache.Remove(key)
+	return nil
+}
 
-	newRecord := record.CreateRecord(key, []byte("0"), 1)
-	var records, _, _ = lsm.MemTable.AddRecord(*newRecord)
-	if records != nil {
-		fmt.Println("Formira se sstable...")
+// commitRecord queues passed record to the wal and waits until it is
+// committed. Record is added to the memtable by the leader of its group.
+func commitRecord(wal *WAL.WAL, lsm *LSM.LSM, flusher *Flusher, rec *record.Record) error {
+	write, err := flusher.enqueue([]string{rec.Key}, func() *WAL.PendingWrite {
+		return wal.Enqueue(rec, func() {
+			lsm.MemTable.AddRecord(*rec)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return write.Wait()
+}
 
-		level := 1
-		index := SStable.GetNewIndexForLevel(level)
+// WALToMemtable replays wal segments into the memtable. Records that
+// are already flushed to sstables are skipped, since segments are kept
+// for a while after their records are flushed.
+func WALToMemtable(wal *WAL.WAL, lsm *LSM.LSM) error {
+	flushedSeqNum := lsm.FlushedSeqNum()
+	return wal.Replay(func(rec record.Record) error {
+		if rec.SeqNum <= flushedSeqNum {
+			return nil
+		}
+		return replayRecord(lsm, rec)
+	})
+}
 
-		filePaths := SStable.FormFilePathsForSSTable(level, index)
+// replayRecord adds a record from the wal to the memtable. If memtable
+// gets full, its records are written to a sstable, but the wal is kept,
+// since it is still being read.
+func replayRecord(lsm *LSM.LSM, rec record.Record) error {
+	if lsm.MemTable.IsFullFor(rec.Key) {
+		records := lsm.MemTable.Flush()
+		lsm.MemTable.Empty()
+		sstable, err := newSSTable(lsm, records)
+		if err != nil {
+			return err
+		}
+		err = lsm.AddSSTable(*sstable, maxSeqNum(records))
+		if err != nil {
+			return err
+		}
+	}
+	lsm.MemTable.AddRecord(rec)
+	return nil
+}
 
-		sstable := SStable.FormSSTable(records, filePaths[0], filePaths[1],
-			filePaths[2], filePaths[3], filePaths[4], filePaths[5])
-		lsm.AddSSTable(*sstable)
-		wal.DeleteAllSegments()
-		wal.DeleteData(key, []byte("0"))
+// maxSeqNum returns the greatest sequence number of passed records.
+func maxSeqNum(records []record.Record) uint64 {
+	seqNum := uint64(0)
+	for _, rec := range records {
+		if rec.SeqNum > seqNum {
+			seqNum = rec.SeqNum
+		}
 	}
-	return true
+	return seqNum
+}
+
+// newSSTable forms a new sstable on the first level from flushed memtable records.
+func newSSTable(lsm *LSM.LSM, records []record.Record) (*SStable.SSTable, error) {
+	level := 1
+	index := SStable.GetNewIndexForLevel(lsm.DirPath, level)
+
+	return SStable.FormSSTableForLevelAndIndex(records, lsm.DirPath, level, index, lsm.TableOptions(level))
 }